@@ -17,6 +17,9 @@ PID=$!
 echo "qclient"
 go test qclient --port=4242 --host=localhost --bench=. --benchtime=200ms
 
+echo "qbench"
+./qbench --port=4242 --host=localhost --duration=10s --delete
+
 echo "killing qserver"
 kill $PID
 
@@ -5,13 +5,28 @@ export GOPATH=`pwd`
 echo "installing qcommon"
 go install qcommon
 
+echo "installing qrpc"
+go install qrpc
+
+echo "installing qbinary"
+go install qbinary
+
+echo "installing qraft"
+go install qraft
+
 echo "installing qclient"
 go install qclient
 
 echo "building qserver"
 go build qserver
 
+echo "building qctl"
+go build qctl
+
 echo "building test client"
 go build testqclient
 
+echo "building qbench"
+go build qbench
+
 echo "done"
@@ -33,7 +33,7 @@ if [ "200" != "$STATUS" ]; then
 fi
 
 echo "starting $CLIENT_COUNT test clients"
-for i in {0..$CLIENT_COUNT}; do
+for i in $(seq 1 $CLIENT_COUNT); do
   ./testqclient --host=$HOST --port=$PORT --count=$OP_COUNT &
 done
 
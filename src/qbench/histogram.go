@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math/bits"
+	"time"
+)
+
+// histogram counts latencies in buckets that are exact below 2^subBits
+// nanoseconds and above that split each power of two into 2^subBits, so that
+// a bucket's bounds are within about 3% of each other at any scale. It isn't
+// safe for concurrent use; each goroutine keeps its own and they are merged at
+// the end.
+type histogram struct {
+	counts	[buckets]int64
+	count	int64
+	sum	int64
+	min	int64
+	max	int64
+}
+
+const (
+	subBits = 5
+	subCount = 1 << subBits
+	buckets = (64 - subBits) * subCount
+)
+
+// bucketOf returns the bucket v, which is not negative, is counted in.
+func bucketOf(v int64) int {
+	if v < subCount {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBits - 1
+	return shift * subCount + int(v >> shift)
+}
+
+// bucketMax returns the largest value counted in bucket i.
+func bucketMax(i int) int64 {
+	if i < 2 * subCount {
+		return int64(i)
+	}
+	shift := i / subCount - 1
+	m := int64(i - shift * subCount)
+	return (m + 1) << shift - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+	h.counts[bucketOf(v)]++
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) merge(o *histogram) {
+	if o.count == 0 {
+		return
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+func (h *histogram) mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / h.count)
+}
+
+// quantile returns the latency that a fraction q of those recorded are at or
+// below, rounded up to its bucket's bound.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			if v := bucketMax(i); v < h.max {
+				return time.Duration(v)
+			}
+			break
+		}
+	}
+	return time.Duration(h.max)
+}
+
+// bucket is the number of latencies below lt and not below the previous
+// bucket's lt.
+type bucket struct {
+	lt	time.Duration
+	count	int64
+}
+
+// nonEmpty returns the buckets with a count, in order.
+func (h *histogram) nonEmpty() []bucket {
+	var out []bucket
+	for i, n := range h.counts {
+		if n > 0 {
+			out = append(out, bucket{lt: time.Duration(bucketMax(i) + 1), count: n})
+		}
+	}
+	return out
+}
+
+// powersOfTwo returns the counts in buckets bounded by powers of two
+// nanoseconds, from the minimum's to the maximum's, for printing.
+func (h *histogram) powersOfTwo() []bucket {
+	if h.count == 0 {
+		return nil
+	}
+	var out []bucket
+	lt := int64(1)
+	for lt <= h.min {
+		lt <<= 1
+	}
+	out = append(out, bucket{lt: time.Duration(lt)})
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		// no bucket straddles a power of two
+		for bucketMax(i) >= lt {
+			lt <<= 1
+			out = append(out, bucket{lt: time.Duration(lt)})
+		}
+		out[len(out) - 1].count += n
+	}
+	return out
+}
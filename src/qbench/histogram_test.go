@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	for i := 0; i < buckets; i++ {
+		max := bucketMax(i)
+		if bucketOf(max) != i || bucketOf(max + 1) != i + 1 && i + 1 < buckets {
+			t.Fatalf("bucket %d ends at %d, which is in %d, followed by %d", i, max, bucketOf(max), bucketOf(max + 1))
+		}
+		if min := bucketMax(i - 1) + 1; i > 0 && float64(max - min) > float64(min) / subCount {
+			t.Fatalf("bucket %d from %d to %d is too wide", i, min, max)
+		}
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	var h histogram
+	for v := 1; v <= 1000; v++ {
+		h.record(time.Duration(v) * time.Microsecond)
+	}
+	for _, c := range []struct {
+		q	float64
+		want	time.Duration
+	}{{0.5, 500 * time.Microsecond}, {0.9, 900 * time.Microsecond}, {0.99, 990 * time.Microsecond}, {0.999, 999 * time.Microsecond}, {1, time.Millisecond}} {
+		got := h.quantile(c.q)
+		if got < c.want || float64(got - c.want) > float64(c.want) / subCount {
+			t.Errorf("quantile %g: want about %v, got %v", c.q, c.want, got)
+		}
+	}
+	if h.mean() != 500500 * time.Nanosecond || h.min != int64(time.Microsecond) || h.max != int64(time.Millisecond) {
+		t.Errorf("mean %v, min %d, max %d", h.mean(), h.min, h.max)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var a, b, all histogram
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		d := time.Duration(r.ExpFloat64() * float64(time.Millisecond))
+		if i % 2 == 0 {
+			a.record(d)
+		} else {
+			b.record(d)
+		}
+		all.record(d)
+	}
+	a.merge(&b)
+	if a != all {
+		t.Errorf("merged histograms differ from one histogram of everything")
+	}
+	var counted int64
+	for _, bucket := range a.powersOfTwo() {
+		counted += bucket.count
+	}
+	if counted != a.count {
+		t.Errorf("powers of two count %d of %d", counted, a.count)
+	}
+}
+
+func TestParseSizes(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, c := range []struct {
+		spec	string
+		min	int
+		max	int
+	}{{"100", 100, 100}, {"uniform:10-20", 10, 20}, {"exp:50", 0, 1000}} {
+		s, err := parseSizes(c.spec)
+		if err != nil {
+			t.Errorf("%s: %v", c.spec, err)
+			continue
+		}
+		for i := 0; i < 1000; i++ {
+			if n := s.next(r); n < c.min || n > c.max {
+				t.Errorf("%s: got size %d", c.spec, n)
+			}
+		}
+	}
+	for _, spec := range []string{"", "-1", "uniform:20-10", "uniform:10", "exp:0", "normal:5"} {
+		if _, err := parseSizes(spec); err == nil {
+			t.Errorf("%q: want error", spec)
+		}
+	}
+}
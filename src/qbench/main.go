@@ -0,0 +1,306 @@
+// qbench measures a qserver's throughput and latency under load. It runs
+// --producers goroutines enqueuing objects, with sizes drawn from --payload, and
+// --consumers goroutines dequeuing them for --duration, and then reports the
+// operations per second and latency percentiles of enqueues, dequeues and,
+// for payloads of at least 16 bytes, the time from enqueue to dequeue.
+//
+//	qbench [flags]
+//
+// --payload is a size in bytes, uniform:MIN-MAX or exp:MEAN. With --rate the
+// producers enqueue on a fixed schedule, sharing the rate between them, and
+// their latencies are measured from when each enqueue was due, so that a
+// server falling behind shows up as latency rather than as a lower rate.
+// Consumers dequeue as fast as they can, waiting --poll between tries while
+// the queue is empty. The queue is created if it doesn't exist and, with
+// --delete, deleted afterwards. The report is a table, followed with
+// --histogram by each latency's distribution, or JSON with --output=json. An
+// interrupt ends the run early and reports what was measured so far.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"qclient"
+	"qcommon"
+	"qrpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	port = flag.Int("port", 4242, "the port the server is listening on")
+	host = flag.String("host", "localhost", "the host the server is running on")
+	cluster = flag.String("cluster", "", "comma-separated host:port of a clustered server's nodes, used instead of --host and --port")
+	grpcPort = flag.Int("grpc_port", 0, "if set, use the gRPC API on this port instead of HTTP")
+	binaryPort = flag.Int("binary_port", 0, "if set, use the binary protocol on this port instead of HTTP")
+	token = flag.String("token", "", "bearer token for servers that require authentication")
+	tlsCA = flag.String("tls_ca", "", "if set, connect over TLS trusting this PEM CA bundle")
+	tlsCert = flag.String("tls_cert", "", "PEM client certificate to present over TLS")
+	tlsKey = flag.String("tls_key", "", "PEM private key for --tls_cert")
+	queue = flag.String("queue", "qbench", "the queue to use, created if it doesn't exist")
+	deleteQueue = flag.Bool("delete", false, "delete the queue afterwards")
+	producers = flag.Int("producers", 4, "the number of goroutines enqueuing")
+	consumers = flag.Int("consumers", 4, "the number of goroutines dequeuing")
+	duration = flag.Duration("duration", 10 * time.Second, "how long to run for")
+	rate = flag.Float64("rate", 0, "enqueues per second across all producers, or 0 for as many as the server takes")
+	payload = flag.String("payload", "100", "payload sizes: N bytes, uniform:MIN-MAX or exp:MEAN")
+	poll = flag.Duration("poll", time.Millisecond, "how long consumers wait after finding the queue empty")
+	output = flag.String("output", "table", "output format, table or json")
+	showHistogram = flag.Bool("histogram", false, "follow the table with the latency distributions")
+)
+
+// stampSize is the length of the stamp at the start of payloads that are long
+// enough for one: the run's tag, so that objects left in the queue by other
+// runs aren't mistaken for this one's, and when the object was enqueued.
+const stampSize = 16
+
+// bench is what a run's goroutines share.
+type bench struct {
+	transport	qclient.Transport
+	id	qcommon.QueueId
+	sizes	sizes
+	tag	uint64
+	start	time.Time
+	deadline	time.Time
+}
+
+// stats is what one goroutine measured.
+type stats struct {
+	latency	histogram
+	endToEnd	histogram
+	ops	int64
+	bytes	int64
+	errors	int64
+	empty	int64
+}
+
+func main() {
+	flag.Parse()
+	if *producers < 0 || *consumers < 0 || *producers + *consumers == 0 {
+		log.Fatal("need at least one producer or consumer")
+	}
+	if *duration <= 0 || *rate < 0 {
+		log.Fatal("--duration must be positive and --rate not negative")
+	}
+	if *output != "table" && *output != "json" {
+		log.Fatalf("unknown output format %q", *output)
+	}
+	sizes, err := parseSizes(*payload)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	qclient.Host = *host
+	qclient.Port = *port
+	if *cluster != "" {
+		qclient.Cluster = strings.Split(*cluster, ",")
+	}
+	qclient.Token = *token
+	if *tlsCA != "" {
+		config, err := qcommon.ClientTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		qclient.TLSConfig = config
+	}
+	// keep a connection per goroutine alive rather than redialing
+	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = *producers + *consumers
+	transport, transportName := qclient.DefaultTransport, "http"
+	if *grpcPort != 0 {
+		transport, transportName = qclient.NewGRPCTransport(fmt.Sprintf("%s:%d", *host, *grpcPort), nil), "grpc"
+	}
+	if *binaryPort != 0 {
+		transport, err = qclient.NewBinaryTransport("tcp", fmt.Sprintf("%s:%d", *host, *binaryPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		transportName = "binary"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	id, err := transport.GetQueue(ctx, *queue)
+	if err != nil {
+		if id, err = transport.CreateQueue(ctx, *queue); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	b := &bench{transport: transport, id: id, sizes: sizes, tag: rand.Uint64()}
+	r := b.run(ctx)
+	r.Transport = transportName
+	if *deleteQueue {
+		if err := transport.DeleteQueue(context.Background(), id); err != nil {
+			log.Printf("deleting %s: %v", *queue, err)
+		}
+	}
+
+	if *output == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(r); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	r.print()
+}
+
+// run runs the producers and consumers until the deadline or until ctx is
+// done, and reports what they measured.
+func (b *bench) run(ctx context.Context) *report {
+	b.start = time.Now()
+	b.deadline = b.start.Add(*duration)
+	produced := make([]*stats, *producers)
+	consumed := make([]*stats, *consumers)
+	var wg sync.WaitGroup
+	for i := range produced {
+		produced[i] = &stats{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.produce(ctx, i, produced[i])
+		}(i)
+	}
+	for i := range consumed {
+		consumed[i] = &stats{}
+		wg.Add(1)
+		go func(s *stats) {
+			defer wg.Done()
+			b.consume(ctx, s)
+		}(consumed[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(b.start)
+
+	r := &report{
+		Queue:		*queue,
+		Producers:	*producers,
+		Consumers:	*consumers,
+		Payload:	b.sizes.spec,
+		Rate:		*rate,
+		Seconds:	elapsed.Seconds(),
+	}
+	r.endToEnd = &histogram{}
+	r.Enqueue = newOpReport(produced, elapsed, nil)
+	r.Dequeue = newOpReport(consumed, elapsed, r.endToEnd)
+	if r.endToEnd.count > 0 {
+		l := newLatencyReport(r.endToEnd)
+		r.EndToEnd = &l
+	}
+	return r
+}
+
+func (b *bench) produce(ctx context.Context, i int, s *stats) {
+	r := rand.New(rand.NewSource(b.start.UnixNano() + int64(i)))
+	buf := make([]byte, b.sizes.max)
+	r.Read(buf)
+	var interval time.Duration
+	next := b.start
+	if *rate > 0 {
+		// stagger the producers' schedules across the interval
+		interval = time.Duration(float64(*producers) / *rate * float64(time.Second))
+		next = b.start.Add(interval * time.Duration(i) / time.Duration(*producers))
+	}
+	for ctx.Err() == nil {
+		due := time.Now()
+		if interval > 0 {
+			due, next = next, next.Add(interval)
+			if due.After(b.deadline) || sleep(ctx, time.Until(due)) != nil {
+				return
+			}
+		} else if due.After(b.deadline) {
+			return
+		}
+		object := buf[:b.sizes.next(r)]
+		b.stamp(object)
+		err := b.transport.Enqueue(ctx, b.id, object)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.fail("enqueue", err)
+			continue
+		}
+		s.latency.record(time.Since(due))
+		s.ops++
+		s.bytes += int64(len(object))
+	}
+}
+
+func (b *bench) consume(ctx context.Context, s *stats) {
+	for ctx.Err() == nil && time.Now().Before(b.deadline) {
+		begin := time.Now()
+		object, err := b.transport.Dequeue(ctx, b.id)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case isEmpty(err):
+			s.empty++
+			sleep(ctx, *poll)
+		case err != nil:
+			s.fail("dequeue", err)
+		default:
+			s.latency.record(time.Since(begin))
+			s.ops++
+			s.bytes += int64(len(object))
+			if age, ok := b.age(object); ok {
+				s.endToEnd.record(age)
+			}
+		}
+	}
+}
+
+// stamp writes the run's tag and the time into object, if it is long enough.
+func (b *bench) stamp(object []byte) {
+	if len(object) < stampSize {
+		return
+	}
+	binary.BigEndian.PutUint64(object, b.tag)
+	binary.BigEndian.PutUint64(object[8:], uint64(time.Since(b.start)))
+}
+
+// age returns how long ago object was stamped, if it was by this run.
+func (b *bench) age(object []byte) (time.Duration, bool) {
+	if len(object) < stampSize || binary.BigEndian.Uint64(object) != b.tag {
+		return 0, false
+	}
+	return time.Since(b.start) - time.Duration(binary.BigEndian.Uint64(object[8:])), true
+}
+
+// fail counts an error, logging the goroutine's first.
+func (s *stats) fail(op string, err error) {
+	s.errors++
+	if s.errors == 1 {
+		log.Printf("%s: %v", op, err)
+	}
+}
+
+// isEmpty reports whether err is a dequeue from an empty queue. The HTTP API
+// says so only in its message.
+func isEmpty(err error) bool {
+	return errors.Is(err, qrpc.ErrEmpty) || err != nil && strings.Contains(err.Error(), "empty queue")
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
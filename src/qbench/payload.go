@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// sizes is a distribution of payload sizes, parsed from --payload:
+//
+//	N			every payload is N bytes
+//	uniform:MIN-MAX		uniformly between MIN and MAX bytes
+//	exp:MEAN		exponentially with mean MEAN bytes, up to 20×MEAN
+type sizes struct {
+	spec	string
+	min	int
+	max	int
+	mean	float64
+	exp	bool
+}
+
+func parseSizes(spec string) (sizes, error) {
+	kind, arg, found := strings.Cut(spec, ":")
+	if !found {
+		n, err := strconv.Atoi(spec)
+		if err != nil || n < 0 {
+			return sizes{}, fmt.Errorf("bad payload size %q", spec)
+		}
+		return sizes{spec: spec, min: n, max: n}, nil
+	}
+	switch kind {
+	case "uniform":
+		lo, hi, _ := strings.Cut(arg, "-")
+		min, err1 := strconv.Atoi(lo)
+		max, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || min < 0 || max < min {
+			return sizes{}, fmt.Errorf("bad uniform payload sizes %q, want uniform:MIN-MAX", spec)
+		}
+		return sizes{spec: spec, min: min, max: max}, nil
+	case "exp":
+		mean, err := strconv.Atoi(arg)
+		if err != nil || mean <= 0 {
+			return sizes{}, fmt.Errorf("bad exponential payload size %q, want exp:MEAN", spec)
+		}
+		return sizes{spec: spec, max: 20 * mean, mean: float64(mean), exp: true}, nil
+	}
+	return sizes{}, fmt.Errorf("unknown payload size distribution %q", kind)
+}
+
+// next returns a payload size drawn from s.
+func (s sizes) next(r *rand.Rand) int {
+	switch {
+	case s.exp:
+		if n := int(r.ExpFloat64() * s.mean); n < s.max {
+			return n
+		}
+		return s.max
+	case s.max > s.min:
+		return s.min + r.Intn(s.max - s.min + 1)
+	}
+	return s.min
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// report is what qbench prints, with latencies in microseconds.
+type report struct {
+	Transport	string	`json:"transport"`
+	Queue	string	`json:"queue"`
+	Producers	int	`json:"producers"`
+	Consumers	int	`json:"consumers"`
+	Payload	string	`json:"payload"`
+	// 0 is unlimited
+	Rate	float64	`json:"rate"`
+	Seconds	float64	`json:"seconds"`
+	Enqueue	opReport	`json:"enqueue"`
+	Dequeue	opReport	`json:"dequeue"`
+	// nil if no payload carried a stamp
+	EndToEnd	*latencyReport	`json:"end_to_end,omitempty"`
+
+	endToEnd	*histogram
+}
+
+type opReport struct {
+	Ops	int64	`json:"ops"`
+	Errors	int64	`json:"errors"`
+	// dequeues that found the queue empty, which aren't in Ops or Latency
+	Empty	int64	`json:"empty,omitempty"`
+	Bytes	int64	`json:"bytes"`
+	OpsPerSecond	float64	`json:"ops_per_second"`
+	BytesPerSecond	float64	`json:"bytes_per_second"`
+	Latency	latencyReport	`json:"latency"`
+
+	histogram	*histogram
+}
+
+type latencyReport struct {
+	Count	int64	`json:"count"`
+	Min	float64	`json:"min_us"`
+	Mean	float64	`json:"mean_us"`
+	P50	float64	`json:"p50_us"`
+	P90	float64	`json:"p90_us"`
+	P99	float64	`json:"p99_us"`
+	P999	float64	`json:"p999_us"`
+	Max	float64	`json:"max_us"`
+	Buckets	[]bucketReport	`json:"buckets"`
+}
+
+// bucketReport counts the latencies below LessThan and not below the
+// previous bucket's.
+type bucketReport struct {
+	LessThan	float64	`json:"lt_us"`
+	Count	int64	`json:"count"`
+}
+
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// newOpReport merges what each goroutine measured, adding their end to end
+// latencies to endToEnd if it isn't nil.
+func newOpReport(all []*stats, elapsed time.Duration, endToEnd *histogram) opReport {
+	h := &histogram{}
+	r := opReport{histogram: h}
+	for _, s := range all {
+		h.merge(&s.latency)
+		if endToEnd != nil {
+			endToEnd.merge(&s.endToEnd)
+		}
+		r.Ops += s.ops
+		r.Errors += s.errors
+		r.Empty += s.empty
+		r.Bytes += s.bytes
+	}
+	r.OpsPerSecond = float64(r.Ops) / elapsed.Seconds()
+	r.BytesPerSecond = float64(r.Bytes) / elapsed.Seconds()
+	r.Latency = newLatencyReport(h)
+	return r
+}
+
+func newLatencyReport(h *histogram) latencyReport {
+	r := latencyReport{
+		Count:	h.count,
+		Min:	micros(time.Duration(h.min)),
+		Mean:	micros(h.mean()),
+		P50:	micros(h.quantile(0.5)),
+		P90:	micros(h.quantile(0.9)),
+		P99:	micros(h.quantile(0.99)),
+		P999:	micros(h.quantile(0.999)),
+		Max:	micros(time.Duration(h.max)),
+		Buckets:	[]bucketReport{},
+	}
+	for _, b := range h.nonEmpty() {
+		r.Buckets = append(r.Buckets, bucketReport{LessThan: micros(b.lt), Count: b.count})
+	}
+	return r
+}
+
+// formatMicros formats a latency in microseconds as a duration.
+func formatMicros(us float64) string {
+	return formatLatency(time.Duration(us * float64(time.Microsecond)))
+}
+
+// formatLatency formats d to three or four significant digits.
+func formatLatency(d time.Duration) string {
+	unit := time.Duration(1)
+	for limit := time.Microsecond; d >= limit && unit < time.Second; limit *= 10 {
+		unit *= 10
+	}
+	return d.Round(unit / 10).String()
+}
+
+func (r *report) print() {
+	rate := "unlimited"
+	if r.Rate > 0 {
+		rate = fmt.Sprintf("%g/s", r.Rate)
+	}
+	fmt.Printf("%d producers, %d consumers over %s to %s for %.1fs, payload %s, rate %s\n\n", r.Producers, r.Consumers, r.Transport, r.Queue, r.Seconds, r.Payload, rate)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "\tOPS\tOPS/S\tMB/S\tERRORS\tEMPTY\tMIN\tMEAN\tP50\tP90\tP99\tP99.9\tMAX\n")
+	for _, op := range []struct {
+		name	string
+		r	opReport
+	}{{"enqueue", r.Enqueue}, {"dequeue", r.Dequeue}} {
+		l := op.r.Latency
+		fmt.Fprintf(w, "%s\t%d\t%.0f\t%.2f\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", op.name, op.r.Ops, op.r.OpsPerSecond, op.r.BytesPerSecond / 1e6, op.r.Errors, op.r.Empty,
+			formatMicros(l.Min), formatMicros(l.Mean), formatMicros(l.P50), formatMicros(l.P90), formatMicros(l.P99), formatMicros(l.P999), formatMicros(l.Max))
+	}
+	if l := r.EndToEnd; l != nil {
+		fmt.Fprintf(w, "end to end\t%d\t\t\t\t\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", l.Count,
+			formatMicros(l.Min), formatMicros(l.Mean), formatMicros(l.P50), formatMicros(l.P90), formatMicros(l.P99), formatMicros(l.P999), formatMicros(l.Max))
+	}
+	w.Flush()
+
+	if !*showHistogram {
+		return
+	}
+	printHistogram("enqueue", r.Enqueue.histogram)
+	printHistogram("dequeue", r.Dequeue.histogram)
+	printHistogram("end to end", r.endToEnd)
+}
+
+// printHistogram prints h's latencies in buckets bounded by powers of two,
+// with bars scaled to the fullest.
+func printHistogram(name string, h *histogram) {
+	buckets := h.powersOfTwo()
+	if len(buckets) == 0 {
+		return
+	}
+	var most int64
+	for _, b := range buckets {
+		if b.count > most {
+			most = b.count
+		}
+	}
+	fmt.Printf("\n%s latency:\n", name)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, b := range buckets {
+		bar := strings.Repeat("#", int((b.count * histogramWidth + most - 1) / most))
+		fmt.Fprintf(w, "  < %s\t%d\t%.2f%%\t%s\n", formatLatency(b.lt), b.count, 100 * float64(b.count) / float64(h.count), bar)
+	}
+	w.Flush()
+}
+
+// histogramWidth is the length of the fullest bucket's bar.
+const histogramWidth = 40
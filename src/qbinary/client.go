@@ -0,0 +1,181 @@
+package qbinary
+
+import (
+	"context"
+	"crypto/tls"
+	"bufio"
+	"fmt"
+	"net"
+	"qcommon"
+	"qrpc"
+	"sync"
+	"sync/atomic"
+)
+
+// Client calls a qserver over the binary protocol on a single connection.
+// Concurrent calls are pipelined. It implements qrpc.QueueService.
+type Client struct {
+	conn	net.Conn
+
+	// writers counts callers waiting to write so that only the last of a
+	// burst flushes.
+	writers	int32
+	wmu	sync.Mutex
+	w	*bufio.Writer
+
+	mu	sync.Mutex
+	pending	map[uint32]chan frame
+	nextRequest	uint32
+	err	error
+}
+
+// Dial connects to a server. network is "tcp" or "unix".
+func Dial(network, addr string) (*Client, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// DialTLS connects to a server over TLS.
+func DialTLS(network, addr string, config *tls.Config) (*Client, error) {
+	conn, err := tls.Dial(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient returns a client using an established connection.
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn:		conn,
+		w:		bufio.NewWriter(conn),
+		pending:	map[uint32]chan frame{},
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) readLoop() {
+	r := bufio.NewReader(c.conn)
+	for {
+		resp, err := readFrame(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		ch, present := c.pending[resp.request]
+		delete(c.pending, resp.request)
+		c.mu.Unlock()
+		if present {
+			ch <- resp
+		}
+	}
+}
+
+// fail closes the connection and wakes every outstanding call.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = qrpc.Errorf(qrpc.Unavailable, "connection lost: %v", err)
+	}
+	for request, ch := range c.pending {
+		close(ch)
+		delete(c.pending, request)
+	}
+	c.conn.Close()
+}
+
+func (c *Client) call(ctx context.Context, op byte, id []byte, body []byte) (frame, error) {
+	ch := make(chan frame, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return frame{}, err
+	}
+	c.nextRequest++
+	request := c.nextRequest
+	c.pending[request] = ch
+	c.mu.Unlock()
+
+	atomic.AddInt32(&c.writers, 1)
+	c.wmu.Lock()
+	err := writeFrame(c.w, frame{kind: op, request: request, id: id, body: body})
+	if atomic.AddInt32(&c.writers, -1) == 0 && err == nil {
+		err = c.w.Flush()
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+
+	var resp frame
+	var ok bool
+	select {
+	case resp, ok = <-ch:
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, request)
+		c.mu.Unlock()
+		return frame{}, ctx.Err()
+	}
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return frame{}, c.err
+	}
+	if code := qrpc.Code(resp.kind); code != qrpc.OK {
+		if code == qrpc.OutOfRange {
+			return frame{}, qrpc.ErrEmpty
+		}
+		return frame{}, &qrpc.Status{Code: code, Message: string(resp.body)}
+	}
+	return resp, nil
+}
+
+// Authenticate sends a token for servers that require one. Requests made
+// before it returns may be rejected.
+func (c *Client) Authenticate(ctx context.Context, token string) error {
+	_, err := c.call(ctx, OpAuth, nil, []byte(token))
+	return err
+}
+
+func (c *Client) CreateQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	resp, err := c.call(ctx, OpCreate, []byte(name), nil)
+	return qcommon.QueueId(resp.id), err
+}
+
+func (c *Client) GetQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	resp, err := c.call(ctx, OpGet, []byte(name), nil)
+	return qcommon.QueueId(resp.id), err
+}
+
+func (c *Client) DeleteQueue(ctx context.Context, id qcommon.QueueId) error {
+	_, err := c.call(ctx, OpDelete, []byte(id), nil)
+	return err
+}
+
+func (c *Client) Enqueue(ctx context.Context, id qcommon.QueueId, object qcommon.Object) error {
+	_, err := c.call(ctx, OpEnqueue, []byte(id), object)
+	return err
+}
+
+func (c *Client) Dequeue(ctx context.Context, id qcommon.QueueId) (qcommon.Object, error) {
+	resp, err := c.call(ctx, OpDequeue, []byte(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	if string(resp.id) != string(id) {
+		return nil, fmt.Errorf("Mismatch queue ids: %q vs %q", resp.id, id)
+	}
+	return qcommon.Object(resp.body), nil
+}
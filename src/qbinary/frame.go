@@ -0,0 +1,91 @@
+// Package qbinary implements a compact length-prefixed protocol for talking to
+// qserver over TCP or Unix sockets.
+//
+// Every frame is
+//
+//	length	uint32	bytes following this field
+//	kind	uint8	op for requests, qrpc status code for responses
+//	request	uint32	id chosen by the client, echoed in the response
+//	idLen	uint16
+//	id	[idLen]byte	queue name or id
+//	body	[]byte	object for enqueue and dequeue, error message on failure
+//
+// with integers in big-endian order. Requests may be pipelined; responses
+// carry the request id they answer.
+package qbinary
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	OpCreate byte = iota + 1
+	OpGet
+	OpDelete
+	OpEnqueue
+	OpDequeue
+
+	// OpAuth authenticates the connection with the token in the body.
+	OpAuth
+)
+
+const (
+	headerSize = 4 + 1 + 4 + 2
+	maxFrameSize = 64 << 20
+)
+
+type frame struct {
+	kind	byte
+	request	uint32
+	id	[]byte
+	body	[]byte
+}
+
+func writeFrame(w *bufio.Writer, f frame) error {
+	if len(f.id) > 0xffff {
+		return fmt.Errorf("queue id of %d bytes is too long", len(f.id))
+	}
+	var hdr [headerSize]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(headerSize - 4 + len(f.id) + len(f.body)))
+	hdr[4] = f.kind
+	binary.BigEndian.PutUint32(hdr[5:], f.request)
+	binary.BigEndian.PutUint16(hdr[9:], uint16(len(f.id)))
+	w.Write(hdr[:])
+	w.Write(f.id)
+	_, err := w.Write(f.body)
+	return err
+}
+
+// readFrame reads the next frame. Returns io.EOF if the stream ends cleanly
+// between frames.
+func readFrame(r *bufio.Reader) (frame, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return frame{}, fmt.Errorf("truncated frame header")
+		}
+		return frame{}, err
+	}
+	length := binary.BigEndian.Uint32(hdr[0:])
+	idLen := uint32(binary.BigEndian.Uint16(hdr[9:]))
+	if length > maxFrameSize {
+		return frame{}, fmt.Errorf("frame of %d bytes exceeds limit", length)
+	}
+	if length < headerSize - 4 + idLen {
+		return frame{}, fmt.Errorf("malformed frame")
+	}
+
+	payload := make([]byte, length - (headerSize - 4))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, fmt.Errorf("truncated frame: %v", err)
+	}
+	return frame{
+		kind:		hdr[4],
+		request:	binary.BigEndian.Uint32(hdr[5:]),
+		id:		payload[:idLen],
+		body:		payload[idLen:],
+	}, nil
+}
@@ -0,0 +1,44 @@
+package qbinary
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	want := []frame{
+		{kind: OpEnqueue, request: 1, id: []byte("q"), body: []byte("object\x00")},
+		{kind: OpDequeue, request: 2, id: []byte("q")},
+		{kind: OpCreate, request: 3},
+	}
+	for _, f := range want {
+		writeFrame(w, f)
+	}
+	w.Flush()
+
+	r := bufio.NewReader(&buf)
+	for _, f := range want {
+		got, err := readFrame(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.kind != f.kind || got.request != f.request || !bytes.Equal(got.id, f.id) || !bytes.Equal(got.body, f.body) {
+			t.Errorf("want %+v, got %+v", f, got)
+		}
+	}
+	if _, err := readFrame(r); err != io.EOF {
+		t.Errorf("want EOF, got %v", err)
+	}
+}
+
+func TestReadMalformedFrame(t *testing.T) {
+	// id length longer than the frame
+	b := []byte{0, 0, 0, 7, OpGet, 0, 0, 0, 1, 0, 9}
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(b))); err == nil {
+		t.Errorf("expected error for malformed frame")
+	}
+}
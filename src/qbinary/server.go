@@ -0,0 +1,247 @@
+package qbinary
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"bufio"
+	"net"
+	"qcommon"
+	"qrpc"
+	"sync"
+	"time"
+)
+
+// Server serves a QueueService over the binary protocol.
+type Server struct {
+	svc	qrpc.QueueService
+
+	// If set, connections must send OpAuth with a token accepted by
+	// Authenticate before any other request, unless they are TLS connections
+	// with a verified client certificate.
+	Authenticate	func(token string) (principal string, ok bool)
+
+	mu	sync.Mutex
+	listeners	map[net.Listener]bool
+	conns	map[net.Conn]bool	// true while a request is being handled
+	closed	bool
+}
+
+func NewServer(svc qrpc.QueueService) *Server {
+	return &Server{
+		svc:		svc,
+		listeners:	map[net.Listener]bool{},
+		conns:		map[net.Conn]bool{},
+	}
+}
+
+// Serve accepts connections on l until it fails or the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			delete(s.listeners, l)
+			if s.closed {
+				err = net.ErrClosed
+			}
+			s.mu.Unlock()
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return net.ErrClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops all listeners and closes open connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+// Shutdown stops all listeners, closes idle connections and waits for the
+// rest to finish the requests they have sent before closing them too. If ctx
+// expires first, remaining connections are closed and ctx's error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if s.closeIdle() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdle closes connections not handling a request, returning whether
+// there are none left.
+func (s *Server) closeIdle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c, active := range s.conns {
+		if !active {
+			c.Close()
+			delete(s.conns, c)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = false
+	return true
+}
+
+// setActive marks whether conn is handling a request. Marking it idle
+// returns false if the server is shutting down and conn should close.
+func (s *Server) setActive(conn net.Conn, active bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, present := s.conns[conn]; !present {
+		return false
+	}
+	s.conns[conn] = active
+	return active || !s.closed
+}
+
+// serveConn handles requests in order, flushing responses whenever there are
+// no more pipelined requests already buffered. Once the server shuts down,
+// the connection closes after its buffered requests have been answered.
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authenticated := s.Authenticate == nil
+	ctx := qcommon.WithRemoteAddr(context.Background(), conn.RemoteAddr().String())
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		state := tlsConn.ConnectionState()
+		if principal, ok := qcommon.CertPrincipal(&state); ok {
+			ctx = qcommon.WithPrincipal(ctx, principal)
+			authenticated = true
+		}
+	}
+	for {
+		req, err := readFrame(r)
+		if err != nil || !s.setActive(conn, true) {
+			return
+		}
+
+		var resp frame
+		switch {
+		case req.kind == OpAuth:
+			resp = s.authenticate(req, &ctx, &authenticated)
+		case !authenticated:
+			resp = errorFrame(req, qrpc.Errorf(qrpc.Unauthenticated, "Missing or invalid token"))
+		default:
+			resp = s.handle(ctx, req)
+		}
+		if err := writeFrame(w, resp); err != nil {
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil || !s.setActive(conn, false) {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) handle(ctx context.Context, req frame) frame {
+	resp := frame{request: req.request}
+	var err error
+	switch req.kind {
+	case OpCreate:
+		var id qcommon.QueueId
+		id, err = s.svc.CreateQueue(ctx, string(req.id))
+		resp.id = []byte(id)
+	case OpGet:
+		var id qcommon.QueueId
+		id, err = s.svc.GetQueue(ctx, string(req.id))
+		resp.id = []byte(id)
+	case OpDelete:
+		err = s.svc.DeleteQueue(ctx, qcommon.QueueId(req.id))
+	case OpEnqueue:
+		err = s.svc.Enqueue(ctx, qcommon.QueueId(req.id), req.body)
+	case OpDequeue:
+		resp.id = req.id
+		resp.body, err = s.svc.Dequeue(ctx, qcommon.QueueId(req.id))
+	default:
+		err = qrpc.Errorf(qrpc.Unimplemented, "unknown op %d", req.kind)
+	}
+
+	if err != nil {
+		return errorFrame(req, err)
+	}
+	return resp
+}
+
+// authenticate checks an OpAuth token and records the principal in the
+// connection's context.
+func (s *Server) authenticate(req frame, ctx *context.Context, authenticated *bool) frame {
+	if s.Authenticate == nil {
+		return frame{request: req.request}
+	}
+	principal, ok := s.Authenticate(string(req.body))
+	if !ok {
+		*authenticated = false
+		*ctx = qcommon.WithPrincipal(*ctx, "")
+		return errorFrame(req, qrpc.Errorf(qrpc.Unauthenticated, "Invalid token"))
+	}
+	*authenticated = true
+	*ctx = qcommon.WithPrincipal(*ctx, principal)
+	return frame{request: req.request}
+}
+
+func errorFrame(req frame, err error) frame {
+	resp := frame{kind: byte(qrpc.CodeOf(err)), request: req.request, body: []byte(err.Error())}
+	var s *qrpc.Status
+	if errors.As(err, &s) {
+		resp.body = []byte(s.Message)
+	}
+	return resp
+}
@@ -0,0 +1,295 @@
+package qclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"qcommon"
+)
+
+// The administrative methods below use the versioned HTTP API of the client's
+// server, whatever its transport is, since the other protocols only carry
+// queue operations. Queues are addressed by name. The package level functions
+// of the same names use the default client.
+
+// APIError is an error response from the versioned HTTP API.
+type APIError struct {
+	StatusCode	int
+	Code	string
+	Message	string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func queuePath(name string, rest string) string {
+	return "v1/queues/" + url.PathEscape(name) + rest
+}
+
+// rest sends in, if set, as JSON and decodes a successful response into out,
+// if set. Errors are *APIError where the server sent one.
+func (c *Client) rest(ctx context.Context, method, path string, in interface{}, out interface{}) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.restAt(ctx, "", method, path, in, out)
+}
+
+// restAt is rest against the server at addr, or c's server if addr is empty.
+func (c *Client) restAt(ctx context.Context, addr string, method, path string, in interface{}, out interface{}) error {
+	var body []byte
+	contentType := ""
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+	resp, b, err := c.request(ctx, addr, method, path, contentType, body, "application/json")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return apiError(resp, b)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// apiError returns the error an unsuccessful response with body b carries.
+func apiError(resp *http.Response, b []byte) error {
+	var e qcommon.ErrorData
+	if json.Unmarshal(b, &e) != nil || e.Error.Code == "" {
+		return fmt.Errorf("%s: %s", resp.Status, string(b))
+	}
+	return &APIError{resp.StatusCode, e.Error.Code, e.Error.Message}
+}
+
+// stream sends body, if set, to c's server and returns the response for the
+// caller to read and close. Since body can't be sent twice, requests aren't
+// retried or failed over.
+func (c *Client) stream(ctx context.Context, method, path string, contentType string, body io.Reader, accept string) (*http.Response, error) {
+	config := c.settings()
+	r, err := newRequest(ctx, config, c.currentNode(config), method, path, contentType, body, accept)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := config.httpClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, apiError(resp, b)
+	}
+	return resp, nil
+}
+
+// ListQueues returns the queues the caller may access.
+func (c *Client) ListQueues(ctx context.Context) ([]qcommon.QueueData, error) {
+	var list qcommon.QueueListData
+	err := c.rest(ctx, "GET", "v1/queues", nil, &list)
+	return list.Queues, err
+}
+
+// DescribeQueue returns a queue's settings.
+func (c *Client) DescribeQueue(ctx context.Context, name string) (qcommon.QueueData, error) {
+	var data qcommon.QueueData
+	err := c.rest(ctx, "GET", queuePath(name, ""), nil, &data)
+	return data, err
+}
+
+// CreateQueueWithSettings creates a queue, leaving zero settings to the
+// server's defaults, and returns the settings it was created with.
+func (c *Client) CreateQueueWithSettings(ctx context.Context, name string, settings qcommon.QueueSettings) (qcommon.QueueData, error) {
+	var data qcommon.QueueData
+	err := c.rest(ctx, "PUT", queuePath(name, ""), qcommon.QueueData{Name: name, Settings: &settings}, &data)
+	return data, err
+}
+
+// Stats returns the server's memory use and stats of the queues the caller
+// may access.
+func (c *Client) Stats(ctx context.Context) (qcommon.ServerStats, error) {
+	var stats qcommon.ServerStats
+	err := c.rest(ctx, "GET", "v1/stats", nil, &stats)
+	return stats, err
+}
+
+// QueueStats returns a queue's depth, memory use and throughput.
+func (c *Client) QueueStats(ctx context.Context, name string) (qcommon.QueueStats, error) {
+	var stats qcommon.QueueStats
+	err := c.rest(ctx, "GET", queuePath(name, "/stats"), nil, &stats)
+	return stats, err
+}
+
+// Purge removes every object from a queue, returning how many there were.
+func (c *Client) Purge(ctx context.Context, name string) (int64, error) {
+	var purge qcommon.PurgeData
+	err := c.rest(ctx, "DELETE", queuePath(name, "/messages"), nil, &purge)
+	return purge.Purged, err
+}
+
+// Peek returns the object at the head of a queue without removing it.
+func (c *Client) Peek(ctx context.Context, name string) (qcommon.Object, error) {
+	var message qcommon.MessageData
+	err := c.rest(ctx, "GET", queuePath(name, "/messages/head"), nil, &message)
+	return message.Object, err
+}
+
+// DequeueHead removes and returns the object at the head of a queue. Unlike
+// Read there is no timeout after which the object is returned to the queue.
+func (c *Client) DequeueHead(ctx context.Context, name string) (qcommon.Object, error) {
+	var message qcommon.MessageData
+	err := c.rest(ctx, "DELETE", queuePath(name, "/messages/head"), nil, &message)
+	return message.Object, err
+}
+
+// ReplicationStatus returns the server's replication role and, for a replica,
+// its lag behind the primary.
+func (c *Client) ReplicationStatus(ctx context.Context) (qcommon.ReplicationStatus, error) {
+	var status qcommon.ReplicationStatus
+	err := c.rest(ctx, "GET", "v1/replication", nil, &status)
+	return status, err
+}
+
+// Promote makes a replica stop following its primary and accept writes.
+func (c *Client) Promote(ctx context.Context) (qcommon.ReplicationStatus, error) {
+	var status qcommon.ReplicationStatus
+	err := c.rest(ctx, "POST", "v1/replication/promote", nil, &status)
+	return status, err
+}
+
+// ClusterStatus returns a clustered server's Raft state and members, as seen
+// by the node the request reaches.
+func (c *Client) ClusterStatus(ctx context.Context) (qcommon.ClusterStatus, error) {
+	var status qcommon.ClusterStatus
+	err := c.rest(ctx, "GET", "v1/cluster", nil, &status)
+	return status, err
+}
+
+// Export writes a queue's messages to w as NDJSON qcommon.ExportedMessages,
+// without removing them, and returns how many there were.
+func (c *Client) Export(ctx context.Context, name string, w io.Writer) (int64, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.stream(ctx, "GET", queuePath(name, "/export"), "", nil, "application/x-ndjson")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	lines := &lineCounter{w: w}
+	_, err = io.Copy(lines, resp.Body)
+	return lines.n, err
+}
+
+// lineCounter counts the lines written through it.
+type lineCounter struct {
+	w	io.Writer
+	n	int64
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(bytes.Count(p[:n], []byte("\n")))
+	return n, err
+}
+
+// Import enqueues on a queue the NDJSON qcommon.ExportedMessages read from r,
+// as written by Export, and returns how many there were. Messages imported
+// before an error stay on the queue.
+func (c *Client) Import(ctx context.Context, name string, r io.Reader) (int64, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.stream(ctx, "POST", queuePath(name, "/import"), "application/x-ndjson", r, "application/json")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var data qcommon.ImportData
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	return data.Imported, err
+}
+
+// LogLevel returns the least severe level the server logs.
+func (c *Client) LogLevel(ctx context.Context) (string, error) {
+	var data qcommon.LogLevelData
+	err := c.rest(ctx, "GET", "v1/log/level", nil, &data)
+	return data.Level, err
+}
+
+// SetLogLevel changes the least severe level the server logs, until it
+// restarts: debug, info, warn or error.
+func (c *Client) SetLogLevel(ctx context.Context, level string) (string, error) {
+	var data qcommon.LogLevelData
+	err := c.rest(ctx, "PUT", "v1/log/level", qcommon.LogLevelData{Level: level}, &data)
+	return data.Level, err
+}
+
+func ListQueues() ([]qcommon.QueueData, error) {
+	return defaultClient.ListQueues(context.Background())
+}
+
+func DescribeQueue(name string) (qcommon.QueueData, error) {
+	return defaultClient.DescribeQueue(context.Background(), name)
+}
+
+func CreateQueueWithSettings(name string, settings qcommon.QueueSettings) (qcommon.QueueData, error) {
+	return defaultClient.CreateQueueWithSettings(context.Background(), name, settings)
+}
+
+func Stats() (qcommon.ServerStats, error) {
+	return defaultClient.Stats(context.Background())
+}
+
+func QueueStats(name string) (qcommon.QueueStats, error) {
+	return defaultClient.QueueStats(context.Background(), name)
+}
+
+func Purge(name string) (int64, error) {
+	return defaultClient.Purge(context.Background(), name)
+}
+
+func Peek(name string) (qcommon.Object, error) {
+	return defaultClient.Peek(context.Background(), name)
+}
+
+func DequeueHead(name string) (qcommon.Object, error) {
+	return defaultClient.DequeueHead(context.Background(), name)
+}
+
+func ReplicationStatus() (qcommon.ReplicationStatus, error) {
+	return defaultClient.ReplicationStatus(context.Background())
+}
+
+func Promote() (qcommon.ReplicationStatus, error) {
+	return defaultClient.Promote(context.Background())
+}
+
+func ClusterStatus() (qcommon.ClusterStatus, error) {
+	return defaultClient.ClusterStatus(context.Background())
+}
+
+func Export(name string, w io.Writer) (int64, error) {
+	return defaultClient.Export(context.Background(), name, w)
+}
+
+func Import(name string, r io.Reader) (int64, error) {
+	return defaultClient.Import(context.Background(), name, r)
+}
+
+func LogLevel() (string, error) {
+	return defaultClient.LogLevel(context.Background())
+}
+
+func SetLogLevel(level string) (string, error) {
+	return defaultClient.SetLogLevel(context.Background(), level)
+}
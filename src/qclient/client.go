@@ -0,0 +1,348 @@
+package qclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"qcommon"
+	"qrpc"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client talks to one qserver, or one clustered qserver. Its methods are safe
+// for concurrent use, and clients of different servers can be used side by
+// side.
+type Client struct {
+	// nil for the default client, which reads the package variables on each
+	// call
+	config	*clientConfig
+	// index in config's nodes of the node requests go to
+	node	int32
+	// guards reads
+	mu	sync.Mutex
+	reads	map[ActiveReadKey]*time.Timer
+	lastEntityId	int32
+}
+
+// clientConfig is how a Client reaches its server.
+type clientConfig struct {
+	// the base URL of the server, or of each node of a clustered server
+	nodes	[]string
+	// the scheme of servers given as host:port
+	scheme	string
+	httpClient	*http.Client
+	// TLS for the gRPC and binary transports, or nil for none
+	tlsConfig	*tls.Config
+	token	string
+	timeout	time.Duration
+	failoverTimeout	time.Duration
+	rateLimitRetries	int
+	transport	Transport
+	// makes transport once the options are applied, if set
+	dialTransport	func(config *clientConfig) (Transport, error)
+}
+
+// defaultClient is what the package level functions use.
+var defaultClient = &Client{reads: map[ActiveReadKey]*time.Timer{}}
+
+// Option configures a Client made by New.
+type Option func(*clientConfig) error
+
+// New returns a client configured by options. Whatever they leave unset is
+// taken from Host, Port, Cluster, Token, TLSConfig, ClusterFailoverTimeout
+// and RateLimitRetries as they are when New is called; queue operations use
+// the HTTP API unless WithTransport says otherwise.
+func New(options ...Option) (*Client, error) {
+	config := packageConfig()
+	config.transport = nil
+	for _, option := range options {
+		if err := option(config); err != nil {
+			return nil, err
+		}
+	}
+	c := &Client{config: config, reads: map[ActiveReadKey]*time.Timer{}}
+	if config.dialTransport != nil {
+		transport, err := config.dialTransport(config)
+		if err != nil {
+			return nil, err
+		}
+		config.transport = transport
+	}
+	if config.transport == nil {
+		config.transport = httpTransport{client: c}
+	}
+	return c, nil
+}
+
+// packageConfig is the configuration the package variables describe.
+func packageConfig() *clientConfig {
+	scheme := "http"
+	if TLSConfig != nil {
+		scheme = "https"
+	}
+	config := &clientConfig{
+		scheme:			scheme,
+		httpClient:		httpClient(),
+		tlsConfig:		TLSConfig,
+		token:			Token,
+		failoverTimeout:	ClusterFailoverTimeout,
+		rateLimitRetries:	RateLimitRetries,
+		transport:		DefaultTransport,
+	}
+	if nodes := Cluster; len(nodes) > 0 {
+		for _, node := range nodes {
+			config.nodes = append(config.nodes, scheme + "://" + node)
+		}
+	} else {
+		config.nodes = []string{fmt.Sprintf("%s://%s:%d", scheme, Host, Port)}
+	}
+	return config
+}
+
+func (c *Client) settings() *clientConfig {
+	if c.config != nil {
+		return c.config
+	}
+	return packageConfig()
+}
+
+// parseBaseURL checks that raw is an http or https URL of a server, and
+// returns it without a trailing slash.
+func parseBaseURL(raw string) (string, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", "", fmt.Errorf("Base URL %q is not an http or https URL of a server", raw)
+	}
+	return strings.TrimSuffix(raw, "/"), u.Scheme, nil
+}
+
+// WithBaseURL makes the client use the server at baseURL, such as
+// "https://queues.example.com:4242".
+func WithBaseURL(baseURL string) Option {
+	return WithClusterURLs(baseURL)
+}
+
+// WithClusterURLs makes the client use a clustered server through the nodes
+// at baseURLs, failing over between them as Cluster does.
+func WithClusterURLs(baseURLs ...string) Option {
+	return func(config *clientConfig) error {
+		if len(baseURLs) == 0 {
+			return errors.New("No base URLs")
+		}
+		config.nodes = nil
+		for _, raw := range baseURLs {
+			node, scheme, err := parseBaseURL(raw)
+			if err != nil {
+				return err
+			}
+			config.nodes = append(config.nodes, node)
+			config.scheme = scheme
+		}
+		return nil
+	}
+}
+
+// WithHTTPClient makes the client send HTTP requests with client, which
+// decides on TLS, proxies and connection reuse.
+func WithHTTPClient(client *http.Client) Option {
+	return func(config *clientConfig) error {
+		if client == nil {
+			return errors.New("Nil HTTP client")
+		}
+		config.httpClient = client
+		return nil
+	}
+}
+
+// WithTLSConfig makes the client use TLS with config, over HTTP and over the
+// gRPC and binary transports, in place of TLSConfig. Servers given as
+// host:port and, unless a later option sets them, the client's own are
+// reached over https.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *clientConfig) error {
+		if config == nil {
+			return errors.New("Nil TLS config")
+		}
+		c.tlsConfig = config
+		c.httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: true}}
+		c.scheme = "https"
+		for i, node := range c.nodes {
+			if strings.HasPrefix(node, "http://") {
+				c.nodes[i] = "https://" + strings.TrimPrefix(node, "http://")
+			}
+		}
+		return nil
+	}
+}
+
+// WithToken makes the client send token as a bearer token, or none if it is
+// empty.
+func WithToken(token string) Option {
+	return func(config *clientConfig) error {
+		config.token = token
+		return nil
+	}
+}
+
+// WithTimeout bounds how long each call may take, including its retries and
+// failovers and, for Export and Import, the whole stream. 0 is no bound
+// beyond the caller's context.
+func WithTimeout(timeout time.Duration) Option {
+	return func(config *clientConfig) error {
+		config.timeout = timeout
+		return nil
+	}
+}
+
+// WithFailoverTimeout sets how long requests move on from node to node of a
+// clustered server before failing, in place of ClusterFailoverTimeout.
+func WithFailoverTimeout(timeout time.Duration) Option {
+	return func(config *clientConfig) error {
+		config.failoverTimeout = timeout
+		return nil
+	}
+}
+
+// WithRateLimitRetries sets how many times a request rejected with 429 is
+// retried, in place of RateLimitRetries.
+func WithRateLimitRetries(retries int) Option {
+	return func(config *clientConfig) error {
+		config.rateLimitRetries = retries
+		return nil
+	}
+}
+
+// WithTransport makes queue operations go through transport instead of the
+// HTTP API. Administrative methods always use the HTTP API.
+func WithTransport(transport Transport) Option {
+	return func(config *clientConfig) error {
+		if transport == nil {
+			return errors.New("Nil transport")
+		}
+		config.transport = transport
+		config.dialTransport = nil
+		return nil
+	}
+}
+
+// WithGRPCTransport makes queue operations use the gRPC API at addr, with the
+// client's token and TLS config. If dial is nil, connections are made over
+// TCP.
+func WithGRPCTransport(addr string, dial qrpc.DialFunc) Option {
+	return func(config *clientConfig) error {
+		config.dialTransport = func(config *clientConfig) (Transport, error) {
+			return newGRPCTransport(config, addr, dial), nil
+		}
+		return nil
+	}
+}
+
+// WithBinaryTransport makes queue operations use the binary protocol on a
+// single pipelined connection to addr, authenticated with the client's token
+// and, over tcp, with the client's TLS config. New fails if the connection
+// can't be made.
+func WithBinaryTransport(network, addr string) Option {
+	return func(config *clientConfig) error {
+		config.dialTransport = func(config *clientConfig) (Transport, error) {
+			return newBinaryTransport(config, network, addr)
+		}
+		return nil
+	}
+}
+
+// withTimeout bounds ctx by c's timeout, if it has one.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.config != nil && c.config.timeout > 0 {
+		return context.WithTimeout(ctx, c.config.timeout)
+	}
+	return ctx, func() {}
+}
+
+func (c *Client) CreateQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.settings().transport.CreateQueue(ctx, name)
+}
+
+func (c *Client) GetQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.settings().transport.GetQueue(ctx, name)
+}
+
+func (c *Client) DeleteQueue(ctx context.Context, id qcommon.QueueId) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.settings().transport.DeleteQueue(ctx, id)
+}
+
+func (c *Client) Enqueue(ctx context.Context, id qcommon.QueueId, object qcommon.Object) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.settings().transport.Enqueue(ctx, id, object)
+}
+
+// Read dequeues an object from the server and then sets a timeout to
+// re-enqueue it, which Dequeue cancels. This ensures that the same object
+// won't be dequeued from the server while it is being read.
+func (c *Client) Read(ctx context.Context, id qcommon.QueueId, timeout time.Duration) (*ReadResponse, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	object, err := c.settings().transport.Dequeue(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	entityId := QueueEntityId(fmt.Sprintf("%d", atomic.AddInt32(&c.lastEntityId, 1)))
+	readResponse := &ReadResponse{
+		Id:		id,
+		EntityId:	entityId,
+		Object:		object,
+	}
+	key := ActiveReadKey{id: readResponse.Id, entityId: readResponse.EntityId}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, present := c.reads[key]; present {
+		return nil, fmt.Errorf("Attempt to read already active read")
+	}
+	// the callback waits for the lock, so the timer is in reads when it runs
+	c.reads[key] = time.AfterFunc(timeout, func() { c.readTimeout(key, readResponse) })
+	return readResponse, nil
+}
+
+// readTimeout returns an object whose read timed out to the queue.
+func (c *Client) readTimeout(key ActiveReadKey, readResponse *ReadResponse) {
+	c.mu.Lock()
+	delete(c.reads, key)
+	c.mu.Unlock()
+	ctx, cancel := c.withTimeout(context.Background())
+	defer cancel()
+	c.settings().transport.Enqueue(ctx, readResponse.Id, readResponse.Object)
+}
+
+// Dequeue confirms a Read, so that its object isn't returned to the queue.
+// It fails if the read already timed out.
+func (c *Client) Dequeue(ctx context.Context, id qcommon.QueueId, entityId QueueEntityId) error {
+	key := ActiveReadKey{id: id, entityId: entityId}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer, present := c.reads[key]
+	if !present {
+		return fmt.Errorf("Attempt to dequeue item without reading")
+	}
+	if !timer.Stop() {
+		// readTimeout is waiting for the lock
+		return fmt.Errorf("Read timed out")
+	}
+	delete(c.reads, key)
+	return nil
+}
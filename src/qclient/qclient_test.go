@@ -2,8 +2,16 @@ package qclient
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"qcommon"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,6 +25,7 @@ var (
 	object = []byte("hello queue server")
 	host = flag.String("host", "localhost", "qserver host")
 	port = flag.Int("port", 4242, "qserver port")
+	token = flag.String("token", "", "qserver bearer token")
 	load = flag.Int("load", 1000, "number of concurrent events to test")
 )
 
@@ -24,6 +33,7 @@ func initQClient() {
 	flag.Parse()
 	Host = *host
 	Port = *port
+	Token = *token
 }
 
 func TestCreate(t *testing.T) {
@@ -323,3 +333,378 @@ func BenchmarkConcurrentDequeue(b *testing.B) {
 	}
 }
 
+
+func TestBinaryObject(t *testing.T) {
+	id, _ := CreateQueue(queueName)
+	defer DeleteQueue(id)
+	binaryObject := []byte{0, 1, 2, 0xfe, 0xff, '\n', '&', '='}
+	if err := Enqueue(id, binaryObject); err != nil {
+		t.Errorf("unexpected enqueue error: %v", err)
+		return
+	}
+	response, err := Read(id, 2)
+	if err != nil {
+		t.Errorf("unexpected read error: %v", err)
+		return
+	}
+	if !bytes.Equal(response.Object, binaryObject) {
+		t.Errorf("want %q, got %q", binaryObject, response.Object)
+	}
+	Dequeue(id, response.EntityId)
+}
+
+func TestAdmin(t *testing.T) {
+	data, err := CreateQueueWithSettings(queueName, qcommon.QueueSettings{DequeueRate: 100})
+	defer DeleteQueue(queueName)
+	if err != nil || data.Settings == nil || data.Settings.DequeueRate != 100 {
+		t.Errorf("unexpected create result: %+v (%v)", data, err)
+		return
+	}
+	Enqueue(queueName, []byte("first"))
+	Enqueue(queueName, []byte("second"))
+
+	if object, err := Peek(queueName); err != nil || string(object) != "first" {
+		t.Errorf("peek: want %q, got %q (%v)", "first", object, err)
+	}
+	if stats, err := QueueStats(queueName); err != nil || stats.Depth != 2 {
+		t.Errorf("unexpected stats: %+v (%v)", stats, err)
+	}
+	if object, err := DequeueHead(queueName); err != nil || string(object) != "first" {
+		t.Errorf("dequeue: want %q, got %q (%v)", "first", object, err)
+	}
+	if purged, err := Purge(queueName); err != nil || purged != 1 {
+		t.Errorf("purge: want 1, got %d (%v)", purged, err)
+	}
+	_, err = Peek(queueName)
+	if apiErr, ok := err.(*APIError); !ok || apiErr.Code != qcommon.ErrorCodeQueueEmpty {
+		t.Errorf("want queue_empty error, got %v", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	const copyName = queueName + "-copy"
+	CreateQueue(queueName)
+	defer DeleteQueue(queueName)
+	CreateQueue(copyName)
+	defer DeleteQueue(copyName)
+	Enqueue(queueName, []byte("first"))
+	Enqueue(queueName, []byte("second"))
+
+	var b bytes.Buffer
+	if n, err := Export(queueName, &b); err != nil || n != 2 {
+		t.Fatalf("export: want 2, got %d (%v)", n, err)
+	}
+	if stats, err := QueueStats(queueName); err != nil || stats.Depth != 2 {
+		t.Errorf("export dequeued: %+v (%v)", stats, err)
+	}
+	if n, err := Import(copyName, &b); err != nil || n != 2 {
+		t.Fatalf("import: want 2, got %d (%v)", n, err)
+	}
+	for _, want := range []string{"first", "second"} {
+		if object, err := DequeueHead(copyName); err != nil || string(object) != want {
+			t.Errorf("want %q, got %q (%v)", want, object, err)
+		}
+	}
+	_, err := Import(copyName, bytes.NewReader([]byte("not json")))
+	if apiErr, ok := err.(*APIError); !ok || apiErr.Code != qcommon.ErrorCodeInvalidArgument {
+		t.Errorf("want invalid_argument error, got %v", err)
+	}
+}
+
+func TestShardRing(t *testing.T) {
+	before := NewSharded(nil, "a:1", "b:1", "c:1")
+	if reordered := NewSharded(nil, "c:1", "a:1", "b:1", "a:1"); fmt.Sprint(reordered.points) != fmt.Sprint(before.points) {
+		t.Errorf("ring depends on server order")
+	}
+	after := NewSharded(nil, "a:1", "b:1", "c:1", "d:1")
+	counts := map[string]int{}
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("queue-%d", i)
+		counts[after.Server(name)]++
+		if server := after.Server(name); server != before.Server(name) {
+			if server != "d:1" {
+				t.Fatalf("%s moved from %s to %s, not the new server", name, before.Server(name), server)
+			}
+			moved++
+		}
+	}
+	// each server should get about a quarter
+	for server, count := range counts {
+		if count < 1500 || count > 3500 {
+			t.Errorf("%s holds %d of 10000 queues", server, count)
+		}
+	}
+	if moved != counts["d:1"] {
+		t.Errorf("moved %d queues, want %d", moved, counts["d:1"])
+	}
+	if server := NewSharded(nil).Server("q"); server != "" {
+		t.Errorf("empty ring placed a queue on %q", server)
+	}
+}
+
+func TestSharded(t *testing.T) {
+	s := NewSharded(nil, fmt.Sprintf("%s:%d", *host, *port))
+	ctx := context.Background()
+	id, err := s.CreateQueue(ctx, queueName)
+	if err != nil {
+		t.Fatalf("unexpected create error: %v", err)
+	}
+	defer s.DeleteQueue(ctx, id)
+	if err := s.Enqueue(ctx, id, object); err != nil {
+		t.Fatalf("unexpected enqueue error: %v", err)
+	}
+	if got, err := s.Dequeue(ctx, id); err != nil || !bytes.Equal(got, object) {
+		t.Errorf("want %q, got %q (%v)", object, got, err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	c, err := New(WithBaseURL(fmt.Sprintf("http://%s:%d/", *host, *port)), WithToken(*token), WithTimeout(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	const name = queueName + "-client"
+	id, err := c.CreateQueue(ctx, name)
+	if err != nil {
+		t.Fatalf("unexpected create error: %v", err)
+	}
+	defer c.DeleteQueue(ctx, id)
+	if err := c.Enqueue(ctx, id, object); err != nil {
+		t.Fatalf("unexpected enqueue error: %v", err)
+	}
+	if stats, err := c.QueueStats(ctx, name); err != nil || stats.Depth != 1 {
+		t.Errorf("unexpected stats: %+v (%v)", stats, err)
+	}
+	response, err := c.Read(ctx, id, time.Minute)
+	if err != nil || !bytes.Equal(response.Object, object) {
+		t.Fatalf("want %q, got %+v (%v)", object, response, err)
+	}
+	if err := c.Dequeue(ctx, id, response.EntityId); err != nil {
+		t.Errorf("unexpected dequeue error: %v", err)
+	}
+	if err := c.Dequeue(ctx, id, response.EntityId); err == nil {
+		t.Errorf("expected error dequeuing twice")
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	for _, option := range []Option{
+		WithBaseURL("localhost:4242"),
+		WithBaseURL("ftp://localhost:4242"),
+		WithBaseURL("http://"),
+		WithClusterURLs(),
+		WithClusterURLs("http://a:1", "b:1"),
+		WithHTTPClient(nil),
+		WithTLSConfig(nil),
+		WithTransport(nil),
+	} {
+		if _, err := New(option); err == nil {
+			t.Errorf("want error from %#v", option)
+		}
+	}
+}
+
+// fakeServer answers create requests with its name as the queue's id, after
+// delay.
+func fakeServer(name string, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the request's context is only canceled once its body is read
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		json.NewEncoder(w).Encode(qcommon.IdData{Id: qcommon.QueueId(name)})
+	}))
+}
+
+func TestClientsSideBySide(t *testing.T) {
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b", "c"} {
+		server := fakeServer(name, 0)
+		defer server.Close()
+		c, err := New(WithBaseURL(server.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(name string, c *Client) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if id, err := c.CreateQueue(context.Background(), "q"); err != nil || id != qcommon.QueueId(name) {
+					t.Errorf("client of %s got %q (%v)", name, id, err)
+					return
+				}
+			}
+		}(name, c)
+	}
+	wg.Wait()
+}
+
+func TestClientTimeout(t *testing.T) {
+	server := fakeServer("slow", time.Minute)
+	defer server.Close()
+	c, err := New(WithBaseURL(server.URL), WithTimeout(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := c.CreateQueue(context.Background(), "q"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5 * time.Second {
+		t.Errorf("timed out after %v", elapsed)
+	}
+}
+
+// fakeShard serves the parts of the HTTP API Rebalance uses, from memory, to
+// clients with the token "shard". Enqueues fail once it has taken
+// enqueueLimit of them, and the next steal removals of a head find another
+// consumer took it first.
+type fakeShard struct {
+	mu	sync.Mutex
+	queues	map[string][][]byte
+	enqueues	int
+	enqueueLimit	int
+	steal	int
+}
+
+func (f *fakeShard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fail := func(status int, code string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(qcommon.ErrorData{Error: qcommon.ErrorDetail{Code: code}})
+	}
+	if r.Header.Get("Authorization") != "Bearer shard" {
+		fail(http.StatusUnauthorized, qcommon.ErrorCodeUnauthenticated)
+		return
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/queues/"), "/")
+	switch {
+	case r.URL.Path == "/v1/queues":
+		list := qcommon.QueueListData{Queues: []qcommon.QueueData{}}
+		for name := range f.queues {
+			list.Queues = append(list.Queues, qcommon.QueueData{Name: name})
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.URL.Path == "/enqueue":
+		name := r.URL.Query().Get("id")
+		if _, present := f.queues[name]; !present || f.enqueues == f.enqueueLimit {
+			fail(http.StatusInternalServerError, qcommon.ErrorCodeInternal)
+			return
+		}
+		f.enqueues++
+		b, _ := io.ReadAll(r.Body)
+		f.queues[name] = append(f.queues[name], b)
+	case rest == "" && r.Method == "PUT":
+		if _, present := f.queues[name]; present {
+			fail(http.StatusConflict, qcommon.ErrorCodeQueueExists)
+			return
+		}
+		f.queues[name] = [][]byte{}
+	case rest == "" && r.Method == "GET":
+		json.NewEncoder(w).Encode(qcommon.QueueData{Name: name})
+	case rest == "" && r.Method == "DELETE":
+		delete(f.queues, name)
+		w.WriteHeader(http.StatusNoContent)
+	case rest == "messages/head":
+		if r.Method == "DELETE" && f.steal > 0 && len(f.queues[name]) > 0 {
+			f.steal--
+			f.queues[name] = f.queues[name][1:]
+		}
+		if len(f.queues[name]) == 0 {
+			fail(http.StatusNotFound, qcommon.ErrorCodeQueueEmpty)
+			return
+		}
+		json.NewEncoder(w).Encode(qcommon.MessageData{Queue: name, Object: f.queues[name][0]})
+		if r.Method == "DELETE" {
+			f.queues[name] = f.queues[name][1:]
+		}
+	default:
+		fail(http.StatusNotFound, qcommon.ErrorCodeNotFound)
+	}
+}
+
+func (f *fakeShard) contents(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fmt.Sprintf("%s", f.queues[name])
+}
+
+func TestRebalance(t *testing.T) {
+	old := &fakeShard{queues: map[string][][]byte{}, enqueueLimit: -1}
+	added := &fakeShard{queues: map[string][][]byte{}, enqueueLimit: 2}
+	oldServer, addedServer := httptest.NewServer(old), httptest.NewServer(added)
+	defer oldServer.Close()
+	defer addedServer.Close()
+	oldAddr, addedAddr := strings.TrimPrefix(oldServer.URL, "http://"), strings.TrimPrefix(addedServer.URL, "http://")
+	// the package variables have no token, so the client's must be used
+	c, err := New(WithBaseURL(oldServer.URL), WithToken("shard"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, to := NewSharded(c, oldAddr), NewSharded(c, oldAddr, addedAddr)
+	var name string
+	for i := 0; name == ""; i++ {
+		if candidate := fmt.Sprintf("queue-%d", i); to.Server(candidate) == addedAddr {
+			name = candidate
+		}
+	}
+	old.queues[name] = [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	// the new server fails part way; nothing is lost
+	ctx := context.Background()
+	if _, err := Rebalance(ctx, from, to); err == nil {
+		t.Fatalf("want the failed enqueue's error")
+	}
+	if got, want := old.contents(name) + added.contents(name), "[c][a b]"; got != want {
+		t.Errorf("after failure: old and new servers hold %s, want %s", got, want)
+	}
+
+	added.mu.Lock()
+	added.enqueueLimit = -1
+	added.mu.Unlock()
+	migrations, err := Rebalance(ctx, from, to)
+	if err != nil || len(migrations) != 1 || migrations[0].Messages != 1 {
+		t.Fatalf("got %+v (%v)", migrations, err)
+	}
+	if got := added.contents(name); got != "[a b c]" {
+		t.Errorf("new server holds %s, want [a b c]", got)
+	}
+	if _, present := old.queues[name]; present {
+		t.Errorf("queue left on the old server")
+	}
+}
+
+func TestRebalanceConcurrentConsumer(t *testing.T) {
+	old := &fakeShard{queues: map[string][][]byte{}, enqueueLimit: -1, steal: 1}
+	added := &fakeShard{queues: map[string][][]byte{}, enqueueLimit: -1}
+	oldServer, addedServer := httptest.NewServer(old), httptest.NewServer(added)
+	defer oldServer.Close()
+	defer addedServer.Close()
+	oldAddr, addedAddr := strings.TrimPrefix(oldServer.URL, "http://"), strings.TrimPrefix(addedServer.URL, "http://")
+	c, err := New(WithBaseURL(oldServer.URL), WithToken("shard"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, to := NewSharded(c, oldAddr), NewSharded(c, oldAddr, addedAddr)
+	var name string
+	for i := 0; name == ""; i++ {
+		if candidate := fmt.Sprintf("queue-%d", i); to.Server(candidate) == addedAddr {
+			name = candidate
+		}
+	}
+	old.queues[name] = [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	// another consumer takes a after it was copied, so the removal takes b
+	if _, err := Rebalance(context.Background(), from, to); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := added.contents(name); got != "[a b c]" {
+		t.Errorf("new server holds %s, want [a b c]", got)
+	}
+}
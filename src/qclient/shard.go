@@ -0,0 +1,249 @@
+package qclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"qcommon"
+	"sort"
+	"strconv"
+)
+
+// shardReplicas is how many points each server has on the hash ring, which
+// evens out how many queues each gets.
+const shardReplicas = 128
+
+// Sharded is a Transport that spreads queues across several qservers, placing
+// each queue on one server by consistent hashing of its name. Adding or
+// removing a server only moves the queues that hash to it; Rebalance migrates
+// them. Every client of a set of servers must use the same server list.
+type Sharded struct {
+	// nil for the default client
+	client	*Client
+	servers	[]string
+	transports	map[string]Transport
+	// points on the ring, sorted, and the server at each
+	points	[]uint32
+	owners	map[uint32]string
+}
+
+// NewSharded returns a transport that shards queues across the HTTP APIs of
+// servers, given as host:port. They are reached with client's scheme, HTTP
+// client and token, or if client is nil with the package variables'.
+func NewSharded(client *Client, servers ...string) *Sharded {
+	s := &Sharded{client: client, transports: map[string]Transport{}, owners: map[uint32]string{}}
+	for _, server := range servers {
+		if _, present := s.transports[server]; present {
+			continue
+		}
+		s.servers = append(s.servers, server)
+		s.transports[server] = httpTransport{client: s.c(), addr: server}
+		for i := 0; i < shardReplicas; i++ {
+			point := hash(server + "#" + strconv.Itoa(i))
+			// on a collision the lower server wins, whatever the order given
+			if owner, taken := s.owners[point]; taken {
+				if server < owner {
+					s.owners[point] = server
+				}
+				continue
+			}
+			s.points = append(s.points, point)
+			s.owners[point] = server
+		}
+	}
+	sort.Slice(s.points, func(i, j int) bool { return s.points[i] < s.points[j] })
+	return s
+}
+
+// hash is FNV-1a with MurmurHash3's finalizer, which spreads names that differ
+// only in their last characters around the ring.
+func hash(s string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x)
+}
+
+func (s *Sharded) c() *Client {
+	if s.client == nil {
+		return defaultClient
+	}
+	return s.client
+}
+
+// Servers returns the servers queues are spread across.
+func (s *Sharded) Servers() []string {
+	return append([]string(nil), s.servers...)
+}
+
+// Server returns the server that holds the named queue, or "" if there are no
+// servers.
+func (s *Sharded) Server(name string) string {
+	if len(s.points) == 0 {
+		return ""
+	}
+	h := hash(name)
+	i := sort.Search(len(s.points), func(i int) bool { return s.points[i] >= h })
+	if i == len(s.points) {
+		i = 0
+	}
+	return s.owners[s.points[i]]
+}
+
+var errNoServers = errors.New("No servers to shard across")
+
+func (s *Sharded) transport(name string) (Transport, error) {
+	server := s.Server(name)
+	if server == "" {
+		return nil, errNoServers
+	}
+	return s.transports[server], nil
+}
+
+func (s *Sharded) CreateQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	t, err := s.transport(name)
+	if err != nil {
+		return nullId, err
+	}
+	return t.CreateQueue(ctx, name)
+}
+
+func (s *Sharded) GetQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	t, err := s.transport(name)
+	if err != nil {
+		return nullId, err
+	}
+	return t.GetQueue(ctx, name)
+}
+
+func (s *Sharded) DeleteQueue(ctx context.Context, id qcommon.QueueId) error {
+	t, err := s.transport(string(id))
+	if err != nil {
+		return err
+	}
+	return t.DeleteQueue(ctx, id)
+}
+
+func (s *Sharded) Enqueue(ctx context.Context, id qcommon.QueueId, object qcommon.Object) error {
+	t, err := s.transport(string(id))
+	if err != nil {
+		return err
+	}
+	return t.Enqueue(ctx, id, object)
+}
+
+func (s *Sharded) Dequeue(ctx context.Context, id qcommon.QueueId) (qcommon.Object, error) {
+	t, err := s.transport(string(id))
+	if err != nil {
+		return nil, err
+	}
+	return t.Dequeue(ctx, id)
+}
+
+// Migration is a queue Rebalance moved.
+type Migration struct {
+	Queue	string
+	From	string
+	To	string
+	Messages	int
+}
+
+// Rebalance moves the queues on the servers of from that to places on another
+// server, reaching each set of servers with its own client. Each queue is
+// created on its new server with the same settings, its messages are copied
+// there oldest first, and it is deleted from the old server. A message is
+// only removed from the old server once the new one has it, so an
+// interruption may leave it on both but never loses it. Clients should
+// already use to, so that nothing else dequeues from the old copies: a
+// message another consumer takes from the old server after it was copied is
+// delivered twice, and the one removed in its place is copied too. The moved
+// messages are interleaved with any enqueued on the new server in the
+// meantime.
+//
+// It stops at the first error, returning the migrations done so far; running
+// it again carries on.
+func Rebalance(ctx context.Context, from, to *Sharded) ([]Migration, error) {
+	var done []Migration
+	for _, server := range from.servers {
+		var list qcommon.QueueListData
+		if err := from.c().restAt(ctx, server, "GET", "v1/queues", nil, &list); err != nil {
+			return done, fmt.Errorf("listing queues on %s: %w", server, err)
+		}
+		for _, q := range list.Queues {
+			target := to.Server(q.Name)
+			if target == "" {
+				return done, errNoServers
+			}
+			if target == server {
+				continue
+			}
+			m, err := migrate(ctx, q.Name, from.c(), server, to.c(), target)
+			if err != nil {
+				return done, fmt.Errorf("moving queue %q from %s to %s: %w", q.Name, server, target, err)
+			}
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
+
+// migrate moves one queue and its messages from server, reached with src, to
+// target, reached with dst.
+func migrate(ctx context.Context, name string, src *Client, server string, dst *Client, target string) (Migration, error) {
+	m := Migration{Queue: name, From: server, To: target}
+	var data qcommon.QueueData
+	if err := src.restAt(ctx, server, "GET", queuePath(name, ""), nil, &data); err != nil {
+		return m, err
+	}
+	// a queue left on the target by an interrupted run is reused
+	var apiErr *APIError
+	err := dst.restAt(ctx, target, "PUT", queuePath(name, ""), data, nil)
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == qcommon.ErrorCodeQueueExists) {
+		return m, err
+	}
+
+	copyTo := httpTransport{client: dst, addr: target}
+	head := queuePath(name, "/messages/head")
+	for {
+		var peeked qcommon.MessageData
+		err := src.restAt(ctx, server, "GET", head, nil, &peeked)
+		if errors.As(err, &apiErr) && apiErr.Code == qcommon.ErrorCodeQueueEmpty {
+			break
+		}
+		if err != nil {
+			return m, err
+		}
+		if err := copyTo.Enqueue(ctx, qcommon.QueueId(name), peeked.Object); err != nil {
+			return m, err
+		}
+		var removed qcommon.MessageData
+		err = src.restAt(ctx, server, "DELETE", head, nil, &removed)
+		if errors.As(err, &apiErr) && apiErr.Code == qcommon.ErrorCodeQueueEmpty {
+			break
+		}
+		if err != nil {
+			return m, err
+		}
+		m.Messages++
+		if !bytes.Equal(removed.Object, peeked.Object) {
+			// something else dequeued the copied message first
+			if err := copyTo.Enqueue(ctx, qcommon.QueueId(name), removed.Object); err != nil {
+				return m, fmt.Errorf("%w; a message removed from %s was lost", err, server)
+			}
+		}
+	}
+
+	err = src.restAt(ctx, server, "DELETE", queuePath(name, ""), nil, nil)
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		err = nil
+	}
+	return m, err
+}
@@ -0,0 +1,300 @@
+package qclient
+
+import (
+	"context"
+	"crypto/tls"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"qbinary"
+	"qcommon"
+	"qrpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transport carries queue operations to a qserver. Dequeue removes an object
+// from the server; Read and Dequeue in this package layer the read timeout on
+// top of it.
+type Transport interface {
+	CreateQueue(ctx context.Context, name string) (qcommon.QueueId, error)
+	GetQueue(ctx context.Context, name string) (qcommon.QueueId, error)
+	DeleteQueue(ctx context.Context, id qcommon.QueueId) error
+	Enqueue(ctx context.Context, id qcommon.QueueId, object qcommon.Object) error
+	Dequeue(ctx context.Context, id qcommon.QueueId) (qcommon.Object, error)
+}
+
+const (
+	nullId = ""
+)
+
+// DefaultTransport is used by the package level functions. It talks to the
+// HTTP API at Host:Port unless replaced.
+var DefaultTransport Transport = httpTransport{client: defaultClient}
+
+// NewGRPCTransport returns a transport that uses the gRPC API at addr. If dial
+// is nil, connections are made over TCP. Token and TLSConfig are captured at
+// creation; WithGRPCTransport uses a client's own.
+func NewGRPCTransport(addr string, dial qrpc.DialFunc) Transport {
+	return newGRPCTransport(packageConfig(), addr, dial)
+}
+
+func newGRPCTransport(config *clientConfig, addr string, dial qrpc.DialFunc) Transport {
+	var client *qrpc.Client
+	if config.tlsConfig != nil {
+		client = qrpc.NewTLSClient(addr, dial, config.tlsConfig)
+	} else {
+		client = qrpc.NewClient(addr, dial)
+	}
+	client.Token = config.token
+	return client
+}
+
+// NewBinaryTransport returns a transport that uses the binary protocol on a
+// single pipelined connection. network is "tcp" or "unix"; TLS is used over
+// tcp if TLSConfig is set. Token and TLSConfig are captured at creation;
+// WithBinaryTransport uses a client's own.
+func NewBinaryTransport(network, addr string) (Transport, error) {
+	return newBinaryTransport(packageConfig(), network, addr)
+}
+
+func newBinaryTransport(config *clientConfig, network, addr string) (Transport, error) {
+	var client *qbinary.Client
+	var err error
+	if config.tlsConfig != nil && network == "tcp" {
+		client, err = qbinary.DialTLS(network, addr, config.tlsConfig)
+	} else {
+		client, err = qbinary.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.token != "" {
+		if err := client.Authenticate(context.Background(), config.token); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// httpTransport uses the form-encoded HTTP API of client's server, or of the
+// server at addr if set.
+type httpTransport struct {
+	client	*Client
+	addr	string
+}
+
+const clusterRetryInterval = 200 * time.Millisecond
+
+var (
+	tlsClientMu sync.Mutex
+	tlsClient *http.Client
+	tlsClientConfig *tls.Config
+)
+
+// httpClient returns a client for the current TLSConfig, reusing it across
+// calls so that connections are kept alive.
+func httpClient() *http.Client {
+	if TLSConfig == nil {
+		return http.DefaultClient
+	}
+	tlsClientMu.Lock()
+	defer tlsClientMu.Unlock()
+	if tlsClientConfig != TLSConfig {
+		tlsClientConfig = TLSConfig
+		tlsClient = &http.Client{Transport: &http.Transport{TLSClientConfig: TLSConfig, ForceAttemptHTTP2: true}}
+	}
+	return tlsClient
+}
+
+// post sends a request to the form-encoded HTTP API and returns the response
+// headers and body if it succeeded.
+func (c *Client) post(ctx context.Context, addr string, path string, contentType string, body []byte, accept string) (http.Header, []byte, error) {
+	resp, b, err := c.request(ctx, addr, "POST", path, contentType, body, accept)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s: %s", resp.Status, string(b))
+	}
+	return resp.Header, b, nil
+}
+
+// request sends a request to the HTTP API at addr, or c's server if addr is
+// empty, authenticated with c's token if set. Rate limited requests are
+// retried after the server's Retry-After, up to c's rate limit retries.
+func (c *Client) request(ctx context.Context, addr string, method, path string, contentType string, body []byte, accept string) (*http.Response, []byte, error) {
+	config := c.settings()
+	for attempt := 0; ; attempt++ {
+		resp, b, err := c.send(ctx, config, addr, method, path, contentType, body, accept)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < config.rateLimitRetries {
+			if err := sleep(ctx, retryAfter(resp.Header)); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		return resp, b, nil
+	}
+}
+
+// send sends a request to addr if set, else to c's server or, if it is
+// clustered, to the current node, failing over to the next while nodes are
+// unreachable or answer 503.
+func (c *Client) send(ctx context.Context, config *clientConfig, addr string, method, path string, contentType string, body []byte, accept string) (*http.Response, []byte, error) {
+	if addr != "" {
+		return sendTo(ctx, config, config.scheme + "://" + addr, method, path, contentType, body, accept)
+	}
+	nodes := config.nodes
+	if len(nodes) == 1 {
+		return sendTo(ctx, config, nodes[0], method, path, contentType, body, accept)
+	}
+	deadline := time.Now().Add(config.failoverTimeout)
+	for tries := 1; ; tries++ {
+		i := int(atomic.LoadInt32(&c.node)) % len(nodes)
+		resp, b, err := sendTo(ctx, config, nodes[i], method, path, contentType, body, accept)
+		if err == nil && resp.StatusCode != http.StatusServiceUnavailable || ctx.Err() != nil || time.Now().After(deadline) {
+			return resp, b, err
+		}
+		// move on, unless a concurrent request already has
+		atomic.CompareAndSwapInt32(&c.node, int32(i), int32((i + 1) % len(nodes)))
+		if tries % len(nodes) == 0 {
+			// every node failed; wait for an election
+			if err := sleep(ctx, clusterRetryInterval); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// currentNode is the base URL requests without an addr go to: c's server or,
+// if it is clustered, the current node.
+func (c *Client) currentNode(config *clientConfig) string {
+	return config.nodes[int(atomic.LoadInt32(&c.node)) % len(config.nodes)]
+}
+
+// newRequest returns a request to the HTTP API at baseURL, authenticated with
+// config's token if set.
+func newRequest(ctx context.Context, config *clientConfig, baseURL string, method, path string, contentType string, body io.Reader, accept string) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, method, baseURL + "/" + path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	if config.token != "" {
+		r.Header.Set("Authorization", "Bearer " + config.token)
+	}
+	return r, nil
+}
+
+func sendTo(ctx context.Context, config *clientConfig, baseURL string, method, path string, contentType string, body []byte, accept string) (*http.Response, []byte, error) {
+	r, err := newRequest(ctx, config, baseURL, method, path, contentType, bytes.NewReader(body), accept)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := config.httpClient.Do(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp, b, err
+}
+
+// retryAfter parses a Retry-After header in seconds or as a date, defaulting
+// to a second.
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return time.Second
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) getBody(ctx context.Context, addr string, path string, values url.Values) ([]byte, error) {
+	_, body, err := c.post(ctx, addr, path, "application/x-www-form-urlencoded", []byte(values.Encode()), "")
+	return body, err
+}
+
+func (t httpTransport) CreateQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	body, err := t.client.getBody(ctx, t.addr, "create", url.Values{"name": {name}})
+	if err != nil {
+		return nullId, err
+	}
+
+	idData := new(qcommon.IdData)
+	err = json.Unmarshal(body, &idData)
+	if err != nil {
+		return nullId, err
+	}
+	return idData.Id, nil
+}
+
+func (t httpTransport) GetQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	body, err := t.client.getBody(ctx, t.addr, "get", url.Values{"name": {name}})
+	if err != nil {
+		return nullId, err
+	}
+
+	idData := new(qcommon.IdData)
+	err = json.Unmarshal(body, &idData)
+	if err != nil {
+		return nullId, err
+	}
+	return idData.Id, nil
+}
+
+func (t httpTransport) DeleteQueue(ctx context.Context, id qcommon.QueueId) error {
+	_, err := t.client.getBody(ctx, t.addr, "delete", url.Values{"id": {string(id)}})
+	return err
+}
+
+// Objects are sent and received as raw bodies so binary payloads survive
+// unchanged and aren't base64 encoded.
+func (t httpTransport) Enqueue(ctx context.Context, id qcommon.QueueId, object qcommon.Object) error {
+	values := url.Values{"id": {string(id)}}
+	_, _, err := t.client.post(ctx, t.addr, "enqueue?" + values.Encode(), qcommon.ObjectContentType, object, "")
+	return err
+}
+
+func (t httpTransport) Dequeue(ctx context.Context, id qcommon.QueueId) (qcommon.Object, error) {
+	values := url.Values{"id": {string(id)}}
+	header, body, err := t.client.post(ctx, t.addr, "dequeue", "application/x-www-form-urlencoded", []byte(values.Encode()), qcommon.ObjectContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if respId := qcommon.QueueId(header.Get(qcommon.QueueIdHeader)); respId != id {
+		return nil, fmt.Errorf("Mismatch queue ids: %q vs %q", respId, id)
+	}
+	return body, nil
+}
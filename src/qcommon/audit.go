@@ -0,0 +1,83 @@
+package qcommon
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// AuditEntry is one line of a server's audit log: an administrative action,
+// who took it, and a hash chaining it to the entry before. Changing, removing
+// or reordering entries breaks the chain; VerifyAuditLog finds where. Entries
+// cut off the end leave an intact chain, so the last hash should be recorded
+// elsewhere to detect that.
+type AuditEntry struct {
+	Seq	int64	`json:"seq"`
+	Time	time.Time	`json:"time"`
+	Principal	string	`json:"principal,omitempty"`
+	Remote	string	`json:"remote,omitempty"`
+	Action	string	`json:"action"`
+	Queue	string	`json:"queue,omitempty"`
+	Params	json.RawMessage	`json:"params,omitempty"`
+	PrevHash	string	`json:"prev_hash"`
+	Hash	string	`json:"hash"`
+}
+
+// Audited actions.
+const (
+	AuditCreateQueue = "create_queue"
+	AuditDeleteQueue = "delete_queue"
+	AuditPurgeQueue = "purge_queue"
+	AuditConfigureQueue = "configure_queue"
+	AuditPromote = "promote"
+	AuditSetLogLevel = "set_log_level"
+)
+
+// ComputeHash returns the hex SHA-256 of the entry's JSON without its hash,
+// which covers PrevHash and so every entry before it.
+func (e AuditEntry) ComputeHash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// VerifyAuditLog checks that every entry read from r is numbered and hashed
+// in sequence, returning the last entry and how many there were. The error
+// names the first entry that doesn't.
+func VerifyAuditLog(r io.Reader) (AuditEntry, int64, error) {
+	var last AuditEntry
+	var n int64
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1 << 20)
+	for scanner.Scan() {
+		line := n + 1
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return last, n, fmt.Errorf("line %d: %v", line, err)
+		}
+		if e.Seq != last.Seq + 1 {
+			return last, n, fmt.Errorf("line %d: seq %d follows %d", line, e.Seq, last.Seq)
+		}
+		if e.PrevHash != last.Hash {
+			return last, n, fmt.Errorf("line %d: seq %d doesn't chain to the entry before it", line, e.Seq)
+		}
+		hash, err := e.ComputeHash()
+		if err != nil {
+			return last, n, fmt.Errorf("line %d: %v", line, err)
+		}
+		if e.Hash != hash {
+			return last, n, fmt.Errorf("line %d: seq %d was altered; its hash doesn't match", line, e.Seq)
+		}
+		last = e
+		n++
+	}
+	return last, n, scanner.Err()
+}
@@ -0,0 +1,34 @@
+package qcommon
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	remoteAddrKey
+)
+
+// WithPrincipal records the authenticated caller of a request.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// PrincipalFrom returns the authenticated caller, or "" if authentication is
+// disabled.
+func PrincipalFrom(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey).(string)
+	return principal
+}
+
+// WithRemoteAddr records the network address a request came from.
+func WithRemoteAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, remoteAddrKey, addr)
+}
+
+func RemoteAddrFrom(ctx context.Context) string {
+	addr, _ := ctx.Value(remoteAddrKey).(string)
+	return addr
+}
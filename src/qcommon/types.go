@@ -1,8 +1,17 @@
 package qcommon
 
+import "time"
+
 type QueueId	string
 type Object	[]byte
 
+// Raw objects are sent and received over HTTP as the request or response body
+// with this content type. The queue id travels in QueueIdHeader.
+const (
+	ObjectContentType = "application/octet-stream"
+	QueueIdHeader = "X-Queue-Id"
+)
+
 // Common type definitions to simplify json marshal/unmarshaling
 // between client and server.
 type IdData struct {
@@ -13,3 +22,179 @@ type IdObjectData struct {
 	Id	QueueId
 	Object	[]byte
 }
+
+// Bodies of the versioned /v1 API.
+type QueueData struct {
+	Name	string	`json:"name"`
+	Settings	*QueueSettings	`json:"settings,omitempty"`
+}
+
+// QueueSettings are chosen when a queue is created. Zero values take the
+// server's defaults.
+type QueueSettings struct {
+	// Operations per second and the number that may be made at once; a
+	// negative rate is unlimited.
+	EnqueueRate	float64	`json:"enqueue_rate,omitempty"`
+	EnqueueBurst	int	`json:"enqueue_burst,omitempty"`
+	DequeueRate	float64	`json:"dequeue_rate,omitempty"`
+	DequeueBurst	int	`json:"dequeue_burst,omitempty"`
+	// The queue's implementation, which can't be changed later: "list", a
+	// lock-free linked list; "slice", a ring buffer that grows; "channel",
+	// a buffered channel; "ring", a lock-free ring buffer allocating
+	// nothing per message; or "disk", which keeps objects in a file.
+	// Capacity is the most messages a slice, channel or ring queue holds; 0
+	// is unbounded for slice queues.
+	Kind	string	`json:"kind,omitempty"`
+	Capacity	int	`json:"capacity,omitempty"`
+}
+
+type QueueListData struct {
+	Queues	[]QueueData	`json:"queues"`
+}
+
+// Bytes count payloads plus per-object overhead.
+type QueueStats struct {
+	Name	string	`json:"name"`
+	Depth	int64	`json:"depth"`
+	Bytes	int64	`json:"bytes"`
+	Enqueued	int64	`json:"enqueued"`
+	Dequeued	int64	`json:"dequeued"`
+	OldestAgeSeconds	float64	`json:"oldest_age_seconds"`
+}
+
+type ServerStats struct {
+	MemoryBytes	int64	`json:"memory_bytes"`
+	MaxMemoryBytes	int64	`json:"max_memory_bytes,omitempty"`
+	Queues	[]QueueStats	`json:"queues"`
+}
+
+type MessageData struct {
+	Queue	string	`json:"queue,omitempty"`
+	Object	[]byte	`json:"object"`
+}
+
+type PurgeData struct {
+	Purged	int64	`json:"purged"`
+}
+
+// ExportedMessage is one line of a queue export, in queue order. The ID
+// numbers the queue's enqueues on the exporting server; an import assigns new
+// IDs but keeps EnqueuedAt, so messages keep their age.
+type ExportedMessage struct {
+	ID	int64	`json:"id,omitempty"`
+	EnqueuedAt	time.Time	`json:"enqueued_at"`
+	Object	[]byte	`json:"object"`
+}
+
+type ImportData struct {
+	Imported	int64	`json:"imported"`
+}
+
+// LogLevelData is a server's least severe log level: debug, info, warn or
+// error.
+type LogLevelData struct {
+	Level	string	`json:"level"`
+}
+
+// HealthData is the body of /healthz and /readyz. Status is "ok" if every
+// check passed and "unavailable" otherwise, when the status code is 503.
+type HealthData struct {
+	Status	string	`json:"status"`
+	Checks	[]HealthCheck	`json:"checks"`
+}
+
+// HealthCheck is one condition of a server's health, with Detail explaining
+// it for humans.
+type HealthCheck struct {
+	Name	string	`json:"name"`
+	OK	bool	`json:"ok"`
+	Detail	string	`json:"detail,omitempty"`
+}
+
+// ReplicationEvent is one line of the NDJSON stream a primary sends its
+// replicas: a reset and a snapshot of every queue as create and enqueue
+// events, then each mutation as it happens. Heartbeats carry the primary's
+// latest sequence number and change nothing.
+type ReplicationEvent struct {
+	Seq	int64	`json:"seq"`
+	Op	string	`json:"op"`
+	Queue	string	`json:"queue,omitempty"`
+	Settings	*QueueSettings	`json:"settings,omitempty"`
+	Object	[]byte	`json:"object,omitempty"`
+	EnqueuedAt	int64	`json:"enqueued_at,omitempty"`	// unix nanoseconds
+}
+
+const (
+	ReplicationReset = "reset"
+	ReplicationCreate = "create"
+	ReplicationDelete = "delete"
+	ReplicationEnqueue = "enqueue"
+	ReplicationDequeue = "dequeue"
+	ReplicationHeartbeat = "heartbeat"
+)
+
+// ReplicationStatus describes a server's role. Seq is the last mutation it
+// recorded; a replica also reports how far it is behind its primary.
+type ReplicationStatus struct {
+	Role	string	`json:"role"`
+	Seq	int64	`json:"seq"`
+	Replicas	int	`json:"replicas"`
+	Primary	string	`json:"primary,omitempty"`
+	Connected	bool	`json:"connected,omitempty"`
+	AppliedSeq	int64	`json:"applied_seq,omitempty"`
+	PrimarySeq	int64	`json:"primary_seq,omitempty"`
+	LagEvents	int64	`json:"lag_events,omitempty"`
+	LagSeconds	float64	`json:"lag_seconds,omitempty"`
+}
+
+// ClusterStatus is a clustered server's view of its cluster. State is
+// "leader", "follower" or "candidate". Indexes are positions in the log of
+// queue mutations.
+type ClusterStatus struct {
+	ID	string	`json:"id"`
+	State	string	`json:"state"`
+	Term	uint64	`json:"term"`
+	Leader	string	`json:"leader,omitempty"`
+	Nodes	[]ClusterNode	`json:"nodes"`
+	LastIndex	uint64	`json:"last_index"`
+	CommitIndex	uint64	`json:"commit_index"`
+	LastApplied	uint64	`json:"last_applied"`
+}
+
+// ClusterNode is a cluster member and the address of its HTTP API.
+type ClusterNode struct {
+	ID	string	`json:"id"`
+	Addr	string	`json:"addr"`
+}
+
+type ErrorData struct {
+	Error	ErrorDetail	`json:"error"`
+}
+
+// ErrorDetail.Code is one of the ErrorCode constants and is stable for
+// clients to match on; Message is for humans.
+type ErrorDetail struct {
+	Code	string	`json:"code"`
+	Message	string	`json:"message"`
+}
+
+const (
+	ErrorCodeInvalidArgument = "invalid_argument"
+	ErrorCodeUnauthenticated = "unauthenticated"
+	ErrorCodePermissionDenied = "permission_denied"
+	ErrorCodeQueueExists = "queue_exists"
+	ErrorCodeQueueNotFound = "queue_not_found"
+	ErrorCodeQueueEmpty = "queue_empty"
+	ErrorCodeObjectTooLarge = "object_too_large"
+	ErrorCodeRateLimited = "rate_limited"
+	ErrorCodeMemoryExhausted = "memory_exhausted"
+	ErrorCodeQueueFull = "queue_full"
+	ErrorCodeNotFound = "not_found"
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	ErrorCodeInternal = "internal"
+	ErrorCodeReadOnlyReplica = "read_only_replica"
+	ErrorCodeNotReplica = "not_replica"
+	ErrorCodeReplicationDisabled = "replication_disabled"
+	ErrorCodeNoLeader = "no_leader"
+	ErrorCodeClusterDisabled = "cluster_disabled"
+)
@@ -0,0 +1,611 @@
+// qctl administers a qserver over its HTTP API.
+//
+//	qctl [flags] list
+//	qctl [flags] create [-enqueue_rate r] [-enqueue_burst n] [-dequeue_rate r] [-dequeue_burst n] [-kind k] [-capacity n] NAME
+//	qctl [flags] get NAME
+//	qctl [flags] delete -yes NAME
+//	qctl [flags] stats [NAME]
+//	qctl [flags] purge -yes NAME
+//	qctl [flags] peek NAME
+//	qctl [flags] enqueue [-lines] NAME [FILE...]
+//	qctl [flags] dequeue [-n count] NAME
+//	qctl [flags] export NAME [FILE]
+//	qctl [flags] import NAME [FILE]
+//	qctl [flags] replication
+//	qctl [flags] promote -yes
+//	qctl [flags] cluster
+//	qctl [flags] loglevel [LEVEL]
+//	qctl [flags] verifyaudit FILE
+//
+// create's -kind chooses the queue's implementation: list, slice, channel,
+// ring or disk, with -capacity bounding slice, channel and ring queues.
+// enqueue sends each file, or stdin if there are none or for "-", as one
+// object; with -lines each line is an object. peek and dequeue write objects
+// to stdout raw, or with --output=json as one JSON message per line. export
+// writes a queue's messages, leaving them queued, as NDJSON to FILE or stdout,
+// and import enqueues them from FILE or stdin. loglevel shows the server's log
+// level or, given one, changes it until the server restarts. verifyaudit
+// checks the hash chain of a server's --audit_log file without contacting the
+// server, and prints the last entry's hash to keep for later checks. Other
+// commands print a table, or JSON with --output=json. With --cluster, any
+// reachable node of a clustered server is used. qctl exits 1 if the command
+// fails and 2 if it is misused.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"qclient"
+	"qcommon"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	port = flag.Int("port", 4242, "the port the server is listening on")
+	host = flag.String("host", "localhost", "the host the server is running on")
+	cluster = flag.String("cluster", "", "comma-separated host:port of a clustered server's nodes, used instead of --host and --port")
+	token = flag.String("token", "", "bearer token for servers that require authentication")
+	tlsCA = flag.String("tls_ca", "", "if set, connect over TLS trusting this PEM CA bundle")
+	tlsCert = flag.String("tls_cert", "", "PEM client certificate to present over TLS")
+	tlsKey = flag.String("tls_key", "", "PEM private key for --tls_cert")
+	output = flag.String("output", "table", "output format, table or json")
+)
+
+// usageError is a misused command.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+type command struct {
+	usage	string
+	run	func(args []string) error
+}
+
+var commands = map[string]command{
+	"list":		{"list", list},
+	"create":	{"create [-enqueue_rate r] [-enqueue_burst n] [-dequeue_rate r] [-dequeue_burst n] [-kind k] [-capacity n] NAME", create},
+	"get":		{"get NAME", get},
+	"delete":	{"delete -yes NAME", deleteQueue},
+	"stats":	{"stats [NAME]", stats},
+	"purge":	{"purge -yes NAME", purge},
+	"peek":		{"peek NAME", peek},
+	"enqueue":	{"enqueue [-lines] NAME [FILE...]", enqueue},
+	"dequeue":	{"dequeue [-n count] NAME", dequeue},
+	"export":	{"export NAME [FILE]", export},
+	"import":	{"import NAME [FILE]", importQueue},
+	"replication":	{"replication", replication},
+	"promote":	{"promote -yes", promote},
+	"cluster":	{"cluster", clusterStatus},
+	"loglevel":	{"loglevel [LEVEL]", logLevel},
+	"verifyaudit":	{"verifyaudit FILE", verifyAudit},
+}
+
+var commandOrder = []string{"list", "create", "get", "delete", "stats", "purge", "peek", "enqueue", "dequeue", "export", "import", "replication", "promote", "cluster", "loglevel", "verifyaudit"}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: qctl [flags] command [args]\n\ncommands:\n")
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "qctl: unknown output format %q\n", *output)
+		os.Exit(2)
+	}
+	cmd, present := commands[flag.Arg(0)]
+	if !present {
+		usage()
+		os.Exit(2)
+	}
+
+	qclient.Host = *host
+	qclient.Port = *port
+	if *cluster != "" {
+		qclient.Cluster = strings.Split(*cluster, ",")
+	}
+	qclient.Token = *token
+	if *tlsCA != "" {
+		config, err := qcommon.ClientTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "qctl: %v\n", err)
+			os.Exit(1)
+		}
+		qclient.TLSConfig = config
+	}
+
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "qctl %s: %v\n", flag.Arg(0), err)
+		var u usageError
+		if errors.As(err, &u) {
+			fmt.Fprintf(os.Stderr, "usage: qctl %s\n", cmd.usage)
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+// parseArgs parses a command's flags and checks it was given between min and
+// max positional arguments; max < 0 is unlimited.
+func parseArgs(flags *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, usageError(err.Error())
+	}
+	if flags.NArg() < min || (max >= 0 && flags.NArg() > max) {
+		return nil, usageError("wrong number of arguments")
+	}
+	return flags.Args(), nil
+}
+
+func writeJSON(v interface{}) error {
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// writeTable prints rows under header, aligned in columns.
+func writeTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprint(w, cell)
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+func list(args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("list", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	queues, err := qclient.ListQueues()
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return writeJSON(qcommon.QueueListData{Queues: queues})
+	}
+	var rows [][]string
+	for _, q := range queues {
+		rows = append(rows, []string{q.Name})
+	}
+	return writeTable([]string{"NAME"}, rows)
+}
+
+func writeQueue(data qcommon.QueueData) error {
+	if *output == "json" {
+		return writeJSON(data)
+	}
+	var s qcommon.QueueSettings
+	if data.Settings != nil {
+		s = *data.Settings
+	}
+	return writeTable(
+		[]string{"NAME", "ENQUEUE_RATE", "ENQUEUE_BURST", "DEQUEUE_RATE", "DEQUEUE_BURST", "KIND", "CAPACITY"},
+		[][]string{{data.Name, formatRate(s.EnqueueRate), formatBurst(s.EnqueueBurst), formatRate(s.DequeueRate), formatBurst(s.DequeueBurst), formatKind(s.Kind), formatBurst(s.Capacity)}})
+}
+
+func formatRate(rate float64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return strconv.FormatFloat(rate, 'g', -1, 64)
+}
+
+func formatKind(kind string) string {
+	if kind == "" {
+		return "list"
+	}
+	return kind
+}
+
+func formatBurst(burst int) string {
+	if burst <= 0 {
+		return "-"
+	}
+	return strconv.Itoa(burst)
+}
+
+func create(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	var settings qcommon.QueueSettings
+	flags.Float64Var(&settings.EnqueueRate, "enqueue_rate", 0, "")
+	flags.IntVar(&settings.EnqueueBurst, "enqueue_burst", 0, "")
+	flags.Float64Var(&settings.DequeueRate, "dequeue_rate", 0, "")
+	flags.IntVar(&settings.DequeueBurst, "dequeue_burst", 0, "")
+	flags.StringVar(&settings.Kind, "kind", "", "")
+	flags.IntVar(&settings.Capacity, "capacity", 0, "")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	data, err := qclient.CreateQueueWithSettings(args[0], settings)
+	if err != nil {
+		return err
+	}
+	return writeQueue(data)
+}
+
+func get(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("get", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	data, err := qclient.DescribeQueue(args[0])
+	if err != nil {
+		return err
+	}
+	return writeQueue(data)
+}
+
+// confirmed parses the -yes flag destructive commands require, along with
+// a queue name if the command acts on a queue.
+func confirmed(name string, args []string, onQueue bool) ([]string, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "")
+	n, target := 0, "the server"
+	if onQueue {
+		n = 1
+	}
+	args, err := parseArgs(flags, args, n, n)
+	if err == nil && !*yes {
+		if onQueue {
+			target = strconv.Quote(args[0])
+		}
+		err = usageError(fmt.Sprintf("refusing to %s %s without -yes", name, target))
+	}
+	return args, err
+}
+
+func deleteQueue(args []string) error {
+	args, err := confirmed("delete", args, true)
+	if err != nil {
+		return err
+	}
+	if err := qclient.DeleteQueue(qcommon.QueueId(args[0])); err != nil {
+		return err
+	}
+	if *output == "table" {
+		fmt.Printf("deleted %s\n", args[0])
+	}
+	return nil
+}
+
+func stats(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("stats", flag.ContinueOnError), args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	var queues []qcommon.QueueStats
+	if len(args) == 1 {
+		q, err := qclient.QueueStats(args[0])
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			return writeJSON(q)
+		}
+		queues = []qcommon.QueueStats{q}
+	} else {
+		s, err := qclient.Stats()
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			return writeJSON(s)
+		}
+		limit := "unlimited"
+		if s.MaxMemoryBytes > 0 {
+			limit = strconv.FormatInt(s.MaxMemoryBytes, 10)
+		}
+		fmt.Printf("memory: %d of %s bytes\n\n", s.MemoryBytes, limit)
+		queues = s.Queues
+	}
+
+	var rows [][]string
+	for _, q := range queues {
+		rows = append(rows, []string{q.Name, strconv.FormatInt(q.Depth, 10), strconv.FormatInt(q.Bytes, 10), strconv.FormatInt(q.Enqueued, 10), strconv.FormatInt(q.Dequeued, 10), formatSeconds(q.OldestAgeSeconds)})
+	}
+	return writeTable([]string{"NAME", "DEPTH", "BYTES", "ENQUEUED", "DEQUEUED", "OLDEST"}, rows)
+}
+
+func purge(args []string) error {
+	args, err := confirmed("purge", args, true)
+	if err != nil {
+		return err
+	}
+	purged, err := qclient.Purge(args[0])
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return writeJSON(qcommon.PurgeData{Purged: purged})
+	}
+	fmt.Printf("purged %d from %s\n", purged, args[0])
+	return nil
+}
+
+func writeObject(name string, object qcommon.Object) error {
+	if *output == "json" {
+		return writeJSON(qcommon.MessageData{Queue: name, Object: object})
+	}
+	_, err := os.Stdout.Write(object)
+	return err
+}
+
+func peek(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("peek", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	object, err := qclient.Peek(args[0])
+	if err != nil {
+		return err
+	}
+	return writeObject(args[0], object)
+}
+
+func enqueue(args []string) error {
+	flags := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	lines := flags.Bool("lines", false, "")
+	args, err := parseArgs(flags, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	id := qcommon.QueueId(args[0])
+	files := args[1:]
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	count := 0
+	for _, file := range files {
+		r := io.Reader(os.Stdin)
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		if *lines {
+			scanner := bufio.NewScanner(r)
+			scanner.Buffer(nil, 64 << 20)
+			for scanner.Scan() {
+				if err := qclient.Enqueue(id, append([]byte(nil), scanner.Bytes()...)); err != nil {
+					return fmt.Errorf("%s after %d objects: %v", file, count, err)
+				}
+				count++
+			}
+			if err := scanner.Err(); err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+			continue
+		}
+
+		object, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if err := qclient.Enqueue(id, object); err != nil {
+			return fmt.Errorf("%s after %d objects: %v", file, count, err)
+		}
+		count++
+	}
+	if *output == "table" {
+		fmt.Printf("enqueued %d to %s\n", count, args[0])
+	}
+	return nil
+}
+
+// dequeue removes up to count objects, stopping early if the queue empties.
+// It fails only if the queue was empty to begin with.
+func dequeue(args []string) error {
+	flags := flag.NewFlagSet("dequeue", flag.ContinueOnError)
+	count := flags.Int("n", 1, "")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < *count; i++ {
+		object, err := qclient.DequeueHead(args[0])
+		var apiErr *qclient.APIError
+		if i > 0 && errors.As(err, &apiErr) && apiErr.Code == qcommon.ErrorCodeQueueEmpty {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeObject(args[0], object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// export writes to FILE, or stdout if there is none or for "-".
+func export(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("export", flag.ContinueOnError), args, 1, 2)
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 || args[1] == "-" {
+		_, err := qclient.Export(args[0], os.Stdout)
+		return err
+	}
+	f, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	exported, err := qclient.Export(args[0], f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s after %d messages: %v", args[1], exported, err)
+	}
+	if *output == "table" {
+		fmt.Printf("exported %d from %s to %s\n", exported, args[0], args[1])
+	}
+	return nil
+}
+
+// importQueue reads FILE, or stdin if there is none or for "-".
+func importQueue(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("import", flag.ContinueOnError), args, 1, 2)
+	if err != nil {
+		return err
+	}
+	r := io.Reader(os.Stdin)
+	if len(args) == 2 && args[1] != "-" {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	imported, err := qclient.Import(args[0], r)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return writeJSON(qcommon.ImportData{Imported: imported})
+	}
+	fmt.Printf("imported %d to %s\n", imported, args[0])
+	return nil
+}
+
+func writeReplicationStatus(status qcommon.ReplicationStatus) error {
+	if *output == "json" {
+		return writeJSON(status)
+	}
+	if status.Role != "replica" {
+		return writeTable([]string{"ROLE", "SEQ", "REPLICAS"}, [][]string{{status.Role, strconv.FormatInt(status.Seq, 10), strconv.Itoa(status.Replicas)}})
+	}
+	return writeTable(
+		[]string{"ROLE", "PRIMARY", "CONNECTED", "APPLIED_SEQ", "PRIMARY_SEQ", "LAG_EVENTS", "LAG"},
+		[][]string{{status.Role, status.Primary, strconv.FormatBool(status.Connected), strconv.FormatInt(status.AppliedSeq, 10), strconv.FormatInt(status.PrimarySeq, 10), strconv.FormatInt(status.LagEvents, 10), formatSeconds(status.LagSeconds)}})
+}
+
+// formatSeconds formats a duration reported in seconds, or "-" for none.
+func formatSeconds(seconds float64) string {
+	if seconds <= 0 {
+		return "-"
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+func replication(args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("replication", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	status, err := qclient.ReplicationStatus()
+	if err != nil {
+		return err
+	}
+	return writeReplicationStatus(status)
+}
+
+func promote(args []string) error {
+	if _, err := confirmed("promote", args, false); err != nil {
+		return err
+	}
+	status, err := qclient.Promote()
+	if err != nil {
+		return err
+	}
+	return writeReplicationStatus(status)
+}
+
+func clusterStatus(args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("cluster", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	status, err := qclient.ClusterStatus()
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return writeJSON(status)
+	}
+	// only the node that answered reports its log
+	var rows [][]string
+	for _, node := range status.Nodes {
+		row := []string{node.ID, node.Addr, "", "-", "-", "-"}
+		switch node.ID {
+		case status.ID:
+			row[2] = status.State
+			row[3] = strconv.FormatUint(status.Term, 10)
+			row[4] = strconv.FormatUint(status.CommitIndex, 10)
+			row[5] = strconv.FormatUint(status.LastApplied, 10)
+		case status.Leader:
+			row[2] = "leader"
+		}
+		rows = append(rows, row)
+	}
+	return writeTable([]string{"NODE", "ADDR", "STATE", "TERM", "COMMIT_INDEX", "LAST_APPLIED"}, rows)
+}
+
+func logLevel(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("loglevel", flag.ContinueOnError), args, 0, 1)
+	if err != nil {
+		return err
+	}
+	var level string
+	if len(args) == 1 {
+		level, err = qclient.SetLogLevel(args[0])
+	} else {
+		level, err = qclient.LogLevel()
+	}
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return writeJSON(qcommon.LogLevelData{Level: level})
+	}
+	return writeTable([]string{"LEVEL"}, [][]string{{level}})
+}
+
+// verifyAudit fails at the first entry of an audit log that was altered,
+// removed or reordered.
+func verifyAudit(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("verifyaudit", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	last, n, err := qcommon.VerifyAuditLog(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	if *output == "json" {
+		return writeJSON(map[string]interface{}{"entries": n, "last_seq": last.Seq, "last_hash": last.Hash})
+	}
+	return writeTable([]string{"ENTRIES", "LAST_SEQ", "LAST_HASH"}, [][]string{{strconv.FormatInt(n, 10), strconv.FormatInt(last.Seq, 10), last.Hash}})
+}
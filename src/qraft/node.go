@@ -0,0 +1,826 @@
+// Package qraft replicates a log of commands across a cluster of nodes with
+// the Raft consensus algorithm. A command proposed to the leader is applied,
+// in the same order, on every node once a majority of the cluster has it.
+//
+// A node with a StateFile keeps its term and vote there, so that it never
+// votes twice in a term however often it restarts. Its log is kept in memory
+// only: a node that restarts rejoins empty and catches up from the leader, so
+// a committed command is lost if every node that had it restarts before the
+// others receive it. With Snapshot and Restore, applied entries are dropped
+// from the log and followers too far behind for what remains are sent a
+// snapshot instead.
+package qraft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultElectionTimeout = time.Second
+	DefaultKeepApplied = 1024
+
+	// entries sent to a follower per AppendEntries
+	maxBatch = 256
+)
+
+// Node states.
+const (
+	Follower = "follower"
+	Candidate = "candidate"
+	Leader = "leader"
+)
+
+var (
+	ErrStopped = errors.New("qraft: node stopped")
+	// ErrLeadershipLost is returned for proposals whose leader stepped down
+	// before they committed. The command may still be applied if the new
+	// leader had it.
+	ErrLeadershipLost = errors.New("qraft: leadership lost before the command committed")
+)
+
+// NotLeaderError is returned by Propose on nodes that aren't the leader.
+type NotLeaderError struct {
+	// Leader is the id of the current leader, or empty if none is known.
+	Leader	string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "qraft: not the leader and no leader is known"
+	}
+	return fmt.Sprintf("qraft: not the leader; the leader is %s", e.Leader)
+}
+
+type Config struct {
+	ID	string
+	// Peers are the ids of the other nodes in the cluster.
+	Peers	[]string
+	Transport	Transport
+	// Apply is called with each committed command, in log order, on a single
+	// goroutine. On the leader its result is returned by Propose.
+	Apply	func(command []byte) interface{}
+	// HeartbeatInterval defaults to DefaultHeartbeatInterval.
+	HeartbeatInterval	time.Duration
+	// ElectionTimeout is the least time followers wait to hear from a leader
+	// before standing for election; each waits a random time up to twice it.
+	// It defaults to DefaultElectionTimeout.
+	ElectionTimeout	time.Duration
+	// StateFile, if set, is where the node keeps its term and vote. NewNode
+	// reads them back from it.
+	StateFile	string
+	// Snapshot returns the state the commands applied so far have built, and
+	// Restore replaces the state with one Snapshot returned. Neither is
+	// called while a command is being applied. With both set, the log keeps
+	// only the KeepApplied most recently applied entries, up to twice as many
+	// before it drops the older ones.
+	Snapshot	func() []byte
+	Restore	func(snapshot []byte)
+	// KeepApplied defaults to DefaultKeepApplied.
+	KeepApplied	int
+}
+
+// Status describes a node's view of the cluster.
+type Status struct {
+	ID	string	`json:"id"`
+	State	string	`json:"state"`
+	Term	uint64	`json:"term"`
+	Leader	string	`json:"leader,omitempty"`
+	LastIndex	uint64	`json:"last_index"`
+	CommitIndex	uint64	`json:"commit_index"`
+	LastApplied	uint64	`json:"last_applied"`
+	// FirstIndex is the index of the oldest entry still in the log.
+	FirstIndex	uint64	`json:"first_index"`
+}
+
+// hardState is what a node keeps in its StateFile.
+type hardState struct {
+	Term	uint64	`json:"term"`
+	VotedFor	string	`json:"voted_for,omitempty"`
+}
+
+type result struct {
+	value	interface{}
+	err	error
+}
+
+type proposal struct {
+	term	uint64
+	done	chan result
+}
+
+type Node struct {
+	id	string
+	peers	[]string
+	transport	Transport
+	apply	func([]byte) interface{}
+	heartbeat	time.Duration
+	electionTimeout	time.Duration
+	stateFile	string
+	snapshot	func() []byte
+	restore	func([]byte)
+	keepApplied	uint64
+	// signalled to send entries to a peer before its next heartbeat
+	notify	map[string]chan bool
+	applyReady	chan bool
+	stopped	chan bool
+	wg	sync.WaitGroup
+	// held while applying a command or taking a snapshot, before mu
+	applying	sync.Mutex
+
+	mu	sync.Mutex
+	state	string
+	term	uint64
+	votedFor	string
+	leader	string
+	// log[0] stands for the entries dropped from the log, the last of which
+	// is at compacted; it has their last term and no command
+	log	[]Entry
+	compacted	uint64
+	commitIndex	uint64
+	lastApplied	uint64
+	// a snapshot from the leader for the applier to restore, and the index
+	// it was taken at
+	received	[]byte
+	receivedIndex	uint64
+	electionDeadline	time.Time
+	// leader state
+	nextIndex	map[string]uint64
+	matchIndex	map[string]uint64
+	lastContact	map[string]time.Time
+	pending	map[uint64]proposal
+}
+
+// NewNode returns a node configured by config, which fails only if its
+// StateFile can't be read.
+func NewNode(config Config) (*Node, error) {
+	n := &Node{
+		id:		config.ID,
+		peers:		config.Peers,
+		transport:	config.Transport,
+		apply:		config.Apply,
+		heartbeat:	config.HeartbeatInterval,
+		electionTimeout:	config.ElectionTimeout,
+		stateFile:	config.StateFile,
+		snapshot:	config.Snapshot,
+		restore:	config.Restore,
+		notify:		map[string]chan bool{},
+		applyReady:	make(chan bool, 1),
+		stopped:	make(chan bool),
+		state:		Follower,
+		log:		[]Entry{{}},
+		nextIndex:	map[string]uint64{},
+		matchIndex:	map[string]uint64{},
+		lastContact:	map[string]time.Time{},
+		pending:	map[uint64]proposal{},
+	}
+	if n.heartbeat <= 0 {
+		n.heartbeat = DefaultHeartbeatInterval
+	}
+	if n.electionTimeout <= 0 {
+		n.electionTimeout = DefaultElectionTimeout
+	}
+	n.keepApplied = DefaultKeepApplied
+	if config.KeepApplied > 0 {
+		n.keepApplied = uint64(config.KeepApplied)
+	}
+	for _, peer := range n.peers {
+		n.notify[peer] = make(chan bool, 1)
+	}
+	if n.stateFile != "" {
+		b, err := os.ReadFile(n.stateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			var state hardState
+			if err := json.Unmarshal(b, &state); err != nil {
+				return nil, fmt.Errorf("qraft: reading %s: %v", n.stateFile, err)
+			}
+			n.term, n.votedFor = state.Term, state.VotedFor
+		}
+	}
+	return n, nil
+}
+
+// Start begins taking part in the cluster.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetElectionDeadline()
+	n.mu.Unlock()
+	n.wg.Add(2)
+	go n.run()
+	go n.applier()
+}
+
+// Stop leaves the cluster, failing pending proposals, and waits for the node's
+// goroutines to finish.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	select {
+	case <-n.stopped:
+		n.mu.Unlock()
+		return
+	default:
+	}
+	close(n.stopped)
+	n.failPending(ErrStopped)
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Leader returns the id of the leader this node knows of, or empty if none.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:		n.id,
+		State:		n.state,
+		Term:		n.term,
+		Leader:		n.leader,
+		LastIndex:	n.lastIndex(),
+		CommitIndex:	n.commitIndex,
+		LastApplied:	n.lastApplied,
+		FirstIndex:	n.compacted + 1,
+	}
+}
+
+// Propose appends command to the log and waits until it is committed and
+// applied, returning what Apply returned. It fails with a *NotLeaderError on
+// nodes other than the leader.
+func (n *Node) Propose(ctx context.Context, command []byte) (interface{}, error) {
+	if len(command) == 0 {
+		return nil, errors.New("qraft: empty command")
+	}
+	n.mu.Lock()
+	select {
+	case <-n.stopped:
+		n.mu.Unlock()
+		return nil, ErrStopped
+	default:
+	}
+	if n.state != Leader {
+		err := &NotLeaderError{Leader: n.leader}
+		n.mu.Unlock()
+		return nil, err
+	}
+	n.log = append(n.log, Entry{Term: n.term, Command: command})
+	index := n.lastIndex()
+	done := make(chan result, 1)
+	n.pending[index] = proposal{term: n.term, done: done}
+	n.advanceCommit()
+	n.mu.Unlock()
+	for _, ch := range n.notify {
+		signal(ch)
+	}
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.pending, index)
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Handle answers an RPC from another node.
+func (n *Node) Handle(msg Message) (Message, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.stopped:
+		return Message{}, ErrStopped
+	default:
+	}
+	switch msg.Type {
+	case MsgRequestVote:
+		return n.handleRequestVote(msg), nil
+	case MsgAppendEntries:
+		return n.handleAppendEntries(msg), nil
+	case MsgInstallSnapshot:
+		return n.handleInstallSnapshot(msg), nil
+	}
+	return Message{}, fmt.Errorf("qraft: unknown message type %q", msg.Type)
+}
+
+func (n *Node) handleRequestVote(msg Message) Message {
+	if msg.Term > n.term {
+		n.becomeFollower(msg.Term, "")
+	}
+	reply := Message{Type: MsgRequestVote, Term: n.term, From: n.id}
+	if msg.Term < n.term || (n.votedFor != "" && n.votedFor != msg.From) {
+		return reply
+	}
+	// only vote for candidates whose log has everything ours does
+	lastTerm := n.entry(n.lastIndex()).Term
+	if msg.LastLogTerm < lastTerm || (msg.LastLogTerm == lastTerm && msg.LastLogIndex < n.lastIndex()) {
+		return reply
+	}
+	n.votedFor = msg.From
+	// a vote that might be forgotten isn't given
+	if err := n.saveState(); err != nil {
+		n.votedFor = ""
+		return reply
+	}
+	n.resetElectionDeadline()
+	reply.Granted = true
+	return reply
+}
+
+func (n *Node) handleAppendEntries(msg Message) Message {
+	reply := Message{Type: MsgAppendEntries, Term: n.term, From: n.id}
+	if !n.heardFromLeader(msg) {
+		return reply
+	}
+	reply.Term = n.term
+
+	if msg.PrevLogIndex < n.compacted {
+		// the dropped entries were committed, so they match the leader's
+		skip := min(n.compacted - msg.PrevLogIndex, uint64(len(msg.Entries)))
+		msg.Entries = msg.Entries[skip:]
+		msg.PrevLogIndex += skip
+		if msg.PrevLogIndex < n.compacted {
+			reply.Success = true
+			return reply
+		}
+		msg.PrevLogTerm = n.entry(msg.PrevLogIndex).Term
+	}
+	if msg.PrevLogIndex > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return reply
+	}
+	if term := n.entry(msg.PrevLogIndex).Term; term != msg.PrevLogTerm {
+		// skip back past the whole conflicting term rather than an entry at a
+		// time
+		i := msg.PrevLogIndex
+		for i > n.commitIndex + 1 && n.entry(i - 1).Term == term {
+			i--
+		}
+		reply.ConflictIndex = i
+		return reply
+	}
+	for i, entry := range msg.Entries {
+		index := msg.PrevLogIndex + 1 + uint64(i)
+		if index <= n.lastIndex() {
+			if n.entry(index).Term == entry.Term {
+				continue
+			}
+			n.log = n.log[:index - n.compacted]
+		}
+		n.log = append(n.log, msg.Entries[i:]...)
+		break
+	}
+	// a delayed message can know of less of the log than one already handled,
+	// so commitIndex only ever moves forward
+	if commit := min(msg.LeaderCommit, msg.PrevLogIndex + uint64(len(msg.Entries))); commit > n.commitIndex {
+		n.commitIndex = commit
+		signal(n.applyReady)
+	}
+	reply.Success = true
+	return reply
+}
+
+// handleInstallSnapshot replaces the log up to the snapshot's index with the
+// snapshot, which the applier restores before applying anything after it.
+func (n *Node) handleInstallSnapshot(msg Message) Message {
+	reply := Message{Type: MsgInstallSnapshot, Term: n.term, From: n.id}
+	if !n.heardFromLeader(msg) {
+		return reply
+	}
+	reply.Term = n.term
+	reply.Success = true
+	if msg.SnapshotIndex <= n.commitIndex {
+		return reply
+	}
+	log := []Entry{{Term: msg.SnapshotTerm}}
+	if msg.SnapshotIndex <= n.lastIndex() && n.entry(msg.SnapshotIndex).Term == msg.SnapshotTerm {
+		log = append(log, n.log[msg.SnapshotIndex - n.compacted + 1:]...)
+	}
+	n.log = log
+	n.compacted = msg.SnapshotIndex
+	n.commitIndex = msg.SnapshotIndex
+	n.received, n.receivedIndex = msg.Snapshot, msg.SnapshotIndex
+	signal(n.applyReady)
+	return reply
+}
+
+// heardFromLeader follows the sender of msg if it leads a term no older than
+// this node's, reporting whether it does. Called with n.mu held.
+func (n *Node) heardFromLeader(msg Message) bool {
+	if msg.Term < n.term {
+		return false
+	}
+	if msg.Term > n.term || n.state != Follower {
+		n.becomeFollower(msg.Term, msg.From)
+	}
+	n.leader = msg.From
+	n.resetElectionDeadline()
+	return true
+}
+
+// run stands for election when no leader is heard from, and makes a leader
+// that can no longer reach a majority step down.
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.stopped:
+			return
+		}
+		n.mu.Lock()
+		switch {
+		case n.state == Leader && !n.hasQuorum():
+			n.becomeFollower(n.term, "")
+		case n.state != Leader && time.Now().After(n.electionDeadline):
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection stands for leader in a new term. Called with n.mu held.
+func (n *Node) startElection() {
+	n.resetElectionDeadline()
+	term, votedFor := n.term, n.votedFor
+	n.term++
+	n.votedFor = n.id
+	if err := n.saveState(); err != nil {
+		// try again at the next deadline
+		n.term, n.votedFor = term, votedFor
+		return
+	}
+	n.state = Candidate
+	n.leader = ""
+	term = n.term
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	req := Message{Type: MsgRequestVote, Term: term, From: n.id, LastLogIndex: n.lastIndex(), LastLogTerm: n.entry(n.lastIndex()).Term}
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go func(peer string) {
+			defer n.wg.Done()
+			reply, err := n.send(peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term, "")
+				return
+			}
+			if n.state != Candidate || n.term != term || !reply.Granted {
+				return
+			}
+			votes++
+			if votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader starts replicating to every peer. Called with n.mu held.
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.id
+	now := time.Now()
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.lastContact[peer] = now
+	}
+	// entries from earlier terms only commit once one from this term does
+	n.log = append(n.log, Entry{Term: n.term})
+	n.advanceCommit()
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go n.replicate(peer, n.term)
+	}
+}
+
+// becomeFollower moves to term, failing any proposals if this node was the
+// leader. Called with n.mu held.
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+	}
+	if n.state == Leader {
+		n.failPending(ErrLeadershipLost)
+	}
+	n.state = Follower
+	n.leader = leader
+	n.resetElectionDeadline()
+}
+
+// replicate sends entries and heartbeats to peer for as long as this node is
+// leader in term.
+func (n *Node) replicate(peer string, term uint64) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+	for {
+		n.mu.Lock()
+		if n.state != Leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		var req Message
+		if prev := n.nextIndex[peer] - 1; prev >= n.compacted {
+			end := min(n.lastIndex(), prev + maxBatch)
+			req = Message{
+				Type:		MsgAppendEntries,
+				Term:		term,
+				From:		n.id,
+				PrevLogIndex:	prev,
+				PrevLogTerm:	n.entry(prev).Term,
+				Entries:	append([]Entry(nil), n.log[prev + 1 - n.compacted:end + 1 - n.compacted]...),
+				LeaderCommit:	n.commitIndex,
+			}
+			n.mu.Unlock()
+		} else {
+			// the entries the peer needs next were dropped
+			n.mu.Unlock()
+			var ok bool
+			if req, ok = n.snapshotMessage(term); !ok {
+				return
+			}
+		}
+
+		reply, err := n.send(peer, req)
+		more := false
+		if err == nil {
+			more = n.replicated(peer, req, reply)
+		}
+		if more {
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-n.notify[peer]:
+		case <-n.stopped:
+			return
+		}
+	}
+}
+
+// snapshotMessage takes a snapshot to send a peer, reporting false if this
+// node no longer leads term.
+func (n *Node) snapshotMessage(term uint64) (Message, bool) {
+	n.applying.Lock()
+	defer n.applying.Unlock()
+	n.mu.Lock()
+	if n.state != Leader || n.term != term {
+		n.mu.Unlock()
+		return Message{}, false
+	}
+	msg := Message{Type: MsgInstallSnapshot, Term: term, From: n.id, SnapshotIndex: n.lastApplied}
+	if n.received != nil {
+		// a snapshot installed as a follower and not yet restored is ahead
+		// of the state machine, and already dropped the entries after it
+		msg.SnapshotIndex, msg.Snapshot = n.receivedIndex, n.received
+	}
+	msg.SnapshotTerm = n.entry(msg.SnapshotIndex).Term
+	n.mu.Unlock()
+	if msg.Snapshot == nil {
+		msg.Snapshot = n.snapshot()
+	}
+	return msg, true
+}
+
+// replicated handles a peer's answer to AppendEntries or InstallSnapshot,
+// reporting whether there is more to send it straight away.
+func (n *Node) replicated(peer string, req, reply Message) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term, "")
+		return false
+	}
+	if n.state != Leader || n.term != req.Term {
+		return false
+	}
+	n.lastContact[peer] = time.Now()
+	if !reply.Success && req.Type == MsgInstallSnapshot {
+		return false
+	}
+	if !reply.Success {
+		next := n.nextIndex[peer] - 1
+		if reply.ConflictIndex > 0 && reply.ConflictIndex < next {
+			next = reply.ConflictIndex
+		}
+		n.nextIndex[peer] = max(next, 1)
+		return true
+	}
+	match := req.PrevLogIndex + uint64(len(req.Entries))
+	if req.Type == MsgInstallSnapshot {
+		match = req.SnapshotIndex
+	}
+	if match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+		n.nextIndex[peer] = match + 1
+		n.advanceCommit()
+	}
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// advanceCommit commits the newest entry of the current term that a majority
+// has. Called with n.mu held.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.entry(index).Term == n.term; index-- {
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			signal(n.applyReady)
+			return
+		}
+	}
+}
+
+// applier applies committed entries in order and answers their proposals.
+func (n *Node) applier() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.applyReady:
+		case <-n.stopped:
+			return
+		}
+		for n.applyNext() {
+		}
+	}
+}
+
+// applyNext applies the next committed entry, or restores a snapshot from the
+// leader, reporting false if there was nothing to do.
+func (n *Node) applyNext() bool {
+	n.applying.Lock()
+	defer n.applying.Unlock()
+	n.mu.Lock()
+	if snapshot := n.received; snapshot != nil {
+		index := n.receivedIndex
+		n.received = nil
+		n.mu.Unlock()
+		n.restore(snapshot)
+		n.mu.Lock()
+		n.lastApplied = index
+		n.mu.Unlock()
+		return true
+	}
+	if n.lastApplied >= n.commitIndex {
+		n.mu.Unlock()
+		return false
+	}
+	index := n.lastApplied + 1
+	entry := n.entry(index)
+	n.mu.Unlock()
+
+	var value interface{}
+	if len(entry.Command) > 0 {
+		value = n.apply(entry.Command)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastApplied = index
+	if p, present := n.pending[index]; present {
+		delete(n.pending, index)
+		if p.term == entry.Term {
+			p.done <- result{value: value}
+		} else {
+			p.done <- result{err: ErrLeadershipLost}
+		}
+	}
+	if n.snapshot != nil && n.restore != nil && index - n.compacted >= 2 * n.keepApplied {
+		n.compact(index - n.keepApplied)
+	}
+	return true
+}
+
+// compact drops the entries up to index, which have been applied, from the
+// log. Called with n.applying and n.mu held.
+func (n *Node) compact(index uint64) {
+	// copied so that the dropped commands can be freed
+	log := make([]Entry, 1, n.lastIndex() - index + 1)
+	log[0] = Entry{Term: n.entry(index).Term}
+	n.log = append(log, n.log[index - n.compacted + 1:]...)
+	n.compacted = index
+}
+
+// saveState writes the term and vote to the state file, if there is one.
+// Called with n.mu held.
+func (n *Node) saveState() error {
+	if n.stateFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(hardState{Term: n.term, VotedFor: n.votedFor})
+	if err != nil {
+		return err
+	}
+	// written aside and renamed so that a crash leaves the old state or the
+	// new one
+	tmp := n.stateFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, n.stateFile)
+}
+
+func (n *Node) send(peer string, msg Message) (Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-n.stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return n.transport.Send(ctx, peer, msg)
+}
+
+// hasQuorum reports whether the leader has heard from a majority within an
+// election timeout. Called with n.mu held.
+func (n *Node) hasQuorum() bool {
+	count := 1
+	for _, peer := range n.peers {
+		if time.Since(n.lastContact[peer]) < n.electionTimeout {
+			count++
+		}
+	}
+	return count >= n.quorum()
+}
+
+func (n *Node) failPending(err error) {
+	for index, p := range n.pending {
+		delete(n.pending, index)
+		p.done <- result{err: err}
+	}
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers) + 1) / 2 + 1
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.compacted + uint64(len(n.log) - 1)
+}
+
+// entry returns the entry at index, which must not have been dropped, or for
+// the last dropped index an entry with only its term.
+func (n *Node) entry(index uint64) Entry {
+	return n.log[index - n.compacted]
+}
+
+func (n *Node) resetElectionDeadline() {
+	n.electionDeadline = time.Now().Add(n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout))))
+}
+
+func signal(ch chan bool) {
+	select {
+	case ch <- true:
+	default:
+	}
+}
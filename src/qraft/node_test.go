@@ -0,0 +1,396 @@
+package qraft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCluster runs nodes on a memory network, each applying commands to its
+// own list.
+type testCluster struct {
+	network	*MemoryNetwork
+	ids	[]string
+	nodes	map[string]*Node
+	keepApplied	int
+
+	mu	sync.Mutex
+	applied	map[string][]string
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	c := &testCluster{network: NewMemoryNetwork(), nodes: map[string]*Node{}, applied: map[string][]string{}}
+	for i := 0; i < size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+// start starts the node id with an empty log, as if it had restarted.
+func (c *testCluster) start(id string) {
+	var peers []string
+	for _, peer := range c.ids {
+		if peer != id {
+			peers = append(peers, peer)
+		}
+	}
+	c.mu.Lock()
+	c.applied[id] = nil
+	c.mu.Unlock()
+	n, _ := NewNode(Config{
+		ID:			id,
+		Peers:			peers,
+		Transport:		c.network.Transport(id),
+		HeartbeatInterval:	5 * time.Millisecond,
+		ElectionTimeout:	50 * time.Millisecond,
+		KeepApplied:		c.keepApplied,
+		Apply: func(command []byte) interface{} {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.applied[id] = append(c.applied[id], string(command))
+			return len(c.applied[id])
+		},
+		Snapshot: func() []byte {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			b, _ := json.Marshal(c.applied[id])
+			return b
+		},
+		Restore: func(snapshot []byte) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			var applied []string
+			json.Unmarshal(snapshot, &applied)
+			c.applied[id] = applied
+		},
+	})
+	c.nodes[id] = n
+	c.network.Register(n)
+	n.Start()
+}
+
+// leader waits for exactly one of ids to lead, with the rest following it.
+func (c *testCluster) leader(t *testing.T, ids ...string) *Node {
+	t.Helper()
+	if len(ids) == 0 {
+		ids = c.ids
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []string
+		agreed := true
+		for _, id := range ids {
+			status := c.nodes[id].Status()
+			if status.State == Leader {
+				leaders = append(leaders, id)
+			}
+			agreed = agreed && status.Leader != "" && status.Leader == c.nodes[ids[0]].Leader()
+		}
+		if len(leaders) == 1 && agreed {
+			return c.nodes[leaders[0]]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no single leader among %v", ids)
+	return nil
+}
+
+// waitApplied waits for node id to have applied want.
+func (c *testCluster) waitApplied(t *testing.T, id string, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		got := fmt.Sprint(c.applied[id])
+		c.mu.Unlock()
+		if got == fmt.Sprint(want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s applied %s, want %v", id, got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func propose(t *testing.T, n *Node, command string) interface{} {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	value, err := n.Propose(ctx, []byte(command))
+	if err != nil {
+		t.Fatalf("proposing %q to %s: %v", command, n.ID(), err)
+	}
+	return value
+}
+
+func TestReplicates(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(t)
+	for i, command := range []string{"a", "b", "c"} {
+		if value := propose(t, leader, command); value != i + 1 {
+			t.Errorf("applying %q returned %v, want %d", command, value, i + 1)
+		}
+	}
+	for _, id := range c.ids {
+		c.waitApplied(t, id, []string{"a", "b", "c"})
+	}
+
+	for _, n := range c.nodes {
+		if n == leader {
+			continue
+		}
+		_, err := n.Propose(context.Background(), []byte("d"))
+		var notLeader *NotLeaderError
+		if !errors.As(err, &notLeader) || notLeader.Leader != leader.ID() {
+			t.Errorf("proposing to follower %s: %v, want leader %s", n.ID(), err, leader.ID())
+		}
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	c := newTestCluster(t, 1)
+	if value := propose(t, c.leader(t), "a"); value != 1 {
+		t.Errorf("got %v, want 1", value)
+	}
+}
+
+func TestPartitionedLeader(t *testing.T) {
+	c := newTestCluster(t, 5)
+	old := c.leader(t)
+	propose(t, old, "a")
+
+	var majority []string
+	for _, id := range c.ids {
+		if id != old.ID() {
+			majority = append(majority, id)
+		}
+	}
+	// the old leader keeps one follower, too few to commit anything
+	c.network.Partition([]string{old.ID(), majority[0]}, majority[1:])
+	ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+	_, err := old.Propose(ctx, []byte("lost"))
+	cancel()
+	if err == nil {
+		t.Fatalf("minority leader committed a proposal")
+	}
+
+	leader := c.leader(t, majority[1:]...)
+	propose(t, leader, "b")
+	if status := old.Status(); status.State == Leader {
+		t.Errorf("leader cut off from a majority still leads: %+v", status)
+	}
+
+	// once healed, the minority drops its uncommitted entry for the majority's
+	c.network.Heal()
+	leader = c.leader(t)
+	propose(t, leader, "c")
+	for _, id := range c.ids {
+		c.waitApplied(t, id, []string{"a", "b", "c"})
+	}
+}
+
+func TestNoQuorum(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.leader(t)
+	c.network.Partition()
+	time.Sleep(300 * time.Millisecond)
+	for _, n := range c.nodes {
+		if status := n.Status(); status.State == Leader {
+			t.Errorf("isolated node leads: %+v", status)
+		}
+	}
+	c.network.Heal()
+	propose(t, c.leader(t), "a")
+}
+
+func TestRestartedNodeCatchesUp(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(t)
+	propose(t, leader, "a")
+	propose(t, leader, "b")
+
+	var restarted string
+	for _, id := range c.ids {
+		if id != leader.ID() {
+			restarted = id
+		}
+	}
+	c.nodes[restarted].Stop()
+	propose(t, leader, "c")
+	c.start(restarted)
+	c.waitApplied(t, restarted, []string{"a", "b", "c"})
+}
+
+func TestCompaction(t *testing.T) {
+	c := &testCluster{network: NewMemoryNetwork(), nodes: map[string]*Node{}, applied: map[string][]string{}, keepApplied: 4}
+	c.ids = []string{"n0", "n1", "n2"}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	defer func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	}()
+	leader := c.leader(t)
+	var restarted string
+	for _, id := range c.ids {
+		if id != leader.ID() {
+			restarted = id
+		}
+	}
+	c.nodes[restarted].Stop()
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprint(i))
+		propose(t, leader, want[i])
+	}
+	if status := leader.Status(); status.FirstIndex <= 1 || status.LastIndex - status.FirstIndex >= 2 * 4 {
+		t.Errorf("leader's log wasn't compacted: %+v", status)
+	}
+
+	// the restarted node needs entries the leader dropped
+	c.start(restarted)
+	c.waitApplied(t, restarted, want)
+	want = append(want, "after")
+	propose(t, leader, "after")
+	for _, id := range c.ids {
+		c.waitApplied(t, id, want)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state")
+	config := Config{ID: "c", Peers: []string{"a", "b"}, Transport: NewMemoryNetwork().Transport("c"), StateFile: file}
+	n, err := NewNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, _ := n.Handle(Message{Type: MsgRequestVote, Term: 3, From: "a"}); !reply.Granted {
+		t.Fatalf("vote refused: %+v", reply)
+	}
+
+	// restarted, it remembers the vote it gave in term 3
+	n, err = NewNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, _ := n.Handle(Message{Type: MsgRequestVote, Term: 3, From: "b"}); reply.Granted || reply.Term != 3 {
+		t.Errorf("voted twice in a term: %+v", reply)
+	}
+	if reply, _ := n.Handle(Message{Type: MsgRequestVote, Term: 3, From: "a"}); !reply.Granted {
+		t.Errorf("vote for the same candidate refused: %+v", reply)
+	}
+}
+
+func TestDelayedHeartbeat(t *testing.T) {
+	n, _ := NewNode(Config{ID: "b", Peers: []string{"a"}, Transport: NewMemoryNetwork().Transport("b")})
+	entries := []Entry{{Term: 1, Command: []byte("x")}, {Term: 1, Command: []byte("y")}, {Term: 1, Command: []byte("z")}}
+	n.Handle(Message{Type: MsgAppendEntries, Term: 1, From: "a", Entries: entries, LeaderCommit: 2})
+	if status := n.Status(); status.CommitIndex != 2 {
+		t.Fatalf("commit index %d, want 2", status.CommitIndex)
+	}
+	// a heartbeat sent after the first entry was replicated arrives late
+	reply, _ := n.Handle(Message{Type: MsgAppendEntries, Term: 1, From: "a", PrevLogIndex: 1, PrevLogTerm: 1, LeaderCommit: 3})
+	if !reply.Success {
+		t.Errorf("delayed heartbeat refused: %+v", reply)
+	}
+	if status := n.Status(); status.CommitIndex != 2 || status.LastIndex != 3 {
+		t.Errorf("after delayed heartbeat: %+v, want commit index 2 and last index 3", status)
+	}
+}
+
+func TestSnapshotBeforeRestore(t *testing.T) {
+	n, _ := NewNode(Config{ID: "b", Peers: []string{"a"}, Transport: NewMemoryNetwork().Transport("b"), Snapshot: func() []byte { return []byte("stale") }, Restore: func([]byte) {}})
+	n.Handle(Message{Type: MsgInstallSnapshot, Term: 1, From: "a", SnapshotIndex: 5, SnapshotTerm: 1, Snapshot: []byte("received")})
+	// the node wins an election before its applier restores the snapshot
+	n.mu.Lock()
+	n.state, n.term = Leader, 2
+	n.mu.Unlock()
+	msg, ok := n.snapshotMessage(2)
+	if !ok || msg.SnapshotIndex != 5 || msg.SnapshotTerm != 1 || string(msg.Snapshot) != "received" {
+		t.Errorf("got %+v, %v; want the received snapshot at index 5", msg, ok)
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	transport := &HTTPTransport{URLs: map[string]string{}, Token: "secret"}
+	nodes := map[string]*Node{}
+	var mu sync.Mutex
+	applied := map[string]int{}
+	for _, id := range ids {
+		var peers []string
+		for _, peer := range ids {
+			if peer != id {
+				peers = append(peers, peer)
+			}
+		}
+		id := id
+		nodes[id], _ = NewNode(Config{
+			ID:			id,
+			Peers:			peers,
+			Transport:		transport,
+			HeartbeatInterval:	5 * time.Millisecond,
+			ElectionTimeout:	50 * time.Millisecond,
+			Apply: func(command []byte) interface{} {
+				mu.Lock()
+				defer mu.Unlock()
+				applied[id]++
+				return nil
+			},
+		})
+		srv := httptest.NewServer(Handler(nodes[id]))
+		defer srv.Close()
+		transport.URLs[id] = srv.URL
+	}
+	for _, n := range nodes {
+		n.Start()
+		defer n.Stop()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var err error
+		for _, n := range nodes {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			_, err = n.Propose(ctx, []byte("x"))
+			cancel()
+			if err == nil {
+				break
+			}
+		}
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no proposal committed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := applied["a"] == 1 && applied["b"] == 1 && applied["c"] == 1
+		mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("applied %v, want one command on each node", applied)
+}
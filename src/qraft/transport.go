@@ -0,0 +1,210 @@
+package qraft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Message types.
+const (
+	MsgRequestVote = "request_vote"
+	MsgAppendEntries = "append_entries"
+	MsgInstallSnapshot = "install_snapshot"
+)
+
+// Message is a Raft RPC request or its response.
+type Message struct {
+	Type	string	`json:"type"`
+	Term	uint64	`json:"term"`
+	From	string	`json:"from"`
+
+	// RequestVote
+	LastLogIndex	uint64	`json:"last_log_index,omitempty"`
+	LastLogTerm	uint64	`json:"last_log_term,omitempty"`
+	Granted	bool	`json:"granted,omitempty"`
+
+	// AppendEntries
+	PrevLogIndex	uint64	`json:"prev_log_index,omitempty"`
+	PrevLogTerm	uint64	`json:"prev_log_term,omitempty"`
+	Entries	[]Entry	`json:"entries,omitempty"`
+	LeaderCommit	uint64	`json:"leader_commit,omitempty"`
+	Success	bool	`json:"success,omitempty"`
+	// on failure, the index the leader should try next
+	ConflictIndex	uint64	`json:"conflict_index,omitempty"`
+
+	// InstallSnapshot, answered with Success
+	SnapshotIndex	uint64	`json:"snapshot_index,omitempty"`
+	SnapshotTerm	uint64	`json:"snapshot_term,omitempty"`
+	Snapshot	[]byte	`json:"snapshot,omitempty"`
+}
+
+// Entry is a log entry. Entries with an empty command are appended by new
+// leaders and not applied.
+type Entry struct {
+	Term	uint64	`json:"term"`
+	Command	[]byte	`json:"command,omitempty"`
+}
+
+// Transport carries RPCs between nodes.
+type Transport interface {
+	Send(ctx context.Context, to string, msg Message) (Message, error)
+}
+
+// ErrUnreachable is returned by MemoryNetwork for nodes that are down or on
+// the other side of a partition.
+var ErrUnreachable = errors.New("qraft: node unreachable")
+
+// MemoryNetwork connects nodes in one process, for tests. Nodes may be cut
+// off from each other with Partition.
+type MemoryNetwork struct {
+	mu	sync.Mutex
+	nodes	map[string]*Node
+	groups	map[string]int
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: map[string]*Node{}, groups: map[string]int{}}
+}
+
+// Register makes n reachable on the network under its id.
+func (m *MemoryNetwork) Register(n *Node) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes[n.id] = n
+}
+
+// Partition splits the network so that nodes only reach nodes in their own
+// group. Nodes in no group are cut off from everyone.
+func (m *MemoryNetwork) Partition(groups ...[]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.groups = map[string]int{}
+	for i, group := range groups {
+		for _, id := range group {
+			m.groups[id] = i + 1
+		}
+	}
+	for id := range m.nodes {
+		if m.groups[id] == 0 {
+			m.groups[id] = -1
+		}
+	}
+}
+
+// Heal removes any partition.
+func (m *MemoryNetwork) Heal() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.groups = map[string]int{}
+}
+
+// Transport returns the transport for the node with id from.
+func (m *MemoryNetwork) Transport(from string) Transport {
+	return memoryTransport{m, from}
+}
+
+func (m *MemoryNetwork) reachable(from, to string) (*Node, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, present := m.nodes[to]
+	if !present || m.groups[from] != m.groups[to] || m.groups[from] < 0 {
+		return nil, false
+	}
+	return n, true
+}
+
+type memoryTransport struct {
+	network	*MemoryNetwork
+	from	string
+}
+
+func (t memoryTransport) Send(ctx context.Context, to string, msg Message) (Message, error) {
+	n, ok := t.network.reachable(t.from, to)
+	if !ok {
+		return Message{}, ErrUnreachable
+	}
+	resp, err := n.Handle(msg)
+	if err != nil {
+		return Message{}, err
+	}
+	// the reply crosses the network too
+	if _, ok := t.network.reachable(to, t.from); !ok {
+		return Message{}, ErrUnreachable
+	}
+	return resp, nil
+}
+
+// HTTPTransport sends RPCs as JSON POSTs to each node's Handler.
+type HTTPTransport struct {
+	// URLs maps node ids to the URL their Handler is served at.
+	URLs	map[string]string
+	// Token, if set, is sent as a bearer token.
+	Token	string
+	Client	*http.Client
+}
+
+func (t *HTTPTransport) Send(ctx context.Context, to string, msg Message) (Message, error) {
+	url, present := t.URLs[to]
+	if !present {
+		return Message{}, fmt.Errorf("qraft: unknown node %q", to)
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return Message{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(b))
+	if err != nil {
+		return Message{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.Token != "" {
+		req.Header.Set("Authorization", "Bearer " + t.Token)
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Message{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Message{}, fmt.Errorf("qraft: %s from %s", resp.Status, to)
+	}
+	var reply Message
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	return reply, err
+}
+
+// Handler serves RPCs sent by HTTPTransport to n.
+func Handler(n *Node) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		var msg Message
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1 << 30)).Decode(&msg); err != nil {
+			http.Error(w, "Unable to parse message", http.StatusBadRequest)
+			return
+		}
+		reply, err := n.Handle(msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		b, err := json.Marshal(reply)
+		if err != nil {
+			http.Error(w, "Failed to marshal JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
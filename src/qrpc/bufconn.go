@@ -0,0 +1,58 @@
+package qrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// BufListener is an in-process net.Listener whose connections are created by
+// its Dial method, for serving and calling gRPC without opening a port.
+type BufListener struct {
+	conns	chan net.Conn
+	done	chan struct{}
+	once	sync.Once
+}
+
+type bufAddr struct{}
+
+func (bufAddr) Network() string { return "bufconn" }
+func (bufAddr) String() string { return "bufconn" }
+
+var errListenerClosed = errors.New("bufconn: listener closed")
+
+func NewBufListener() *BufListener {
+	return &BufListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *BufListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *BufListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *BufListener) Addr() net.Addr {
+	return bufAddr{}
+}
+
+// Dial connects to the listener. It has the signature of a DialFunc.
+func (l *BufListener) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,158 @@
+package qrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"qcommon"
+	"strconv"
+)
+
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Client calls a QueueService over gRPC. It implements QueueService itself.
+type Client struct {
+	// Token, if set, is sent as a bearer token with every call.
+	Token	string
+
+	scheme	string
+	addr	string
+	httpClient	*http.Client
+}
+
+// NewClient returns a client for the gRPC server at addr. Connections are made
+// with dial, or over TCP if dial is nil.
+func NewClient(addr string, dial DialFunc) *Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{Protocols: &protocols, DialContext: dial}
+	return &Client{scheme: "http", addr: addr, httpClient: &http.Client{Transport: transport}}
+}
+
+// NewTLSClient is NewClient over TLS.
+func NewTLSClient(addr string, dial DialFunc, config *tls.Config) *Client {
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	transport := &http.Transport{Protocols: &protocols, DialContext: dial, TLSClientConfig: config}
+	return &Client{scheme: "https", addr: addr, httpClient: &http.Client{Transport: transport}}
+}
+
+// call makes an RPC and passes each reply message to fn.
+func (c *Client) call(ctx context.Context, method string, req []byte, fn func(fields [][]byte) error) error {
+	var body bytes.Buffer
+	writeMessage(&body, req)
+	r, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s://%s/%s/%s", c.scheme, c.addr, ServiceName, method), &body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Te", "trailers")
+	if c.Token != "" {
+		r.Header.Set("Authorization", "Bearer " + c.Token)
+	}
+
+	resp, err := c.httpClient.Do(r)
+	if err != nil {
+		return Errorf(Unavailable, "%v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Errorf(Unknown, "unexpected HTTP status: %s", resp.Status)
+	}
+
+	for {
+		msg, err := readMessage(resp.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Errorf(Internal, "reading reply: %v", err)
+		}
+		fields, err := decode(msg, 2)
+		if err != nil {
+			return Errorf(Internal, "decoding reply: %v", err)
+		}
+		if err := fn(fields); err != nil {
+			return err
+		}
+	}
+	return responseStatus(resp)
+}
+
+// responseStatus returns the error carried in the response's grpc-status,
+// which is a header for trailers-only responses and a trailer otherwise.
+func responseStatus(resp *http.Response) error {
+	header := resp.Header
+	if header.Get("Grpc-Status") == "" {
+		header = resp.Trailer
+	}
+	code, err := strconv.Atoi(header.Get("Grpc-Status"))
+	if err != nil {
+		return Errorf(Internal, "missing grpc-status")
+	}
+	if Code(code) == OK {
+		return nil
+	}
+	return &Status{Code: Code(code), Message: decodeStatusMessage(header.Get("Grpc-Message"))}
+}
+
+func (c *Client) unary(ctx context.Context, method string, req []byte) ([][]byte, error) {
+	var reply [][]byte
+	err := c.call(ctx, method, req, func(fields [][]byte) error {
+		reply = fields
+		return nil
+	})
+	if err == nil && reply == nil {
+		err = Errorf(Internal, "missing reply to %s", method)
+	}
+	return reply, err
+}
+
+func (c *Client) CreateQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	reply, err := c.unary(ctx, "CreateQueue", encode([]byte(name)))
+	if err != nil {
+		return "", err
+	}
+	return qcommon.QueueId(reply[0]), nil
+}
+
+func (c *Client) GetQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	reply, err := c.unary(ctx, "GetQueue", encode([]byte(name)))
+	if err != nil {
+		return "", err
+	}
+	return qcommon.QueueId(reply[0]), nil
+}
+
+func (c *Client) DeleteQueue(ctx context.Context, id qcommon.QueueId) error {
+	_, err := c.unary(ctx, "DeleteQueue", encode([]byte(id)))
+	return err
+}
+
+func (c *Client) Enqueue(ctx context.Context, id qcommon.QueueId, object qcommon.Object) error {
+	_, err := c.unary(ctx, "Enqueue", encode([]byte(id), object))
+	return err
+}
+
+func (c *Client) Dequeue(ctx context.Context, id qcommon.QueueId) (qcommon.Object, error) {
+	reply, err := c.unary(ctx, "Dequeue", encode([]byte(id)))
+	if err != nil {
+		if CodeOf(err) == OutOfRange {
+			return nil, ErrEmpty
+		}
+		return nil, err
+	}
+	return qcommon.Object(reply[1]), nil
+}
+
+// DequeueStream passes each object in the queue to fn until the queue is
+// empty or fn returns an error.
+func (c *Client) DequeueStream(ctx context.Context, id qcommon.QueueId, fn func(object qcommon.Object) error) error {
+	return c.call(ctx, "DequeueStream", encode([]byte(id)), func(fields [][]byte) error {
+		return fn(qcommon.Object(fields[1]))
+	})
+}
@@ -0,0 +1,139 @@
+package qrpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"qcommon"
+	"strconv"
+	"strings"
+)
+
+const (
+	ServiceName = "qserve.QueueService"
+)
+
+// QueueService is the set of queue operations exposed over gRPC. Dequeue
+// returns ErrEmpty when there is nothing to dequeue. Servers pass the request
+// context, carrying the authenticated principal if any.
+type QueueService interface {
+	CreateQueue(ctx context.Context, name string) (qcommon.QueueId, error)
+	GetQueue(ctx context.Context, name string) (qcommon.QueueId, error)
+	DeleteQueue(ctx context.Context, id qcommon.QueueId) error
+	Enqueue(ctx context.Context, id qcommon.QueueId, object qcommon.Object) error
+	Dequeue(ctx context.Context, id qcommon.QueueId) (qcommon.Object, error)
+}
+
+// Server is an http.Handler serving a QueueService as gRPC. It must be served
+// over HTTP/2.
+type Server struct {
+	svc	QueueService
+}
+
+func NewServer(svc QueueService) *Server {
+	return &Server{svc: svc}
+}
+
+// NewHTTPServer returns an http.Server that serves svc over HTTP/2, with or
+// without TLS.
+func NewHTTPServer(svc QueueService) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{Handler: NewServer(svc), Protocols: &protocols}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+
+	method, ok := strings.CutPrefix(r.URL.Path, "/" + ServiceName + "/")
+	if !ok {
+		writeStatus(w, Errorf(Unimplemented, "unknown service for %q", r.URL.Path))
+		return
+	}
+
+	req, err := readMessage(r.Body)
+	if err != nil {
+		writeStatus(w, Errorf(InvalidArgument, "reading request: %v", err))
+		return
+	}
+	fields, err := decode(req, 2)
+	if err != nil {
+		writeStatus(w, Errorf(InvalidArgument, "decoding request: %v", err))
+		return
+	}
+	id := qcommon.QueueId(fields[0])
+	ctx := r.Context()
+
+	var reply []byte
+	switch method {
+	case "CreateQueue":
+		id, err = s.svc.CreateQueue(ctx, string(fields[0]))
+		reply = encode([]byte(id))
+	case "GetQueue":
+		id, err = s.svc.GetQueue(ctx, string(fields[0]))
+		reply = encode([]byte(id))
+	case "DeleteQueue":
+		err = s.svc.DeleteQueue(ctx, id)
+		reply = encode()
+	case "Enqueue":
+		err = s.svc.Enqueue(ctx, id, fields[1])
+		reply = encode()
+	case "Dequeue":
+		var object qcommon.Object
+		object, err = s.svc.Dequeue(ctx, id)
+		reply = encode([]byte(id), object)
+	case "DequeueStream":
+		writeStatus(w, s.dequeueStream(ctx, w, id))
+		return
+	default:
+		err = Errorf(Unimplemented, "unknown method %q", method)
+	}
+
+	if err == nil {
+		err = writeMessage(w, reply)
+	}
+	writeStatus(w, err)
+}
+
+// dequeueStream sends objects until the queue is empty.
+func (s *Server) dequeueStream(ctx context.Context, w http.ResponseWriter, id qcommon.QueueId) error {
+	flusher, _ := w.(http.Flusher)
+	for {
+		object, err := s.svc.Dequeue(ctx, id)
+		if err == ErrEmpty {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeMessage(w, encode([]byte(id), object)); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// writeStatus sets the grpc-status trailers for err.
+func writeStatus(w http.ResponseWriter, err error) {
+	code := CodeOf(err)
+	w.Header().Set(http.TrailerPrefix + "Grpc-Status", strconv.Itoa(int(code)))
+	if err != nil {
+		msg := err.Error()
+		var s *Status
+		if errors.As(err, &s) {
+			msg = s.Message
+		}
+		w.Header().Set(http.TrailerPrefix + "Grpc-Message", encodeStatusMessage(msg))
+	}
+}
@@ -0,0 +1,77 @@
+package qrpc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Code is a gRPC status code.
+type Code int
+
+const (
+	OK Code = 0
+	Unknown Code = 2
+	InvalidArgument Code = 3
+	NotFound Code = 5
+	AlreadyExists Code = 6
+	PermissionDenied Code = 7
+	ResourceExhausted Code = 8
+	OutOfRange Code = 11
+	Unimplemented Code = 12
+	Internal Code = 13
+	Unavailable Code = 14
+	Unauthenticated Code = 16
+)
+
+// Status is an error carrying a gRPC status code.
+type Status struct {
+	Code	Code
+	Message	string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", s.Code, s.Message)
+}
+
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// ErrEmpty is returned by QueueService.Dequeue when the queue has no objects.
+var ErrEmpty = Errorf(OutOfRange, "Attempt to dequeue from empty queue")
+
+// CodeOf returns the status code of err, OK for nil and Unknown for errors
+// that don't carry a status.
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	var s *Status
+	if errors.As(err, &s) {
+		return s.Code
+	}
+	return Unknown
+}
+
+// grpc-message values are percent-encoded outside printable ASCII.
+func encodeStatusMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func decodeStatusMessage(msg string) string {
+	if s, err := url.PathUnescape(msg); err == nil {
+		return s
+	}
+	return msg
+}
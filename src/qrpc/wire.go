@@ -0,0 +1,117 @@
+package qrpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// protobuf wire types
+const (
+	wireVarint = 0
+	wireFixed64 = 1
+	wireBytes = 2
+	wireFixed32 = 5
+)
+
+const (
+	maxMessageSize = 64 << 20
+)
+
+// encode builds a protobuf message from length-delimited fields. The field
+// number of fields[i] is i+1. Empty fields are omitted as in proto3.
+func encode(fields ...[]byte) []byte {
+	var b []byte
+	for i, f := range fields {
+		if len(f) == 0 {
+			continue
+		}
+		b = binary.AppendUvarint(b, uint64((i+1)<<3|wireBytes))
+		b = binary.AppendUvarint(b, uint64(len(f)))
+		b = append(b, f...)
+	}
+	return b
+}
+
+// decode parses a protobuf message into its first n length-delimited fields.
+// Unknown fields are skipped.
+func decode(b []byte, n int) ([][]byte, error) {
+	fields := make([][]byte, n)
+	for len(b) > 0 {
+		key, l := binary.Uvarint(b)
+		if l <= 0 {
+			return nil, fmt.Errorf("malformed field key")
+		}
+		b = b[l:]
+		field, wireType := int(key>>3), int(key&7)
+
+		var v []byte
+		switch wireType {
+		case wireVarint:
+			_, l = binary.Uvarint(b)
+			if l <= 0 {
+				return nil, fmt.Errorf("malformed varint in field %d", field)
+			}
+			b = b[l:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wireType == wireFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return nil, fmt.Errorf("truncated field %d", field)
+			}
+			b = b[size:]
+		case wireBytes:
+			size, l := binary.Uvarint(b)
+			if l <= 0 || uint64(len(b)-l) < size {
+				return nil, fmt.Errorf("truncated field %d", field)
+			}
+			v = b[l : l+int(size)]
+			b = b[l+int(size):]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d in field %d", wireType, field)
+		}
+
+		if field >= 1 && field <= n && wireType == wireBytes {
+			fields[field-1] = v
+		}
+	}
+	return fields, nil
+}
+
+// writeMessage writes a length-prefixed gRPC message. Compression is not
+// supported.
+func writeMessage(w io.Writer, msg []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// readMessage reads a length-prefixed gRPC message. Returns io.EOF if the
+// stream ends cleanly between messages.
+func readMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated message header")
+		}
+		return nil, err
+	}
+	if hdr[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds limit", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("truncated message: %v", err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,59 @@
+package qrpc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	b := encode([]byte("id"), []byte{0, 1, 2})
+	fields, err := decode(b, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(fields[0]) != "id" || !bytes.Equal(fields[1], []byte{0, 1, 2}) {
+		t.Errorf("want %q, got %q", []string{"id", "\x00\x01\x02"}, fields)
+	}
+}
+
+func TestDecodeSkipsUnknownFields(t *testing.T) {
+	// field 3 varint 150, field 1 "x", field 4 fixed32
+	b := []byte{0x18, 0x96, 0x01, 0x0a, 0x01, 'x', 0x25, 0, 0, 0, 0}
+	fields, err := decode(b, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(fields[0]) != "x" {
+		t.Errorf("want %q, got %q", "x", fields[0])
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	if _, err := decode([]byte{0x0a, 0x05, 'x'}, 1); err == nil {
+		t.Errorf("expected error for truncated field")
+	}
+}
+
+func TestMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+	writeMessage(&buf, []byte("one"))
+	writeMessage(&buf, nil)
+
+	for _, want := range []string{"one", ""} {
+		msg, err := readMessage(&buf)
+		if err != nil || string(msg) != want {
+			t.Errorf("want %q, got %q (%v)", want, msg, err)
+		}
+	}
+	if _, err := readMessage(&buf); err != io.EOF {
+		t.Errorf("want EOF, got %v", err)
+	}
+}
+
+func TestStatusMessageEncoding(t *testing.T) {
+	msg := "50% done\n\xff"
+	if got := decodeStatusMessage(encodeStatusMessage(msg)); got != msg {
+		t.Errorf("want %q, got %q", msg, got)
+	}
+}
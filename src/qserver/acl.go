@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"qcommon"
+	"qrpc"
+	"strings"
+	"sync"
+)
+
+type permission string
+
+const (
+	permCreate permission = "create"
+	permDelete permission = "delete"
+	permEnqueue permission = "enqueue"
+	permDequeue permission = "dequeue"
+	// permAdmin grants every other permission.
+	permAdmin permission = "admin"
+)
+
+var allPermissions = []permission{permCreate, permDelete, permEnqueue, permDequeue, permAdmin}
+
+// aclRule grants permissions to a principal on queues whose names match any of
+// the path.Match patterns in Queues. A Principal of "*" matches everyone,
+// including unauthenticated callers.
+type aclRule struct {
+	Principal	string	`json:"principal"`
+	Queues	[]string	`json:"queues"`
+	Permissions	[]permission	`json:"permissions"`
+}
+
+// acl is the authorization policy, loaded from a JSON file of the form
+//
+//	{"rules": [{"principal": "producer", "queues": ["orders-*"], "permissions": ["enqueue"]}]}
+type acl struct {
+	sync.RWMutex
+	path	string
+	rules	[]aclRule
+}
+
+func loadACL(path string) (*acl, error) {
+	a := &acl{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload re-reads the policy file, keeping the current rules if it is invalid.
+func (a *acl) reload() error {
+	b, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var policy struct {
+		Rules	[]aclRule	`json:"rules"`
+	}
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return fmt.Errorf("%s: %v", a.path, err)
+	}
+	for i, rule := range policy.Rules {
+		if rule.Principal == "" {
+			return fmt.Errorf("%s: rule %d: missing principal", a.path, i)
+		}
+		for _, pattern := range rule.Queues {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: rule %d: bad queue pattern %q", a.path, i, pattern)
+			}
+		}
+		for _, perm := range rule.Permissions {
+			if !validPermission(perm) {
+				return fmt.Errorf("%s: rule %d: unknown permission %q", a.path, i, perm)
+			}
+		}
+	}
+
+	a.Lock()
+	a.rules = policy.Rules
+	a.Unlock()
+	return nil
+}
+
+func validPermission(perm permission) bool {
+	for _, p := range allPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether principal holds any of perms on the queue.
+func (a *acl) allows(principal string, queue string, perms ...permission) bool {
+	a.RLock()
+	defer a.RUnlock()
+	for _, rule := range a.rules {
+		if rule.Principal != "*" && rule.Principal != principal {
+			continue
+		}
+		if !matchesAny(rule.Queues, queue) {
+			continue
+		}
+		for _, granted := range rule.Permissions {
+			if granted == permAdmin {
+				return true
+			}
+			for _, perm := range perms {
+				if granted == perm {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize returns a PermissionDenied error, and logs the denial, unless the
+// caller holds one of perms on the queue. Everything is allowed if no policy
+// is loaded.
+func authorize(ctx context.Context, queue string, perms ...permission) error {
+	if acls == nil {
+		return nil
+	}
+	principal := qcommon.PrincipalFrom(ctx)
+	if acls.allows(principal, queue, perms...) {
+		return nil
+	}
+	logger.Info("permission denied", "principal", principal, "permissions", fmt.Sprint(perms), "queue", queue)
+	return qrpc.Errorf(qrpc.PermissionDenied, "Permission denied")
+}
+
+// permitted is authorize for HTTP handlers. It writes a 403 in the style of
+// the API being called and returns false if the request is denied.
+func permitted(w http.ResponseWriter, r *http.Request, queue string, perms ...permission) bool {
+	if err := authorize(r.Context(), queue, perms...); err != nil {
+		msg := err.(*qrpc.Status).Message
+		if strings.HasPrefix(r.URL.Path, "/v1/") {
+			writeError(w, http.StatusForbidden, qcommon.ErrorCodePermissionDenied, "%s", msg)
+		} else {
+			http.Error(w, msg, http.StatusForbidden)
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"qcommon"
+	"qrpc"
+	"testing"
+)
+
+const testPolicy = `{"rules": [
+	{"principal": "producer", "queues": ["orders-*"], "permissions": ["enqueue"]},
+	{"principal": "consumer", "queues": ["orders-*", "audit"], "permissions": ["dequeue"]},
+	{"principal": "ops", "queues": ["*"], "permissions": ["admin"]},
+	{"principal": "*", "queues": ["public"], "permissions": ["enqueue", "dequeue"]}
+]}`
+
+func loadTestACL(t *testing.T, policy string) (*acl, error) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	if err := os.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatalf("writing policy: %v", err)
+	}
+	return loadACL(path)
+}
+
+func TestACLAllows(t *testing.T) {
+	a, err := loadTestACL(t, testPolicy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, test := range []struct {
+		principal	string
+		queue	string
+		perm	permission
+		want	bool
+	}{
+		{"producer", "orders-eu", permEnqueue, true},
+		{"producer", "orders-eu", permDequeue, false},
+		{"producer", "orders-eu", permDelete, false},
+		{"producer", "audit", permEnqueue, false},
+		{"consumer", "audit", permDequeue, true},
+		{"ops", "anything", permDelete, true},
+		{"ops", "anything", permCreate, true},
+		{"", "public", permEnqueue, true},
+		{"", "orders-eu", permEnqueue, false},
+	} {
+		if got := a.allows(test.principal, test.queue, test.perm); got != test.want {
+			t.Errorf("%q %s %q: want %v, got %v", test.principal, test.perm, test.queue, test.want, got)
+		}
+	}
+}
+
+func TestACLValidation(t *testing.T) {
+	for _, policy := range []string{
+		`{"rules": [{"principal": "p", "queues": ["q"], "permissions": ["drain"]}]}`,
+		`{"rules": [{"principal": "p", "queues": ["[q"], "permissions": ["enqueue"]}]}`,
+		`{"rules": [{"queues": ["q"], "permissions": ["enqueue"]}]}`,
+		`{"rules": [`,
+	} {
+		if _, err := loadTestACL(t, policy); err == nil {
+			t.Errorf("expected error for %s", policy)
+		}
+	}
+}
+
+func TestACLEnforced(t *testing.T) {
+	a, _ := loadTestACL(t, testPolicy)
+	acls = a
+	defer func() { acls = nil }()
+
+	registry := newRegistry()
+	registry.create("orders-eu", qcommon.QueueSettings{})
+	svc := service{registry}
+	producer := qcommon.WithPrincipal(ctx, "producer")
+	if err := svc.Enqueue(producer, "orders-eu", []byte("x")); err != nil {
+		t.Errorf("unexpected enqueue error: %v", err)
+	}
+	if _, err := svc.Dequeue(producer, "orders-eu"); qrpc.CodeOf(err) != qrpc.PermissionDenied {
+		t.Errorf("want PermissionDenied, got %v", err)
+	}
+	if err := svc.DeleteQueue(producer, "orders-eu"); qrpc.CodeOf(err) != qrpc.PermissionDenied {
+		t.Errorf("want PermissionDenied, got %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/delete", deleteHandler)
+	registerRESTHandlers(mux)
+	for _, test := range []struct {
+		method	string
+		path	string
+		want	int
+	}{
+		{"POST", "/delete?id=orders-eu", http.StatusForbidden},
+		{"DELETE", "/v1/queues/orders-eu", http.StatusForbidden},
+		{"PUT", "/v1/queues/orders-us", http.StatusForbidden},
+		{"DELETE", "/v1/queues/orders-eu/messages/head", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r = r.WithContext(producer)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %s: want %d, got %d", test.method, test.path, test.want, w.Code)
+		}
+	}
+}
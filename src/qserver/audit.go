@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"qcommon"
+	"sync"
+	"time"
+)
+
+// auditLog appends a hash-chained qcommon.AuditEntry per administrative
+// action to a file, syncing each. A nil auditLog records nothing.
+type auditLog struct {
+	sync.Mutex
+	f	*os.File
+	last	qcommon.AuditEntry
+}
+
+// openAuditLog verifies the audit log at path, creating it if need be, and
+// opens it to append to the chain.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	last, _, err := qcommon.VerifyAuditLog(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s is corrupt or has been tampered with: %v", path, err)
+	}
+	return &auditLog{f: f, last: last}, nil
+}
+
+// record appends an action taken by the caller of ctx. Failures are logged
+// rather than returned since the action has already been taken.
+func (a *auditLog) record(ctx context.Context, action, queue string, params interface{}) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	e := qcommon.AuditEntry{
+		Seq:		a.last.Seq + 1,
+		Time:		time.Now().UTC(),
+		Principal:	qcommon.PrincipalFrom(ctx),
+		Remote:		qcommon.RemoteAddrFrom(ctx),
+		Action:		action,
+		Queue:		queue,
+		PrevHash:	a.last.Hash,
+	}
+	var err error
+	if params != nil {
+		e.Params, err = json.Marshal(params)
+	}
+	if err == nil {
+		err = a.write(&e)
+	}
+	if err != nil {
+		logger.Error("writing audit log failed", "action", action, "queue", queue, "error", err)
+		return
+	}
+	a.last = e
+}
+
+// write hashes e and appends it. Called with a locked.
+func (a *auditLog) write(e *qcommon.AuditEntry) error {
+	var err error
+	if e.Hash, err = e.ComputeHash(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	return a.f.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"qcommon"
+	"strings"
+	"testing"
+)
+
+// useAuditLog records to a fresh audit log until the test ends.
+func useAuditLog(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audits = a
+	t.Cleanup(func() {
+		audits = nil
+		a.close()
+	})
+	return path
+}
+
+func readAudit(t *testing.T, path string) []qcommon.AuditEntry {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []qcommon.AuditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var e qcommon.AuditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("audit line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	path := useAuditLog(t)
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	writeTokens(t, tokenFile, "s3cret alice\n")
+	tokens, _ := loadTokens(tokenFile)
+	mux := http.NewServeMux()
+	registerRESTHandlers(mux)
+	srv := httptest.NewServer(authenticate(tokens, mux))
+	defer srv.Close()
+	// the test recreates the queue after deleting it
+	defer queues.remove("auditq")
+	url := srv.URL + "/v1/queues/auditq"
+	request := func(method, url, body string) {
+		r, _ := http.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	request("PUT", url, `{"settings": {"enqueue_rate": 5}}`)
+	request("POST", url + "/messages", `{"object": "eA=="}`)
+	request("DELETE", url + "/messages", "")
+	request("DELETE", url, "")
+
+	entries := readAudit(t, path)
+	want := []string{qcommon.AuditCreateQueue, qcommon.AuditPurgeQueue, qcommon.AuditDeleteQueue}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d audit entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, e := range entries {
+		if e.Action != want[i] || e.Queue != "auditq" || e.Principal != "alice" || e.Remote == "" || e.Time.IsZero() {
+			t.Errorf("entry %d: %+v", i, e)
+		}
+	}
+	if !strings.Contains(string(entries[0].Params), `"enqueue_rate":5`) || string(entries[1].Params) != `{"purged":1}` {
+		t.Errorf("params: %s, %s", entries[0].Params, entries[1].Params)
+	}
+
+	// reopening carries the chain on
+	audits.close()
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	audits = a
+	request("PUT", url, "")
+	f, _ := os.Open(path)
+	defer f.Close()
+	if last, n, err := qcommon.VerifyAuditLog(f); err != nil || n != 4 || last.Seq != 4 {
+		t.Errorf("verifying: %d entries, last %+v, %v", n, last, err)
+	}
+}
+
+func TestAuditLogTampering(t *testing.T) {
+	path := useAuditLog(t)
+	for _, queue := range []string{"a", "b", "c"} {
+		audits.record(t.Context(), qcommon.AuditCreateQueue, queue, nil)
+	}
+	b, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(string(b), "\n")[:3]
+
+	for name, tampered := range map[string]string{
+		"altered":	lines[0] + strings.Replace(lines[1], `"queue":"b"`, `"queue":"x"`, 1) + lines[2],
+		"removed":	lines[0] + lines[2],
+		"reordered":	lines[1] + lines[0] + lines[2],
+		"truncated line":	lines[0] + lines[1][:20],
+	} {
+		if _, _, err := qcommon.VerifyAuditLog(strings.NewReader(tampered)); err == nil {
+			t.Errorf("%s log verified", name)
+		}
+		os.WriteFile(path, []byte(tampered), 0600)
+		if _, err := openAuditLog(path); err == nil {
+			t.Errorf("%s log opened", name)
+		}
+	}
+	if _, n, err := qcommon.VerifyAuditLog(bytes.NewReader(b)); err != nil || n != 3 {
+		t.Errorf("untouched log: %d entries, %v", n, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"qcommon"
+	"qrpc"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tokenStore maps bearer tokens to the principal they authenticate. Tokens are
+// kept hashed so that lookups don't compare secrets byte by byte.
+type tokenStore struct {
+	sync.RWMutex
+	path	string
+	principals	map[[sha256.Size]byte]string
+}
+
+// loadTokens reads a token file. Each non-empty line not starting with '#' is
+// a token followed by the principal it authenticates, separated by spaces.
+func loadTokens(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload re-reads the token file, keeping the current tokens if it is invalid.
+func (s *tokenStore) reload() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	principals := map[[sha256.Size]byte]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want \"<token> <principal>\"", s.path, line)
+		}
+		principals[sha256.Sum256([]byte(fields[0]))] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.principals = principals
+	s.Unlock()
+	return nil
+}
+
+func (s *tokenStore) principal(token string) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	principal, present := s.principals[sha256.Sum256([]byte(token))]
+	return principal, present
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// authenticate identifies the caller as the principal another node of the
+// cluster forwarded the request for, by bearer token or, failing those, by the
+// common name of a verified TLS client certificate. If tokens is set, requests
+// identified by none of these are rejected with a 401 in the style of the API
+// being called.
+func authenticate(tokens *tokenStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(qcommon.WithRemoteAddr(r.Context(), r.RemoteAddr))
+		// a request another node forwarded comes from whoever it says
+		principal, ok := queues.cluster.forwardedPrincipal(r)
+		if token, found := bearerToken(r); !ok && found && tokens != nil {
+			principal, ok = tokens.principal(token)
+		}
+		if !ok {
+			principal, ok = qcommon.CertPrincipal(r.TLS)
+		}
+		if ok {
+			annotate(r.Context(), "principal", principal)
+			next.ServeHTTP(w, r.WithContext(qcommon.WithPrincipal(r.Context(), principal)))
+			return
+		}
+		if tokens == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logger.Debug("rejected unauthenticated request", "remote", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="qserver"`)
+		switch {
+		case strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc"):
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", strconv.Itoa(int(qrpc.Unauthenticated)))
+			w.Header().Set("Grpc-Message", "Missing or invalid token")
+			w.WriteHeader(http.StatusOK)
+		case strings.HasPrefix(r.URL.Path, "/v1/"):
+			writeError(w, http.StatusUnauthorized, qcommon.ErrorCodeUnauthenticated, "Missing or invalid token")
+		default:
+			http.Error(w, "Missing or invalid token", http.StatusUnauthorized)
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"qbinary"
+	"qclient"
+	"qcommon"
+	"qrpc"
+	"strings"
+	"testing"
+)
+
+func writeTokens(t *testing.T, path, contents string) {
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("writing tokens: %v", err)
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	writeTokens(t, path, "# comment\nsecret alice\n\nother bob\n")
+	tokens, err := loadTokens(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if principal, ok := tokens.principal("secret"); !ok || principal != "alice" {
+		t.Errorf("want alice, got %q", principal)
+	}
+	if _, ok := tokens.principal("nope"); ok {
+		t.Errorf("unexpected principal for unknown token")
+	}
+
+	writeTokens(t, path, "rotated alice\n")
+	if err := tokens.reload(); err != nil {
+		t.Fatalf("unexpected reload error: %v", err)
+	}
+	if _, ok := tokens.principal("secret"); ok {
+		t.Errorf("old token still valid after reload")
+	}
+
+	writeTokens(t, path, "missing-principal\n")
+	if err := tokens.reload(); err == nil {
+		t.Errorf("expected error for malformed token file")
+	}
+	if _, ok := tokens.principal("rotated"); !ok {
+		t.Errorf("tokens lost after failed reload")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	writeTokens(t, path, "secret alice\n")
+	tokens, _ := loadTokens(path)
+
+	var got string
+	handler := authenticate(tokens, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = qcommon.PrincipalFrom(r.Context())
+	}))
+
+	for _, test := range []struct {
+		path	string
+		header	string
+		want	int
+	}{
+		{"/create", "", http.StatusUnauthorized},
+		{"/create", "Bearer wrong", http.StatusUnauthorized},
+		{"/v1/queues", "Basic secret", http.StatusUnauthorized},
+		{"/v1/queues", "Bearer secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("POST", test.path, nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %q: want %d, got %d", test.path, test.header, test.want, w.Code)
+		}
+	}
+	if got != "alice" {
+		t.Errorf("want principal alice, got %q", got)
+	}
+}
+
+func TestGRPCAuthentication(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	writeTokens(t, path, "secret alice\n")
+	tokens, _ := loadTokens(path)
+
+	l := qrpc.NewBufListener()
+	srv := qrpc.NewHTTPServer(service{newRegistry()})
+	srv.Handler = authenticate(tokens, srv.Handler)
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := qrpc.NewClient("bufconn", l.Dial)
+	if _, err := client.CreateQueue(ctx, "authq"); qrpc.CodeOf(err) != qrpc.Unauthenticated {
+		t.Errorf("want Unauthenticated, got %v", err)
+	}
+	qclient.Token = "secret"
+	defer func() { qclient.Token = "" }()
+	client = qclient.NewGRPCTransport("bufconn", l.Dial).(*qrpc.Client)
+	if _, err := client.CreateQueue(ctx, "authq"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBinaryAuthentication(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	srv := qbinary.NewServer(service{newRegistry()})
+	srv.Authenticate = func(token string) (string, bool) {
+		return "alice", token == "secret"
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client, _ := qbinary.Dial("tcp", l.Addr().String())
+	defer client.Close()
+	if _, err := client.CreateQueue(ctx, "authq"); qrpc.CodeOf(err) != qrpc.Unauthenticated {
+		t.Errorf("want Unauthenticated, got %v", err)
+	}
+	if err := client.Authenticate(ctx, "wrong"); qrpc.CodeOf(err) != qrpc.Unauthenticated {
+		t.Errorf("want Unauthenticated, got %v", err)
+	}
+	if err := client.Authenticate(ctx, "secret"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := client.CreateQueue(ctx, "authq"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestClientTokens has two clients with different tokens share a server over
+// each transport, and checks each is seen as its own principal.
+func TestClientTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	writeTokens(t, path, "secret alice\nother bob\n")
+	tokens, _ := loadTokens(path)
+	var principals []string
+	record := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principals = append(principals, qcommon.PrincipalFrom(r.Context()))
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	created := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(qcommon.IdData{Id: "tokensq"})
+	})
+	web := httptest.NewServer(authenticate(tokens, record(created)))
+	defer web.Close()
+
+	l := qrpc.NewBufListener()
+	grpc := qrpc.NewHTTPServer(service{newRegistry()})
+	grpc.Handler = authenticate(tokens, record(grpc.Handler))
+	go grpc.Serve(l)
+	defer grpc.Close()
+
+	bl, _ := net.Listen("tcp", "127.0.0.1:0")
+	binary := qbinary.NewServer(service{newRegistry()})
+	binary.Authenticate = func(token string) (string, bool) {
+		principal, ok := tokens.principal(token)
+		principals = append(principals, principal)
+		return principal, ok
+	}
+	go binary.Serve(bl)
+	defer binary.Close()
+
+	for _, test := range []struct {
+		name	string
+		option	qclient.Option
+	}{
+		{"http", qclient.WithBaseURL(web.URL)},
+		{"grpc", qclient.WithGRPCTransport("bufconn", l.Dial)},
+		{"binary", qclient.WithBinaryTransport("tcp", bl.Addr().String())},
+	} {
+		principals = nil
+		for _, token := range []string{"secret", "other"} {
+			client, err := qclient.New(test.option, qclient.WithToken(token))
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", test.name, err)
+			}
+			if _, err := client.CreateQueue(ctx, "tokensq-" + token); err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+		}
+		if got := strings.Join(principals, " "); got != "alice bob" {
+			t.Errorf("%s: want principals alice bob, got %q", test.name, got)
+		}
+	}
+}
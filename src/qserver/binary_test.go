@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"qbinary"
+	"qrpc"
+	"sync"
+	"testing"
+)
+
+func startBinary(t testing.TB, network string) (*qbinary.Client, func()) {
+	addr := "127.0.0.1:0"
+	if network == "unix" {
+		addr = filepath.Join(t.TempDir(), "qserver.sock")
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := qbinary.NewServer(service{newRegistry()})
+	go srv.Serve(l)
+	client, err := qbinary.Dial(network, l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return client, func() {
+		client.Close()
+		srv.Close()
+	}
+}
+
+func TestBinaryOperations(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		client, stop := startBinary(t, network)
+
+		id, err := client.CreateQueue(ctx, "binq")
+		if err != nil || id != "binq" {
+			t.Errorf("%s: want %q, got %q (%v)", network, "binq", id, err)
+		}
+		if _, err := client.CreateQueue(ctx, "binq"); qrpc.CodeOf(err) != qrpc.AlreadyExists {
+			t.Errorf("%s: want AlreadyExists, got %v", network, err)
+		}
+		object := []byte("binary\x00\xffobject")
+		if err := client.Enqueue(ctx, id, object); err != nil {
+			t.Errorf("%s: unexpected enqueue error: %v", network, err)
+		}
+		if got, err := client.Dequeue(ctx, id); err != nil || !bytes.Equal(got, object) {
+			t.Errorf("%s: want %q, got %q (%v)", network, object, got, err)
+		}
+		if _, err := client.Dequeue(ctx, id); err != qrpc.ErrEmpty {
+			t.Errorf("%s: want ErrEmpty, got %v", network, err)
+		}
+		if err := client.DeleteQueue(ctx, id); err != nil {
+			t.Errorf("%s: unexpected delete error: %v", network, err)
+		}
+		if _, err := client.GetQueue(ctx, string(id)); qrpc.CodeOf(err) != qrpc.NotFound {
+			t.Errorf("%s: want NotFound, got %v", network, err)
+		}
+
+		stop()
+	}
+}
+
+func TestBinaryPipelined(t *testing.T) {
+	client, stop := startBinary(t, "tcp")
+	defer stop()
+
+	id, _ := client.CreateQueue(ctx, "binq")
+	var waitgroup sync.WaitGroup
+	waitgroup.Add(*count)
+	for i := 0; i < *count; i++ {
+		go func(i int) {
+			if err := client.Enqueue(ctx, id, []byte(fmt.Sprintf("%d", i))); err != nil {
+				t.Errorf("unexpected enqueue error: %v", err)
+			}
+			waitgroup.Done()
+		}(i)
+	}
+	waitgroup.Wait()
+
+	seen := map[string]bool{}
+	for i := 0; i < *count; i++ {
+		object, err := client.Dequeue(ctx, id)
+		if err != nil {
+			t.Fatalf("unexpected dequeue error: %v", err)
+		}
+		seen[string(object)] = true
+	}
+	if len(seen) != *count {
+		t.Errorf("want %d distinct objects, got %d", *count, len(seen))
+	}
+}
+
+func BenchmarkBinaryEnqueue(b *testing.B) {
+	client, stop := startBinary(b, "tcp")
+	defer stop()
+
+	id, _ := client.CreateQueue(ctx, "binq")
+	object := []byte("hello queue server")
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			client.Enqueue(ctx, id, object)
+		}
+	})
+}
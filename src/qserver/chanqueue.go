@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// channelQueue is a bounded queue backed by a buffered channel. Enqueues go
+// through the channel concurrently. Peeking takes the head out of the channel
+// into a slot beside it, so dequeues and peeks take turns to keep the slot
+// ahead of the channel. Walking, which a channel can't do, stops everything
+// to drain the channel and refill it in order, so it takes time in proportion
+// to the queue's depth.
+type channelQueue struct {
+	// held for reading by enqueue, and for writing by walk while it drains
+	// the channel
+	fill	sync.RWMutex
+	ch	chan message
+	// messages in the slot and the channel, counted before they are sent
+	len	int64
+	capacity	int64
+
+	// held by dequeue, peek and walk
+	mu	sync.Mutex
+	// the head, if peek took it from the channel
+	head	message
+	hasHead	bool
+}
+
+func newChannelQueue(capacity int) *channelQueue {
+	return &channelQueue{ch: make(chan message, capacity), capacity: int64(capacity)}
+}
+
+func (q *channelQueue) enqueue(m message) error {
+	q.fill.RLock()
+	defer q.fill.RUnlock()
+	for {
+		n := atomic.LoadInt64(&q.len)
+		if n >= q.capacity {
+			return errFull
+		}
+		if atomic.CompareAndSwapInt64(&q.len, n, n + 1) {
+			break
+		}
+	}
+	// there's room: the channel holds no more than the count
+	q.ch <- m
+	return nil
+}
+
+func (q *channelQueue) dequeue() (message, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.hasHead {
+		m := q.head
+		q.head, q.hasHead = message{}, false
+		atomic.AddInt64(&q.len, -1)
+		return m, true, nil
+	}
+	select {
+	case m := <-q.ch:
+		atomic.AddInt64(&q.len, -1)
+		return m, true, nil
+	default:
+		return message{}, false, nil
+	}
+}
+
+func (q *channelQueue) peek() (message, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.hasHead {
+		select {
+		case q.head = <-q.ch:
+			q.hasHead = true
+		default:
+			return message{}, false, nil
+		}
+	}
+	return q.head, true, nil
+}
+
+// messages returns the queue's messages, in order, leaving them queued.
+func (q *channelQueue) messages() []message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.fill.Lock()
+	defer q.fill.Unlock()
+	var messages []message
+	if q.hasHead {
+		messages = append(messages, q.head)
+	}
+	queued := make([]message, len(q.ch))
+	for i := range queued {
+		queued[i] = <-q.ch
+	}
+	// nothing else can send while q is locked, so these can't block
+	for _, m := range queued {
+		q.ch <- m
+	}
+	return append(messages, queued...)
+}
+
+func (q *channelQueue) walk(visit func(message) bool) {
+	for _, m := range q.messages() {
+		if !visit(m) {
+			return
+		}
+	}
+}
+
+func (q *channelQueue) cost(object []byte) int64 {
+	return int64(len(object)) + slotOverhead
+}
+
+func (q *channelQueue) close() error {
+	return nil
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"qcommon"
+	"qraft"
+	"qrpc"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// proxiedHeader marks requests a node forwarded to its leader, so that they
+// aren't forwarded again while leadership changes. Its value is the node's id
+// and, if the cluster has a token, an HMAC keyed by it of the id and the
+// forwardedPrincipalHeader.
+const proxiedHeader = "Qserver-Proxied-By"
+
+// forwardedPrincipalHeader carries, escaped, who the forwarding node
+// authenticated a request as, so that callers identified by a client
+// certificate the leader never sees keep their identity. It is only sent and
+// trusted if the cluster has a token to sign it with.
+const forwardedPrincipalHeader = "Qserver-Forwarded-Principal"
+
+// Raft timing, shortened by tests.
+var (
+	clusterHeartbeat = qraft.DefaultHeartbeatInterval
+	clusterElectionTimeout = qraft.DefaultElectionTimeout
+	clusterKeepApplied = qraft.DefaultKeepApplied
+)
+
+// Cluster commands.
+const (
+	commandCreate = "create"
+	commandConfigure = "configure"
+	commandDelete = "delete"
+	commandEnqueue = "enqueue"
+	commandDequeue = "dequeue"
+	commandPurge = "purge"
+)
+
+// clusterCommand is a queue mutation in the cluster's log. Settings have the
+// leader's defaults applied so that every node creates the same queue.
+type clusterCommand struct {
+	Op	string	`json:"op"`
+	Queue	string	`json:"queue"`
+	Settings	*qcommon.QueueSettings	`json:"settings,omitempty"`
+	Object	[]byte	`json:"object,omitempty"`
+	EnqueuedAt	int64	`json:"enqueued_at,omitempty"`
+}
+
+// commandResult is what applying a command did. ok is whether the queue was
+// created, changed, deleted or dequeued from, or for the other commands
+// whether it existed.
+type commandResult struct {
+	entry	*entry
+	ok	bool
+	object	[]byte
+	id	int64
+	purged	int64
+	// why an enqueue, dequeue or purge failed
+	err	error
+}
+
+// cluster replicates a registry across servers through a Raft log. Every node
+// applies the log to its own registry; only the leader accepts mutations, and
+// the others proxy HTTP API requests to it.
+type cluster struct {
+	id	string
+	addrs	map[string]string
+	node	*qraft.Node
+	// the token nodes send each other, which also signs their forwarded
+	// requests
+	token	string
+	proxies	map[string]http.Handler
+}
+
+// newCluster joins this server, id, to the cluster whose nodes serve their
+// HTTP APIs at addrs, keeping its Raft term and vote in stateFile. Nodes reach
+// each other with client, authenticating with token if set.
+func newCluster(id string, addrs map[string]string, stateFile, scheme, token string, client *http.Client, r *registry) (*cluster, error) {
+	transport := &qraft.HTTPTransport{URLs: map[string]string{}, Token: token, Client: client}
+	for peer, addr := range addrs {
+		transport.URLs[peer] = scheme + "://" + addr + "/v1/cluster/raft"
+	}
+	c, err := joinCluster(id, addrs, stateFile, transport, r)
+	if err != nil {
+		return nil, err
+	}
+	c.token = token
+	for peer, addr := range addrs {
+		c.proxies[peer] = c.newProxy(peer, &url.URL{Scheme: scheme, Host: addr}, client.Transport)
+	}
+	return c, nil
+}
+
+// joinCluster is newCluster over any transport, without proxying.
+func joinCluster(id string, addrs map[string]string, stateFile string, transport qraft.Transport, r *registry) (*cluster, error) {
+	var peers []string
+	for peer := range addrs {
+		if peer != id {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Strings(peers)
+	node, err := qraft.NewNode(qraft.Config{
+		ID:		id,
+		Peers:		peers,
+		Transport:	transport,
+		Apply:		r.apply,
+		HeartbeatInterval:	clusterHeartbeat,
+		ElectionTimeout:	clusterElectionTimeout,
+		StateFile:	stateFile,
+		Snapshot:	r.snapshot,
+		Restore:	r.restore,
+		KeepApplied:	clusterKeepApplied,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := &cluster{id: id, addrs: addrs, node: node, proxies: map[string]http.Handler{}}
+	r.cluster = c
+	c.node.Start()
+	return c, nil
+}
+
+// parseClusterPeers parses "id=host:port,..." into addresses by id.
+func parseClusterPeers(s string) (map[string]string, error) {
+	addrs := map[string]string{}
+	for _, peer := range strings.Split(s, ",") {
+		id, addr, found := strings.Cut(strings.TrimSpace(peer), "=")
+		if !found || id == "" || addr == "" {
+			return nil, fmt.Errorf("cluster peer %q isn't id=host:port", peer)
+		}
+		if _, present := addrs[id]; present {
+			return nil, fmt.Errorf("cluster peer %q listed twice", id)
+		}
+		addrs[id] = addr
+	}
+	return addrs, nil
+}
+
+func (c *cluster) stop() {
+	c.node.Stop()
+}
+
+// propose commits cmd through the log and returns what applying it did on
+// this node.
+func (c *cluster) propose(ctx context.Context, cmd clusterCommand) (commandResult, error) {
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return commandResult{}, err
+	}
+	value, err := c.node.Propose(ctx, b)
+	if err != nil {
+		return commandResult{}, c.unavailable(err)
+	}
+	return value.(commandResult), nil
+}
+
+// unavailable explains why the cluster couldn't commit a command.
+func (c *cluster) unavailable(err error) error {
+	var notLeader *qraft.NotLeaderError
+	switch {
+	case errors.As(err, &notLeader) && notLeader.Leader != "":
+		return qrpc.Errorf(qrpc.Unavailable, "Not the cluster leader; the leader is %s at %s", notLeader.Leader, c.addrs[notLeader.Leader])
+	case errors.As(err, &notLeader):
+		return qrpc.Errorf(qrpc.Unavailable, "No cluster leader is elected")
+	case errors.Is(err, qraft.ErrLeadershipLost):
+		return qrpc.Errorf(qrpc.Unavailable, "Cluster leadership changed before the operation committed; it may or may not have been applied")
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return qrpc.Errorf(qrpc.Unavailable, "Gave up waiting for the cluster to commit the operation; it may or may not have been applied")
+	}
+	return qrpc.Errorf(qrpc.Unavailable, "Cluster unavailable: %v", err)
+}
+
+// apply carries out a committed command. Every node applies the same commands
+// in the same order, so it must depend only on the command and the registry.
+func (r *registry) apply(command []byte) interface{} {
+	var cmd clusterCommand
+	if err := json.Unmarshal(command, &cmd); err != nil {
+		logger.Warn("ignoring malformed cluster command", "error", err)
+		return commandResult{}
+	}
+	return r.applyCommand(cmd)
+}
+
+func (r *registry) applyCommand(cmd clusterCommand) commandResult {
+	var settings qcommon.QueueSettings
+	if cmd.Settings != nil {
+		settings = *cmd.Settings
+	}
+	switch cmd.Op {
+	case commandCreate:
+		e, created := r.insert(cmd.Queue, settings)
+		return commandResult{entry: e, ok: created}
+	case commandConfigure:
+		return commandResult{ok: r.set(cmd.Queue, settings)}
+	case commandDelete:
+		return commandResult{ok: r.remove(cmd.Queue)}
+	}
+
+	e, present := r.get(cmd.Queue)
+	if !present {
+		return commandResult{}
+	}
+	switch cmd.Op {
+	case commandEnqueue:
+		// the leader checked the memory budget before proposing, but a
+		// bounded queue may fill up meanwhile
+		id, err := e.add(cmd.Object, cmd.EnqueuedAt, false)
+		return commandResult{entry: e, ok: true, id: id, err: err}
+	case commandDequeue:
+		// every node removes the message, even one that can't read it
+		object, id, valid, err := e.consumeMessage()
+		return commandResult{entry: e, ok: valid && err == nil, object: object, id: id, err: err}
+	case commandPurge:
+		purged, err := e.consumeAll()
+		return commandResult{entry: e, ok: true, purged: purged, err: err}
+	}
+	logger.Warn("ignoring unknown cluster command", "op", cmd.Op)
+	return commandResult{}
+}
+
+// snapshot returns the registry as the commands that would rebuild it, for
+// nodes too far behind to catch up from the log. Nothing else changes the
+// registry while the log isn't being applied.
+func (r *registry) snapshot() []byte {
+	r.RLock()
+	defer r.RUnlock()
+	var cmds []clusterCommand
+	for name, e := range r.queues {
+		settings := e.settings()
+		cmds = append(cmds, clusterCommand{Op: commandCreate, Queue: name, Settings: &settings})
+		e.queue.walk(func(m message) bool {
+			cmds = append(cmds, clusterCommand{Op: commandEnqueue, Queue: name, Object: m.object, EnqueuedAt: m.enqueuedAt})
+			return true
+		})
+	}
+	b, err := json.Marshal(cmds)
+	if err != nil {
+		logger.Error("marshaling cluster snapshot failed", "error", err)
+	}
+	return b
+}
+
+// restore replaces the registry's queues with those of a snapshot.
+func (r *registry) restore(snapshot []byte) {
+	var cmds []clusterCommand
+	if err := json.Unmarshal(snapshot, &cmds); err != nil {
+		logger.Error("ignoring malformed cluster snapshot", "error", err)
+		return
+	}
+	for _, name := range r.names() {
+		r.remove(name)
+	}
+	for _, cmd := range cmds {
+		if result := r.applyCommand(cmd); result.err != nil {
+			logger.Warn("restoring cluster snapshot", "queue", cmd.Queue, "error", result.err)
+		}
+	}
+	logger.Info("restored cluster snapshot", "queues", len(r.names()))
+}
+
+// The API handlers change queues with the commit methods, which apply the
+// change directly or, when the server is clustered, commit it through the
+// cluster's log first. Only clustered servers return errors other than
+// invalid settings and the errors of add from them. Those that enqueue or dequeue add the message
+// to the request's log line.
+
+// commitCreate is create. Returns false if the name is already taken.
+func (r *registry) commitCreate(ctx context.Context, name string, settings qcommon.QueueSettings) (*entry, bool, error) {
+	if err := checkSettings(withDefaultSettings(settings)); err != nil {
+		return nil, false, qrpc.Errorf(qrpc.InvalidArgument, "Invalid settings: %v", err)
+	}
+	if r.cluster == nil {
+		e, created := r.create(name, settings)
+		return e, created, nil
+	}
+	settings = withDefaultSettings(settings)
+	result, err := r.cluster.propose(ctx, clusterCommand{Op: commandCreate, Queue: name, Settings: &settings})
+	return result.entry, result.ok, err
+}
+
+// commitConfigure is configure. Returns whether anything changed.
+func (r *registry) commitConfigure(ctx context.Context, name string, settings qcommon.QueueSettings) (bool, error) {
+	if err := checkSettings(withDefaultSettings(settings)); err != nil {
+		return false, qrpc.Errorf(qrpc.InvalidArgument, "Invalid settings: %v", err)
+	}
+	if e, present := r.get(name); present {
+		have, want := e.settings(), withDefaultSettings(settings)
+		if have.Kind != want.Kind || have.Capacity != want.Capacity {
+			return false, qrpc.Errorf(qrpc.InvalidArgument, "Queue %q is a %s queue of capacity %d; kind and capacity can't be changed once created", name, have.Kind, have.Capacity)
+		}
+	}
+	if r.cluster == nil {
+		return r.configure(name, settings), nil
+	}
+	settings = withDefaultSettings(settings)
+	result, err := r.cluster.propose(ctx, clusterCommand{Op: commandConfigure, Queue: name, Settings: &settings})
+	return result.ok, err
+}
+
+// commitRemove is remove. Returns false if the queue doesn't exist.
+func (r *registry) commitRemove(ctx context.Context, name string) (bool, error) {
+	if r.cluster == nil {
+		return r.remove(name), nil
+	}
+	result, err := r.cluster.propose(ctx, clusterCommand{Op: commandDelete, Queue: name})
+	return result.ok, err
+}
+
+// commitEnqueue is enqueue.
+func (e *entry) commitEnqueue(ctx context.Context, object []byte) error {
+	return e.commitAdd(ctx, object, time.Now().UnixNano())
+}
+
+// commitAdd is add, checking the budget.
+func (e *entry) commitAdd(ctx context.Context, object []byte, enqueuedAt int64) error {
+	c := e.registry.cluster
+	if c == nil {
+		id, err := e.add(object, enqueuedAt, true)
+		if err == nil {
+			annotateMessage(ctx, id, object)
+		}
+		return err
+	}
+	if max := e.registry.maxBytes; max > 0 && atomic.LoadInt64(&e.registry.bytes) + e.queue.cost(object) > max {
+		return errMemoryExhausted(max)
+	}
+	result, err := c.propose(ctx, clusterCommand{Op: commandEnqueue, Queue: e.name, Object: object, EnqueuedAt: enqueuedAt})
+	if err == nil && !result.ok {
+		err = errQueueRemoved(e.name)
+	}
+	if err == nil {
+		err = result.err
+	}
+	if err == nil {
+		annotateMessage(ctx, result.id, object)
+	}
+	return err
+}
+
+// commitDequeue is dequeue.
+func (e *entry) commitDequeue(ctx context.Context) ([]byte, bool, error) {
+	c := e.registry.cluster
+	if c == nil {
+		object, id, valid, err := e.dequeueMessage()
+		if valid {
+			annotateMessage(ctx, id, object)
+		}
+		return object, valid, err
+	}
+	result, err := c.propose(ctx, clusterCommand{Op: commandDequeue, Queue: e.name})
+	if err == nil && result.entry == nil {
+		err = errQueueRemoved(e.name)
+	}
+	if err == nil {
+		err = result.err
+	}
+	if result.ok {
+		annotateMessage(ctx, result.id, result.object)
+	}
+	return result.object, result.ok, err
+}
+
+// commitPurge is purge.
+func (e *entry) commitPurge(ctx context.Context) (int64, error) {
+	c := e.registry.cluster
+	if c == nil {
+		return e.purge()
+	}
+	result, err := c.propose(ctx, clusterCommand{Op: commandPurge, Queue: e.name})
+	if err == nil && !result.ok {
+		err = errQueueRemoved(e.name)
+	}
+	if err == nil {
+		err = result.err
+	}
+	return result.purged, err
+}
+
+func errQueueRemoved(name string) error {
+	return qrpc.Errorf(qrpc.NotFound, "Queue %q doesn't exist", name)
+}
+
+// writeCommitError reports a failed commit method in the style of the API
+// being called.
+func writeCommitError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := http.StatusInternalServerError, qcommon.ErrorCodeInternal
+	switch qrpc.CodeOf(err) {
+	case qrpc.ResourceExhausted:
+		writeEnqueueError(w, r, err)
+		return
+	case qrpc.InvalidArgument:
+		status, code = http.StatusBadRequest, qcommon.ErrorCodeInvalidArgument
+	case qrpc.Unavailable:
+		status, code = http.StatusServiceUnavailable, qcommon.ErrorCodeNoLeader
+	case qrpc.NotFound:
+		status, code = http.StatusNotFound, qcommon.ErrorCodeQueueNotFound
+	}
+	msg := err.Error()
+	if s, ok := err.(*qrpc.Status); ok {
+		msg = s.Message
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		writeError(w, status, code, "%s", msg)
+	} else {
+		http.Error(w, msg, status)
+	}
+}
+
+// newProxy forwards requests to the node id at target.
+func (c *cluster) newProxy(id string, target *url.URL, transport http.RoundTripper) http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			principal := ""
+			if c.token != "" {
+				principal = url.QueryEscape(qcommon.PrincipalFrom(pr.In.Context()))
+			}
+			pr.Out.Header.Del(forwardedPrincipalHeader)
+			if principal != "" {
+				pr.Out.Header.Set(forwardedPrincipalHeader, principal)
+			}
+			pr.Out.Header.Set(proxiedHeader, hopMark(c.id, principal, c.token))
+		},
+		Transport:	transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			writeCommitError(w, r, qrpc.Errorf(qrpc.Unavailable, "Forwarding to cluster leader %s: %v", id, err))
+		},
+	}
+}
+
+// hopMark is the proxiedHeader value of requests forwarded by node id with
+// principal as their forwardedPrincipalHeader.
+func hopMark(id, principal, token string) string {
+	if token == "" {
+		return id
+	}
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(id + "\n" + principal))
+	return id + " " + hex.EncodeToString(mac.Sum(nil))
+}
+
+// forwarded reports whether another node of c forwarded r. Without a
+// cluster token any client may claim to be a node, as it may send Raft
+// RPCs.
+func (c *cluster) forwarded(r *http.Request) bool {
+	mark := r.Header.Get(proxiedHeader)
+	id, _, _ := strings.Cut(mark, " ")
+	if _, member := c.addrs[id]; !member || id == c.id {
+		return false
+	}
+	return hmac.Equal([]byte(mark), []byte(hopMark(id, r.Header.Get(forwardedPrincipalHeader), c.token)))
+}
+
+// forwardedPrincipal returns who the node that forwarded r authenticated it
+// as, if c has a token to prove that node's claim.
+func (c *cluster) forwardedPrincipal(r *http.Request) (string, bool) {
+	if c == nil || c.token == "" || r.Header.Get(forwardedPrincipalHeader) == "" || !c.forwarded(r) {
+		return "", false
+	}
+	principal, err := url.QueryUnescape(r.Header.Get(forwardedPrincipalHeader))
+	return principal, err == nil
+}
+
+// clusterProxy forwards API requests to the leader when this node isn't it,
+// so that clients may use any node. The leader takes forwarded requests to
+// come from whoever this node authenticated them as, or without a cluster
+// token authenticates them again from their own headers.
+func clusterProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := queues.cluster
+		if c != nil && !c.forwarded(r) {
+			// a client's claim to be a node
+			r.Header.Del(proxiedHeader)
+			r.Header.Del(forwardedPrincipalHeader)
+		}
+		// the log level is each node's own
+		if c == nil || strings.HasPrefix(r.URL.Path, "/v1/cluster") || strings.HasPrefix(r.URL.Path, "/v1/log/") || r.Header.Get(proxiedHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch leader := c.node.Leader(); {
+		case leader == c.id:
+			next.ServeHTTP(w, r)
+		case leader == "":
+			writeCommitError(w, r, qrpc.Errorf(qrpc.Unavailable, "No cluster leader is elected"))
+		default:
+			if _, bearer := bearerToken(r); c.token == "" && !bearer && qcommon.PrincipalFrom(r.Context()) != "" {
+				// the leader can't tell who the client certificate named
+				writeCommitError(w, r, qrpc.Errorf(qrpc.Unavailable, "Requests authenticated by client certificate can only be forwarded to the cluster leader %s with --cluster_token; send them to it directly", leader))
+				return
+			}
+			annotate(r.Context(), "forwarded_to", leader)
+			c.proxies[leader].ServeHTTP(w, r)
+		}
+	})
+}
+
+// clustered returns the server's cluster, or writes an error if it has none.
+func clustered(w http.ResponseWriter, r *http.Request) (*cluster, bool) {
+	if !permitted(w, r, "*", permAdmin) {
+		return nil, false
+	}
+	c := queues.cluster
+	if c == nil {
+		writeError(w, http.StatusNotFound, qcommon.ErrorCodeClusterDisabled, "Server isn't clustered")
+	}
+	return c, c != nil
+}
+
+func clusterStatusHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := clustered(w, r)
+	if !ok {
+		return
+	}
+	raft := c.node.Status()
+	status := qcommon.ClusterStatus{
+		ID:		raft.ID,
+		State:		raft.State,
+		Term:		raft.Term,
+		Leader:		raft.Leader,
+		Nodes:		[]qcommon.ClusterNode{},
+		LastIndex:	raft.LastIndex,
+		CommitIndex:	raft.CommitIndex,
+		LastApplied:	raft.LastApplied,
+	}
+	for id, addr := range c.addrs {
+		status.Nodes = append(status.Nodes, qcommon.ClusterNode{ID: id, Addr: addr})
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool { return status.Nodes[i].ID < status.Nodes[j].ID })
+	writeJSON(w, http.StatusOK, status)
+}
+
+// clusterRaftHandler receives Raft RPCs from the other nodes.
+func clusterRaftHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := clustered(w, r)
+	if !ok {
+		return
+	}
+	qraft.Handler(c.node).ServeHTTP(w, r)
+}
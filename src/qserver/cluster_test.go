@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"qcommon"
+	"qraft"
+	"qrpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startCluster joins registries into a cluster on a memory network, with
+// node i applying to registries[i].
+func startCluster(t *testing.T, registries ...*registry) (*qraft.MemoryNetwork, []*cluster) {
+	clusterHeartbeat, clusterElectionTimeout = 5 * time.Millisecond, 50 * time.Millisecond
+	t.Cleanup(func() {
+		clusterHeartbeat, clusterElectionTimeout = qraft.DefaultHeartbeatInterval, qraft.DefaultElectionTimeout
+	})
+	network := qraft.NewMemoryNetwork()
+	addrs := map[string]string{}
+	for i := range registries {
+		addrs[fmt.Sprintf("n%d", i)] = fmt.Sprintf("host%d:4242", i)
+	}
+	var clusters []*cluster
+	for i, r := range registries {
+		c, err := joinCluster(fmt.Sprintf("n%d", i), addrs, "", network.Transport(fmt.Sprintf("n%d", i)), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		network.Register(c.node)
+		clusters = append(clusters, c)
+	}
+	t.Cleanup(func() {
+		for _, c := range clusters {
+			c.stop()
+		}
+	})
+	return network, clusters
+}
+
+// clusterLeader waits for one of clusters to lead the others.
+func clusterLeader(t *testing.T, clusters ...*cluster) *cluster {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leader := clusters[0].node.Leader()
+		agreed := leader != ""
+		for _, c := range clusters {
+			agreed = agreed && c.node.Leader() == leader
+		}
+		if agreed {
+			for _, c := range clusters {
+				if c.id == leader && c.node.Status().State == qraft.Leader {
+					return c
+				}
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no cluster leader elected")
+	return nil
+}
+
+// registryOf returns the registry c applies to.
+func registryOf(c *cluster, registries []*registry) *registry {
+	for _, r := range registries {
+		if r.cluster == c {
+			return r
+		}
+	}
+	return nil
+}
+
+// waitForApplied waits for clusters to apply everything leader committed.
+// The queues they apply to may then be read safely.
+func waitForApplied(t *testing.T, leader *cluster, clusters ...*cluster) {
+	t.Helper()
+	committed := leader.node.Status().CommitIndex
+	deadline := time.Now().Add(5 * time.Second)
+	for _, c := range clusters {
+		for c.node.Status().LastApplied < committed {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s didn't apply up to %d: %+v", c.id, committed, c.node.Status())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func checkContents(t *testing.T, r *registry, name string, want ...string) {
+	t.Helper()
+	got := contents(r, name)
+	if fmt.Sprintf("%s", got) != fmt.Sprintf("%s", want) {
+		t.Errorf("%s: queue %q holds %q, want %q", r.cluster.id, name, got, want)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	registries := []*registry{newRegistry(), newRegistry(), newRegistry()}
+	network, clusters := startCluster(t, registries...)
+	leader := clusterLeader(t, clusters...)
+	leaderRegistry := registryOf(leader, registries)
+	ctx := context.Background()
+
+	if _, created, err := leaderRegistry.commitCreate(ctx, "jobs", qcommon.QueueSettings{EnqueueRate: 5}); err != nil || !created {
+		t.Fatalf("creating: %v, %v", created, err)
+	}
+	if _, created, err := leaderRegistry.commitCreate(ctx, "jobs", qcommon.QueueSettings{}); err != nil || created {
+		t.Errorf("creating twice: %v, %v", created, err)
+	}
+	e, _ := leaderRegistry.get("jobs")
+	for _, object := range []string{"a", "b", "c"} {
+		if err := e.commitEnqueue(ctx, []byte(object)); err != nil {
+			t.Fatalf("enqueueing: %v", err)
+		}
+	}
+	if object, valid, err := e.commitDequeue(ctx); err != nil || !valid || string(object) != "a" {
+		t.Errorf("dequeued %q, %v, %v", object, valid, err)
+	}
+	waitForApplied(t, leader, clusters...)
+	for _, r := range registries {
+		checkContents(t, r, "jobs", "b", "c")
+		if e, present := r.get("jobs"); !present || e.settings().EnqueueRate != 5 {
+			t.Errorf("queue settings weren't replicated: %+v", e)
+		}
+	}
+
+	for _, r := range registries {
+		if r == leaderRegistry {
+			continue
+		}
+		_, _, err := r.commitCreate(ctx, "other", qcommon.QueueSettings{})
+		if qrpc.CodeOf(err) != qrpc.Unavailable || !strings.Contains(err.Error(), leader.id) {
+			t.Errorf("creating on a follower: %v, want Unavailable naming %s", err, leader.id)
+		}
+	}
+
+	// the others elect a new leader when the old one is cut off, and it
+	// catches up when the partition heals
+	var others []*cluster
+	var ids []string
+	for _, c := range clusters {
+		if c != leader {
+			others = append(others, c)
+			ids = append(ids, c.id)
+		}
+	}
+	network.Partition([]string{leader.id}, ids)
+	next := clusterLeader(t, others...)
+	e, _ = registryOf(next, registries).get("jobs")
+	if err := e.commitEnqueue(ctx, []byte("d")); err != nil {
+		t.Fatalf("enqueueing on new leader: %v", err)
+	}
+	network.Heal()
+	waitForApplied(t, next, clusters...)
+	for _, r := range registries {
+		checkContents(t, r, "jobs", "b", "c", "d")
+	}
+}
+
+func TestClusterSnapshot(t *testing.T) {
+	clusterKeepApplied = 2
+	defer func() { clusterKeepApplied = qraft.DefaultKeepApplied }()
+	registries := []*registry{newRegistry(), newRegistry(), newRegistry()}
+	network, clusters := startCluster(t, registries...)
+	leader := clusterLeader(t, clusters...)
+	leaderRegistry := registryOf(leader, registries)
+	ctx := context.Background()
+
+	var follower int
+	for i, c := range clusters {
+		if c != leader {
+			follower = i
+		}
+	}
+	clusters[follower].stop()
+	e, _, _ := leaderRegistry.commitCreate(ctx, "snapshotted", qcommon.QueueSettings{DequeueRate: 4})
+	for _, object := range []string{"a", "b", "c", "d", "e"} {
+		if err := e.commitEnqueue(ctx, []byte(object)); err != nil {
+			t.Fatalf("enqueueing: %v", err)
+		}
+	}
+	e.commitDequeue(ctx)
+	if status := leader.node.Status(); status.FirstIndex <= 1 {
+		t.Fatalf("leader's log wasn't compacted: %+v", status)
+	}
+
+	// restarted empty, the follower catches up from a snapshot
+	restarted := newRegistry()
+	c, err := joinCluster(clusters[follower].id, clusters[follower].addrs, "", network.Transport(clusters[follower].id), restarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.stop()
+	network.Register(c.node)
+	waitForApplied(t, leader, c)
+	checkContents(t, restarted, "snapshotted", "b", "c", "d", "e")
+	if e, present := restarted.get("snapshotted"); !present || e.settings().DequeueRate != 4 {
+		t.Errorf("queue settings weren't restored: %+v", e)
+	}
+}
+
+func TestClusterNoLeader(t *testing.T) {
+	_, clusters := startCluster(t, queues, newRegistry(), newRegistry())
+	defer func() { queues.cluster = nil }()
+	clusters[0].node.Stop()
+	clusters[1].node.Stop()
+
+	mux := http.NewServeMux()
+	registerRESTHandlers(mux)
+	srv := httptest.NewServer(clusterProxy(mux))
+	defer srv.Close()
+	resp, b := doRequest(t, "PUT", srv.URL + "/v1/queues/cluster-no-leader", "", "")
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCode(b) != qcommon.ErrorCodeNoLeader {
+		t.Errorf("creating without a leader: %s %s", resp.Status, b)
+	}
+	if _, present := queues.get("cluster-no-leader"); present {
+		t.Errorf("queue created without a leader")
+	}
+	resp, b = doRequest(t, "GET", srv.URL + "/v1/cluster", "", "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), `"addr":"host2:4242"`) {
+		t.Errorf("cluster status: %s %s", resp.Status, b)
+	}
+}
+
+func TestClusterProxiedHeader(t *testing.T) {
+	_, clusters := startCluster(t, queues, newRegistry(), newRegistry())
+	defer func() { queues.cluster = nil }()
+	clusters[0].token = "secret"
+	clusters[1].node.Stop()
+	clusters[2].node.Stop()
+
+	mux := http.NewServeMux()
+	registerRESTHandlers(mux)
+	srv := httptest.NewServer(clusterProxy(mux))
+	defer srv.Close()
+	for _, test := range []struct {
+		mark	string
+		status	int
+	}{
+		// a client's claim to have been forwarded is ignored
+		{"n1", http.StatusServiceUnavailable},
+		{hopMark("n1", "", "guess"), http.StatusServiceUnavailable},
+		{hopMark("n0", "", "secret"), http.StatusServiceUnavailable},
+		// a node's is served here rather than forwarded again
+		{hopMark("n1", "", "secret"), http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL + "/v1/queues/cluster-proxied", nil)
+		req.Header.Set(proxiedHeader, test.mark)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %q: got %s, want %d", proxiedHeader, test.mark, resp.Status, test.status)
+		}
+	}
+}
+
+func TestClusterForwardedPrincipal(t *testing.T) {
+	addrs := map[string]string{"n0": "host0:4242", "n1": "host1:4242"}
+	defer func() { queues.cluster = nil }()
+	queues.cluster = &cluster{id: "n0", addrs: addrs, token: "secret"}
+	path := filepath.Join(t.TempDir(), "tokens")
+	writeTokens(t, path, "s3cret alice\n")
+	tokens, _ := loadTokens(path)
+	var got string
+	leader := httptest.NewServer(authenticate(tokens, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = qcommon.PrincipalFrom(r.Context())
+	})))
+	defer leader.Close()
+	target, _ := url.Parse(leader.URL)
+
+	// a client certificate the leader never sees still names the caller
+	follower := &cluster{id: "n1", addrs: addrs, token: "secret"}
+	r := httptest.NewRequest("GET", "/v1/queues", nil)
+	r = r.WithContext(qcommon.WithPrincipal(r.Context(), "carol smith"))
+	w := httptest.NewRecorder()
+	follower.newProxy("n0", target, http.DefaultTransport).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || got != "carol smith" {
+		t.Errorf("forwarded: got %d as %q, want carol smith", w.Code, got)
+	}
+
+	// a client can't claim a principal itself
+	req, _ := http.NewRequest("GET", leader.URL + "/v1/queues", nil)
+	req.Header.Set(forwardedPrincipalHeader, "carol")
+	req.Header.Set(proxiedHeader, hopMark("n1", "carol", "guess"))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("forged principal: got %v, %v", resp, err)
+	}
+}
+
+func TestClusterCertificateWithoutToken(t *testing.T) {
+	_, clusters := startCluster(t, newRegistry(), newRegistry())
+	defer func() { queues.cluster = nil }()
+	leader := clusterLeader(t, clusters...)
+	for _, c := range clusters {
+		if c != leader {
+			queues.cluster = c
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(qcommon.WithPrincipal(r.Context(), "carol"))
+		clusterProxy(http.NotFoundHandler()).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	resp, b := doRequest(t, "GET", srv.URL + "/v1/queues", "", "")
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(b), "--cluster_token") {
+		t.Errorf("got %d %s", resp.StatusCode, b)
+	}
+}
+
+func TestParseClusterPeers(t *testing.T) {
+	addrs, err := parseClusterPeers("a=h1:1, b=h2:2")
+	if err != nil || len(addrs) != 2 || addrs["a"] != "h1:1" || addrs["b"] != "h2:2" {
+		t.Errorf("got %v, %v", addrs, err)
+	}
+	for _, bad := range []string{"", "a", "a=", "=h:1", "a=h:1,a=h:2"} {
+		if _, err := parseClusterPeers(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
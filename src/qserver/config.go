@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"qcommon"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A config file is a JSON object whose keys are qserver's flag names, plus
+// "queues", a list of qcommon.QueueData to create at startup:
+//
+//	{
+//		"port": 4242,
+//		"binary_socket": "/run/qserver.sock",
+//		"max_memory": 1073741824,
+//		"verbose": true,
+//		"queues": [
+//			{"name": "jobs", "settings": {"enqueue_rate": 100}}
+//		]
+//	}
+//
+// Flags given on the command line take precedence over the file. On SIGHUP
+// the file is read again and queues are created or reconfigured; changes to
+// other keys take effect on restart. A clustered server has no leader at
+// startup, so its queues are only applied by sending SIGHUP to the leader.
+type config struct {
+	path	string
+	flags	map[string]string
+	queues	[]qcommon.QueueData
+}
+
+// loadConfig reads and validates the config file at path.
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	c := &config{path: path, flags: map[string]string{}}
+	for key, value := range raw {
+		if key == "queues" {
+			if c.queues, err = parseQueues(value); err != nil {
+				return nil, fmt.Errorf("%s: queues: %v", path, err)
+			}
+			continue
+		}
+		if key == "config" || flag.Lookup(key) == nil {
+			return nil, fmt.Errorf("%s: unknown key %q", path, key)
+		}
+		// flags parse strings, so unquote strings and pass anything else as is
+		var s string
+		if json.Unmarshal(value, &s) != nil {
+			s = string(value)
+		}
+		if err := validateFlag(key, s); err != nil {
+			return nil, fmt.Errorf("%s: invalid value %q for %s: %v", path, s, key, err)
+		}
+		c.flags[key] = s
+	}
+	return c, nil
+}
+
+func parseQueues(b json.RawMessage) ([]qcommon.QueueData, error) {
+	var queues []qcommon.QueueData
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&queues); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for i, q := range queues {
+		if q.Name == "" {
+			return nil, fmt.Errorf("queue %d has no name", i)
+		}
+		if seen[q.Name] {
+			return nil, fmt.Errorf("queue %q listed twice", q.Name)
+		}
+		seen[q.Name] = true
+		if s := q.Settings; s != nil && (s.EnqueueRate < 0 || s.EnqueueBurst < 0 || s.DequeueRate < 0 || s.DequeueBurst < 0) {
+			return nil, fmt.Errorf("queue %q has negative settings", q.Name)
+		}
+		if s := q.Settings; s != nil {
+			if err := checkKind(*s); err != nil {
+				return nil, fmt.Errorf("queue %q: %v", q.Name, err)
+			}
+		}
+	}
+	return queues, nil
+}
+
+// validateFlag checks that value parses as the named flag by setting it on a
+// fresh value of the flag's type.
+func validateFlag(name, value string) error {
+	v := reflect.New(reflect.TypeOf(flag.Lookup(name).Value).Elem()).Interface().(flag.Value)
+	return v.Set(value)
+}
+
+// applyFlags sets flags from the config that weren't given on the command line.
+func (c *config) applyFlags() error {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range c.flags {
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %v", c.path, name, err)
+		}
+	}
+	return nil
+}
+
+// applyQueues creates or reconfigures the config's queues in r. In a
+// cluster, only the leader can.
+func (c *config) applyQueues(r *registry) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	for _, q := range c.queues {
+		var settings qcommon.QueueSettings
+		if q.Settings != nil {
+			settings = *q.Settings
+		}
+		changed, err := r.commitConfigure(ctx, q.Name, settings)
+		if err != nil {
+			logger.Error("configuring queue failed", "queue", q.Name, "error", err)
+		} else if changed {
+			logger.Info("configured queue", "queue", q.Name)
+			audits.record(ctx, qcommon.AuditConfigureQueue, q.Name, settings)
+		}
+	}
+}
+
+// reload reads the config file again and applies its queues, returning the
+// new config. Flag changes are only reported since they need a restart.
+func (c *config) reload(r *registry) (*config, error) {
+	next, err := loadConfig(c.path)
+	if err != nil {
+		return c, err
+	}
+	var changed []string
+	for name := range union(c.flags, next.flags) {
+		if c.flags[name] != next.flags[name] {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		logger.Warn("config changes take effect on restart", "flags", strings.Join(changed, ","))
+	}
+	if err := readOnly(); err != nil {
+		logger.Warn("not configuring queues", "error", err)
+	} else {
+		next.applyQueues(r)
+	}
+	return next, nil
+}
+
+func union(a, b map[string]string) map[string]bool {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
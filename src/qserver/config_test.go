@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"qcommon"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, path, contents string) {
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qserver.json")
+	for _, test := range []struct {
+		contents	string
+		want	string
+	}{
+		{`{"port": 80, "verbose": true, "shutdown_timeout": "5s", "queues": [{"name": "a"}]}`, ""},
+		{`{"port": "eighty"}`, "invalid value \"eighty\" for port"},
+		{`{"shutdown_timeout": 5}`, "shutdown_timeout"},
+		{`{"no_such_flag": 1}`, "unknown key \"no_such_flag\""},
+		{`{"config": "other.json"}`, "unknown key \"config\""},
+		{`{"queues": [{"name": "a"}, {"name": "a"}]}`, "listed twice"},
+		{`{"queues": [{"settings": {}}]}`, "no name"},
+		{`{"queues": [{"name": "a", "settings": {"enqueue_rate": -1}}]}`, "negative"},
+		{`{"queues": [{"name": "a", "setings": {}}]}`, "unknown field"},
+		{`{"port": 80,}`, "invalid character"},
+	} {
+		writeTestConfig(t, path, test.contents)
+		_, err := loadConfig(path)
+		if test.want == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.contents, err)
+		}
+		if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%s: want error containing %q, got %v", test.contents, test.want, err)
+		}
+	}
+}
+
+func TestConfigReloadQueues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qserver.json")
+	writeTestConfig(t, path, `{"queues": [{"name": "a"}, {"name": "b", "settings": {"enqueue_rate": 5}}]}`)
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	registry := newRegistry()
+	c.applyQueues(registry)
+	b, _ := registry.get("b")
+	b.enqueue([]byte("kept"))
+
+	writeTestConfig(t, path, `{"queues": [{"name": "b", "settings": {"enqueue_rate": 10}}, {"name": "c"}]}`)
+	if c, err = c.reload(registry); err != nil {
+		t.Fatalf("unexpected reload error: %v", err)
+	}
+	if got := registry.names(); strings.Join(got, ",") != "a,b,c" {
+		t.Errorf("want queues a,b,c, got %v", got)
+	}
+	if settings := b.settings(); settings.EnqueueRate != 10 || b.enqueueLimit().rate != 10 {
+		t.Errorf("want enqueue rate 10, got %+v", settings)
+	}
+	if object, _, _ := b.dequeue(); string(object) != "kept" {
+		t.Errorf("reconfiguring lost queued objects, got %q", object)
+	}
+
+	writeTestConfig(t, path, `{"queues": [{"name": ""}]}`)
+	if _, err := c.reload(registry); err == nil {
+		t.Errorf("want error reloading invalid config")
+	}
+	if settings := b.settings(); settings != (qcommon.QueueSettings{EnqueueRate: 10, Kind: kindList}) {
+		t.Errorf("invalid reload changed settings to %+v", settings)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"qcommon"
+)
+
+// dashboardHTML polls /v1/stats from the browser and uses the versioned API
+// for its peek, purge and delete actions.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// dashboardHandler serves the dashboard page. The page holds no queue data so
+// it is served without authentication; its API requests carry the token
+// entered on it.
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, http.StatusMethodNotAllowed, qcommon.ErrorCodeMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(dashboardHTML)
+}
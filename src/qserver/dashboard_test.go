@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"qcommon"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	w := httptest.NewRecorder()
+	dashboardHandler(w, httptest.NewRequest("GET", "/dashboard", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("want html, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "/v1/stats") {
+		t.Errorf("dashboard doesn't poll /v1/stats")
+	}
+
+	w = httptest.NewRecorder()
+	dashboardHandler(w, httptest.NewRequest("POST", "/dashboard", nil))
+	if w.Code != http.StatusMethodNotAllowed || errorCode(w.Body.Bytes()) != qcommon.ErrorCodeMethodNotAllowed {
+		t.Errorf("POST: want %d %s, got %d %s", http.StatusMethodNotAllowed, qcommon.ErrorCodeMethodNotAllowed, w.Code, w.Body)
+	}
+}
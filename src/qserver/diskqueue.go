@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+)
+
+// diskQueue keeps its objects in a file under --queue_dir, holding only their
+// positions in memory, for queues whose backlog would not fit. The file is
+// appended to, truncated whenever the queue empties and compacted, by copying
+// what is still queued to a new file, once more than half of it is dequeued
+// objects. It doesn't outlive the server: queues, and so their files, are
+// recreated empty on restart.
+type diskQueue struct {
+	mu	sync.Mutex
+	path	string
+	// nil until the first enqueue
+	f	*os.File
+	records	[]diskRecord
+	head	int
+	// offsets count every byte ever enqueued, so that they stay the same
+	// when the file is truncated or compacted; base is the offset of the
+	// file's first byte and end the offset after its last
+	base	int64
+	end	int64
+	closed	bool
+}
+
+// diskRecord is where a message's object is in a diskQueue's file.
+type diskRecord struct {
+	offset	int64
+	size	int
+	enqueuedAt	int64
+	id	int64
+}
+
+// recordOverhead is charged per object in place of its length, which is on
+// disk, for the record of where it is.
+const recordOverhead = int64(unsafe.Sizeof(diskRecord{}))
+
+// diskCompactBytes is how many bytes of dequeued objects a disk queue's file
+// may start with before it is compacted. Shortened by tests.
+var diskCompactBytes int64 = 64 << 20
+
+var errClosed = errors.New("queue was deleted")
+
+// diskQueuePath is the file the disk queue named name keeps its objects in.
+func diskQueuePath(name string) string {
+	return filepath.Join(*queueDir, url.PathEscape(name) + ".queue")
+}
+
+func newDiskQueue(path string) *diskQueue {
+	return &diskQueue{path: path}
+}
+
+func (q *diskQueue) enqueue(m message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errClosed
+	}
+	if q.f == nil {
+		f, err := os.OpenFile(q.path, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		q.f = f
+	}
+	if _, err := q.f.WriteAt(m.object, q.end - q.base); err != nil {
+		return err
+	}
+	q.records = append(q.records, diskRecord{offset: q.end, size: len(m.object), enqueuedAt: m.enqueuedAt, id: m.id})
+	q.end += int64(len(m.object))
+	return nil
+}
+
+// read returns the message r records. Called with q locked.
+func (q *diskQueue) read(r diskRecord) (message, error) {
+	object := make([]byte, r.size)
+	if _, err := q.f.ReadAt(object, r.offset - q.base); err != nil {
+		return message{}, err
+	}
+	return message{object: object, enqueuedAt: r.enqueuedAt, id: r.id}, nil
+}
+
+func (q *diskQueue) dequeue() (message, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.head == len(q.records) {
+		return message{}, false, nil
+	}
+	m, err := q.read(q.records[q.head])
+	if err != nil {
+		return message{}, false, err
+	}
+	q.advance()
+	return m, true, nil
+}
+
+// discard removes the message at the head without reading it, for when
+// dequeue can't, and returns it without its object.
+func (q *diskQueue) discard() (message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.head == len(q.records) {
+		return message{}, false
+	}
+	r := q.records[q.head]
+	q.advance()
+	return message{enqueuedAt: r.enqueuedAt, id: r.id}, true
+}
+
+// advance drops the record at the head, truncating or compacting the file
+// once enough of it is dead. Called with q locked.
+func (q *diskQueue) advance() {
+	q.head++
+	switch {
+	case q.head == len(q.records):
+		q.records, q.head, q.base = q.records[:0], 0, q.end
+		if err := q.f.Truncate(0); err != nil {
+			logger.Error("truncating disk queue failed", "file", q.path, "error", err)
+		}
+	case q.head > len(q.records) / 2:
+		// don't let the dequeued records pile up
+		q.records = append(q.records[:0], q.records[q.head:]...)
+		q.head = 0
+	}
+	if q.head < len(q.records) {
+		if start := q.records[q.head].offset; start - q.base >= diskCompactBytes && start - q.base >= q.end - start {
+			if err := q.compact(start); err != nil {
+				logger.Error("compacting disk queue failed", "file", q.path, "error", err)
+			}
+		}
+	}
+}
+
+// compact replaces the file with one holding only the objects from offset
+// start on. Called with q locked.
+func (q *diskQueue) compact(start int64) error {
+	tmp := q.path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, io.NewSectionReader(q.f, start - q.base, q.end - start)); err == nil {
+		err = os.Rename(tmp, q.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	q.f.Close()
+	q.f, q.base = f, start
+	return nil
+}
+
+func (q *diskQueue) peek() (message, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.head == len(q.records) {
+		return message{}, false, nil
+	}
+	m, err := q.read(q.records[q.head])
+	if err != nil {
+		return message{}, false, err
+	}
+	return m, true, nil
+}
+
+// walk reads the messages one at a time so as not to hold up the queue,
+// skipping those dequeued meanwhile.
+func (q *diskQueue) walk(visit func(message) bool) {
+	q.mu.Lock()
+	records := append([]diskRecord(nil), q.records[q.head:]...)
+	q.mu.Unlock()
+	for _, r := range records {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		if q.head == len(q.records) || r.offset < q.records[q.head].offset {
+			q.mu.Unlock()
+			continue
+		}
+		m, err := q.read(r)
+		q.mu.Unlock()
+		if err != nil {
+			logger.Error("reading disk queue failed", "file", q.path, "error", err)
+			return
+		}
+		if !visit(m) {
+			return
+		}
+	}
+}
+
+func (q *diskQueue) cost(object []byte) int64 {
+	return recordOverhead
+}
+
+// close removes the queue's file.
+func (q *diskQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.records, q.head = nil, 0
+	if q.f == nil {
+		return nil
+	}
+	q.f.Close()
+	return os.Remove(q.path)
+}
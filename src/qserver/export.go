@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"qcommon"
+	"qrpc"
+	"strconv"
+	"time"
+)
+
+// exportHandler streams a queue's messages as NDJSON qcommon.ExportedMessages
+// without dequeuing them. It is a live view: messages enqueued while it runs
+// may be included, and ones dequeued may still be.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	name, q, present := pathQueue(w, r, permDequeue)
+	if !present || !admitted(w, r, name, nil) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	var exported int64
+	q.queue.walk(func(m message) bool {
+		if err := enc.Encode(qcommon.ExportedMessage{ID: m.id, EnqueuedAt: time.Unix(0, m.enqueuedAt).UTC(), Object: m.object}); err != nil {
+			return false
+		}
+		exported++
+		return true
+	})
+	annotate(r.Context(), "exported", exported)
+}
+
+// importHandler enqueues the NDJSON qcommon.ExportedMessages in the body, in
+// order, keeping when each was enqueued. Each message is charged to the rate
+// limits as an enqueue would be. Messages imported before an error stay
+// imported, and the error says how many there were.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	name, q, present := pathQueue(w, r, permEnqueue)
+	if !present {
+		return
+	}
+	var imported int64
+	body := bufio.NewReader(r.Body)
+	// base64 inflates the object by a third
+	limit := int(*maxObjectSize / 3 * 4 + 1024)
+	for {
+		line, err := readLine(body, limit)
+		if err == io.EOF {
+			break
+		}
+		if err == errLineTooLong {
+			writeError(w, http.StatusRequestEntityTooLarge, qcommon.ErrorCodeObjectTooLarge, "Imported %d messages, then a line exceeds %d bytes", imported, limit)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, qcommon.ErrorCodeInvalidArgument, "Imported %d messages, then unable to read message: %v", imported, err)
+			return
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var m qcommon.ExportedMessage
+		if err := json.Unmarshal(line, &m); err != nil {
+			writeError(w, http.StatusBadRequest, qcommon.ErrorCodeInvalidArgument, "Imported %d messages, then unable to parse message: %v", imported, err)
+			return
+		}
+		if int64(len(m.Object)) > *maxObjectSize {
+			writeError(w, http.StatusRequestEntityTooLarge, qcommon.ErrorCodeObjectTooLarge, "Imported %d messages, then object exceeds %d bytes", imported, *maxObjectSize)
+			return
+		}
+		if limited, ok := admit(r.Context(), name, q.enqueueLimit()).(*rateLimitError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.retryAfter.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, qcommon.ErrorCodeRateLimited, "Imported %d messages, then: %s", imported, limited.Message)
+			return
+		}
+		enqueuedAt := m.EnqueuedAt.UnixNano()
+		if m.EnqueuedAt.IsZero() {
+			enqueuedAt = time.Now().UnixNano()
+		}
+		if addErr := q.commitAdd(unlogged(r.Context()), m.Object, enqueuedAt); addErr != nil {
+			msg := addErr.Error()
+			var s *qrpc.Status
+			if errors.As(addErr, &s) {
+				msg = s.Message
+			}
+			err := qrpc.Errorf(qrpc.CodeOf(addErr), "Imported %d messages, then: %s", imported, msg)
+			var full *queueFullError
+			if errors.As(addErr, &full) {
+				err = &queueFullError{err.(*qrpc.Status)}
+			}
+			writeCommitError(w, r, err)
+			return
+		}
+		imported++
+	}
+	annotate(r.Context(), "imported", imported)
+	writeJSON(w, http.StatusOK, qcommon.ImportData{Imported: imported})
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine returns the next line of r without its newline, or io.EOF after
+// the last. A line longer than limit is errLineTooLong, and no more than
+// limit bytes of it are buffered.
+func readLine(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, bytes.TrimSuffix(chunk, []byte("\n"))...)
+		if len(line) > limit {
+			return nil, errLineTooLong
+		}
+		switch err {
+		case nil:
+			return line, nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(line) == 0 {
+				return nil, io.EOF
+			}
+			return line, nil
+		default:
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"qcommon"
+	"qrpc"
+	"sync"
+	"time"
+)
+
+const (
+	replicaRetryInterval = time.Second
+)
+
+// follower keeps a registry identical to a primary's by applying its
+// replication stream, reconnecting and resyncing from a fresh snapshot
+// whenever the stream breaks.
+type follower struct {
+	primary	string
+	url	string
+	token	string
+	client	*http.Client
+	registry	*registry
+	cancel	context.CancelFunc
+	done	chan bool
+
+	mu	sync.Mutex
+	connected	bool
+	// whether the snapshot since the last reset has been applied
+	synced	bool
+	resetSeq	int64
+	appliedSeq	int64
+	primarySeq	int64
+	caughtUp	time.Time
+}
+
+// startFollower follows the primary at baseURL, authenticating with token if
+// set.
+func startFollower(primary, baseURL, token string, client *http.Client, r *registry) *follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{
+		primary:	primary,
+		url:		baseURL + "/v1/replication/stream",
+		token:		token,
+		client:		client,
+		registry:	r,
+		cancel:		cancel,
+		done:		make(chan bool),
+	}
+	go f.run(ctx)
+	return f
+}
+
+func errReadOnly(primary string) error {
+	return qrpc.Errorf(qrpc.Unavailable, "Server is a read-only replica of %s", primary)
+}
+
+func (f *follower) run(ctx context.Context) {
+	defer close(f.done)
+	for {
+		err := f.follow(ctx)
+		f.mu.Lock()
+		f.connected = false
+		f.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("replication stream ended; reconnecting", "primary", f.primary, "error", err)
+		select {
+		case <-time.After(replicaRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow applies one connection's stream until it breaks.
+func (f *follower) follow(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", f.url, nil)
+	if err != nil {
+		return err
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer " + f.token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e qcommon.ErrorData
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("%s: %s", resp.Status, e.Error.Message)
+	}
+
+	d := json.NewDecoder(resp.Body)
+	for {
+		var ev qcommon.ReplicationEvent
+		if err := d.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("primary closed the stream")
+			}
+			return err
+		}
+		f.apply(ev)
+	}
+}
+
+func (f *follower) apply(ev qcommon.ReplicationEvent) {
+	switch ev.Op {
+	case qcommon.ReplicationHeartbeat:
+		f.mu.Lock()
+		f.primarySeq = ev.Seq
+		f.synced = f.connected
+		f.updateCaughtUp()
+		f.mu.Unlock()
+		return
+	case qcommon.ReplicationReset:
+		for _, name := range f.registry.names() {
+			f.registry.remove(name)
+		}
+		f.mu.Lock()
+		f.connected, f.synced, f.resetSeq = true, false, ev.Seq
+		f.mu.Unlock()
+		logger.Info("resyncing from primary", "primary", f.primary, "seq", ev.Seq)
+	case qcommon.ReplicationCreate:
+		if ev.Settings != nil {
+			f.registry.set(ev.Queue, *ev.Settings)
+		}
+	case qcommon.ReplicationDelete:
+		f.registry.remove(ev.Queue)
+	case qcommon.ReplicationEnqueue:
+		// mutations of a queue deleted while they were in flight are dropped,
+		// as they are on the primary
+		if e, present := f.registry.get(ev.Queue); present {
+			if _, err := e.add(ev.Object, ev.EnqueuedAt, false); err != nil {
+				logger.Warn("replicated enqueue failed", "queue", ev.Queue, "error", err)
+			}
+		}
+	case qcommon.ReplicationDequeue:
+		if e, present := f.registry.get(ev.Queue); present {
+			// a message this replica can't read is logged and removed
+			e.consumeMessage()
+		}
+	default:
+		logger.Warn("ignoring unknown replication op", "op", ev.Op)
+	}
+
+	f.mu.Lock()
+	f.appliedSeq = ev.Seq
+	// the snapshot's events all carry the reset's seq
+	if ev.Seq > f.resetSeq {
+		f.synced = true
+	}
+	if f.primarySeq < ev.Seq {
+		f.primarySeq = ev.Seq
+	}
+	f.updateCaughtUp()
+	f.mu.Unlock()
+}
+
+// updateCaughtUp notes when the replica last had everything the primary did.
+// Called with f.mu held.
+func (f *follower) updateCaughtUp() {
+	if f.appliedSeq >= f.primarySeq {
+		f.caughtUp = time.Now()
+	}
+}
+
+func (f *follower) status() qcommon.ReplicationStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := qcommon.ReplicationStatus{
+		Role:		"replica",
+		Primary:	f.primary,
+		Connected:	f.connected,
+		AppliedSeq:	f.appliedSeq,
+		PrimarySeq:	f.primarySeq,
+	}
+	if f.primarySeq > f.appliedSeq {
+		status.LagEvents = f.primarySeq - f.appliedSeq
+		status.LagSeconds = time.Since(f.caughtUp).Seconds()
+	}
+	return status
+}
+
+// ready reports whether the replica holds a full copy of the primary's
+// queues, and why not if it doesn't.
+func (f *follower) ready() (bool, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case !f.connected:
+		return false, "not connected to primary " + f.primary
+	case !f.synced:
+		return false, "loading snapshot from primary " + f.primary
+	}
+	return true, "following primary " + f.primary
+}
+
+// stop disconnects from the primary and waits for the stream to finish
+// applying.
+func (f *follower) stop() {
+	f.cancel()
+	<-f.done
+}
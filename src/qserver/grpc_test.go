@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"bytes"
+	"qclient"
+	"qcommon"
+	"qrpc"
+	"testing"
+)
+
+var ctx = context.Background()
+
+// startGRPC serves a fresh registry over an in-process listener and returns a
+// client transport connected to it.
+func startGRPC(t *testing.T) (*qrpc.Client, func()) {
+	l := qrpc.NewBufListener()
+	srv := qrpc.NewHTTPServer(service{newRegistry()})
+	go srv.Serve(l)
+	client := qclient.NewGRPCTransport("bufconn", l.Dial).(*qrpc.Client)
+	return client, func() { srv.Close() }
+}
+
+func TestGRPCCreateGetDelete(t *testing.T) {
+	client, stop := startGRPC(t)
+	defer stop()
+
+	id, err := client.CreateQueue(ctx, "grpcq")
+	if err != nil || id != "grpcq" {
+		t.Fatalf("want %q, got %q (%v)", "grpcq", id, err)
+	}
+	if _, err := client.CreateQueue(ctx, "grpcq"); qrpc.CodeOf(err) != qrpc.AlreadyExists {
+		t.Errorf("want AlreadyExists, got %v", err)
+	}
+	if id, err := client.GetQueue(ctx, "grpcq"); err != nil || id != "grpcq" {
+		t.Errorf("want %q, got %q (%v)", "grpcq", id, err)
+	}
+	if err := client.DeleteQueue(ctx, "grpcq"); err != nil {
+		t.Errorf("unexpected delete error: %v", err)
+	}
+	if _, err := client.GetQueue(ctx, "grpcq"); qrpc.CodeOf(err) != qrpc.NotFound {
+		t.Errorf("want NotFound, got %v", err)
+	}
+}
+
+func TestGRPCEnqueueDequeue(t *testing.T) {
+	client, stop := startGRPC(t)
+	defer stop()
+
+	id, _ := client.CreateQueue(ctx, "grpcq")
+	object := qcommon.Object("binary\x00\xffobject")
+	if err := client.Enqueue(ctx, id, object); err != nil {
+		t.Fatalf("unexpected enqueue error: %v", err)
+	}
+	got, err := client.Dequeue(ctx, id)
+	if err != nil || !bytes.Equal(got, object) {
+		t.Errorf("want %q, got %q (%v)", object, got, err)
+	}
+	if _, err := client.Dequeue(ctx, id); err != qrpc.ErrEmpty {
+		t.Errorf("want ErrEmpty, got %v", err)
+	}
+	if err := client.Enqueue(ctx, "missing", object); qrpc.CodeOf(err) != qrpc.NotFound {
+		t.Errorf("want NotFound, got %v", err)
+	}
+}
+
+func TestGRPCDequeueStream(t *testing.T) {
+	client, stop := startGRPC(t)
+	defer stop()
+
+	id, _ := client.CreateQueue(ctx, "grpcq")
+	want := []string{"a", "b", "c"}
+	for _, s := range want {
+		client.Enqueue(ctx, id, []byte(s))
+	}
+
+	var got []string
+	err := client.DequeueStream(ctx, id, func(object qcommon.Object) error {
+		got = append(got, string(object))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected stream error: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("want %q, got %q", want[i], got[i])
+		}
+	}
+
+	if err := client.DequeueStream(ctx, "missing", func(qcommon.Object) error { return nil }); qrpc.CodeOf(err) != qrpc.NotFound {
+		t.Errorf("want NotFound, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"qcommon"
+	"strings"
+	"sync"
+)
+
+// clusterReadyLag is how many committed cluster log entries a node may have
+// left to apply and still be ready.
+const clusterReadyLag = 100
+
+// readinessState tracks a server's lifecycle for /readyz. The zero value is
+// a server still starting.
+type readinessState struct {
+	sync.Mutex
+	listeners	[]string
+	started	bool
+	draining	bool
+}
+
+var readiness readinessState
+
+// listening records that a listener is up, e.g. "http :4242".
+func (s *readinessState) listening(name string) {
+	s.Lock()
+	defer s.Unlock()
+	s.listeners = append(s.listeners, name)
+}
+
+// start marks every listener as up.
+func (s *readinessState) start() {
+	s.Lock()
+	defer s.Unlock()
+	s.started = true
+}
+
+// drain marks the server as shutting down, so that it stops being sent
+// requests before it stops serving them.
+func (s *readinessState) drain() {
+	s.Lock()
+	defer s.Unlock()
+	s.draining = true
+}
+
+// healthzHandler reports that the process is alive and serving HTTP. It
+// doesn't depend on the queues, so a probe restarting servers that fail it
+// won't restart one that is merely busy or catching up.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, http.StatusMethodNotAllowed, qcommon.ErrorCodeMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+	writeHealth(w, []qcommon.HealthCheck{{Name: "process", OK: true}})
+}
+
+// readyzHandler reports whether the server should be sent requests: its
+// listeners are up, it isn't shutting down, and as a replica it holds the
+// primary's snapshot, or as a cluster node it knows the leader and has
+// applied the log.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, http.StatusMethodNotAllowed, qcommon.ErrorCodeMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+	writeHealth(w, readyChecks(queues, following.Load()))
+}
+
+// readyChecks checks the readiness of a server serving r, following f if
+// it is a replica.
+func readyChecks(r *registry, f *follower) []qcommon.HealthCheck {
+	readiness.Lock()
+	listeners := strings.Join(readiness.listeners, ", ")
+	checks := []qcommon.HealthCheck{
+		{Name: "listeners", OK: readiness.started, Detail: "listening on " + listeners},
+		{Name: "shutdown", OK: !readiness.draining, Detail: "serving"},
+	}
+	readiness.Unlock()
+	if !checks[0].OK {
+		checks[0].Detail = "starting; listening on " + listeners
+	}
+	if !checks[1].OK {
+		checks[1].Detail = "shutting down"
+	}
+
+	if f != nil {
+		ok, detail := f.ready()
+		checks = append(checks, qcommon.HealthCheck{Name: "replication", OK: ok, Detail: detail})
+	}
+	if c := r.cluster; c != nil {
+		check := qcommon.HealthCheck{Name: "cluster"}
+		switch status := c.node.Status(); {
+		case status.Leader == "":
+			check.Detail = "no cluster leader is elected"
+		case status.CommitIndex > status.LastApplied + clusterReadyLag:
+			check.Detail = fmt.Sprintf("applied %d of %d committed log entries", status.LastApplied, status.CommitIndex)
+		default:
+			check.OK = true
+			check.Detail = fmt.Sprintf("%s, leader %s, applied %d of %d committed log entries", status.State, status.Leader, status.LastApplied, status.CommitIndex)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// writeHealth responds with checks, as 503 Service Unavailable if any failed.
+func writeHealth(w http.ResponseWriter, checks []qcommon.HealthCheck) {
+	data := qcommon.HealthData{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			data.Status, status = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, data)
+}
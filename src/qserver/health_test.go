@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"qcommon"
+	"testing"
+	"time"
+)
+
+// probe requests a health endpoint and decodes its checks by name.
+func probe(t *testing.T, handler http.HandlerFunc, path string) (int, map[string]qcommon.HealthCheck) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", path, nil))
+	var data qcommon.HealthData
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatalf("%s: %v: %s", path, err, w.Body)
+	}
+	if (data.Status == "ok") != (w.Code == http.StatusOK) {
+		t.Errorf("%s: status %q with code %d", path, data.Status, w.Code)
+	}
+	checks := map[string]qcommon.HealthCheck{}
+	for _, check := range data.Checks {
+		checks[check.Name] = check
+	}
+	return w.Code, checks
+}
+
+func TestHealthz(t *testing.T) {
+	if code, checks := probe(t, healthzHandler, "/healthz"); code != http.StatusOK || !checks["process"].OK {
+		t.Errorf("got %d %v", code, checks)
+	}
+}
+
+func TestReadyzLifecycle(t *testing.T) {
+	readiness = readinessState{}
+	defer func() { readiness = readinessState{} }()
+
+	readiness.listening("http :4242")
+	if code, checks := probe(t, readyzHandler, "/readyz"); code != http.StatusServiceUnavailable || checks["listeners"].OK || !checks["shutdown"].OK {
+		t.Errorf("starting: got %d %v", code, checks)
+	}
+	readiness.start()
+	if code, checks := probe(t, readyzHandler, "/readyz"); code != http.StatusOK || checks["listeners"].Detail != "listening on http :4242" {
+		t.Errorf("started: got %d %v", code, checks)
+	}
+	readiness.drain()
+	if code, checks := probe(t, readyzHandler, "/readyz"); code != http.StatusServiceUnavailable || checks["shutdown"].OK {
+		t.Errorf("draining: got %d %v", code, checks)
+	}
+	if code, _ := probe(t, healthzHandler, "/healthz"); code != http.StatusOK {
+		t.Errorf("draining: healthz got %d", code)
+	}
+}
+
+func TestReadyzReplica(t *testing.T) {
+	f := &follower{primary: "primary:4242", registry: newRegistry()}
+	check := func(when string, want bool) {
+		t.Helper()
+		if ok, detail := f.ready(); ok != want {
+			t.Errorf("%s: ready %v, %s", when, ok, detail)
+		}
+	}
+	check("connecting", false)
+	f.apply(qcommon.ReplicationEvent{Seq: 5, Op: qcommon.ReplicationReset})
+	f.apply(qcommon.ReplicationEvent{Seq: 5, Op: qcommon.ReplicationCreate, Queue: "q", Settings: &qcommon.QueueSettings{}})
+	check("loading snapshot", false)
+	f.apply(qcommon.ReplicationEvent{Seq: 6, Op: qcommon.ReplicationEnqueue, Queue: "q", Object: []byte("x")})
+	check("streaming", true)
+
+	f.apply(qcommon.ReplicationEvent{Seq: 9, Op: qcommon.ReplicationReset})
+	check("resyncing", false)
+	f.apply(qcommon.ReplicationEvent{Seq: 9, Op: qcommon.ReplicationHeartbeat})
+	check("heartbeat after empty snapshot", true)
+
+	checks := readyChecks(newRegistry(), f)
+	if len(checks) != 3 || checks[2].Name != "replication" || !checks[2].OK {
+		t.Errorf("got %v", checks)
+	}
+}
+
+func TestReadyzCluster(t *testing.T) {
+	registries := []*registry{newRegistry(), newRegistry(), newRegistry()}
+	network, clusters := startCluster(t, registries...)
+	leader := clusterLeader(t, clusters...)
+	for _, r := range registries {
+		if check := readyChecks(r, nil)[2]; check.Name != "cluster" || !check.OK {
+			t.Errorf("%s: got %v", r.cluster.id, check)
+		}
+	}
+
+	// a follower cut off from the leader stands for election
+	network.Partition([]string{"n0"}, []string{"n1"}, []string{"n2"})
+	follower := clusters[0]
+	if follower == leader {
+		follower = clusters[1]
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.node.Leader() != "" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if check := readyChecks(registryOf(follower, registries), nil)[2]; check.OK {
+		t.Errorf("leaderless %s: got %v", follower.id, check)
+	}
+}
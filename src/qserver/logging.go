@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"qcommon"
+	"qrpc"
+	"strings"
+	"time"
+)
+
+// The server logs through logger, as logfmt or JSON lines. Each request is
+// logged once when it finishes, at debug level unless it failed with a server
+// error, carrying the fields its handlers added with annotate.
+
+var (
+	logFormat = flag.String("log_format", "text", "log format: text, which is logfmt, or json")
+	logLevelName = flag.String("log_level", "info", "least severe level logged: debug, info, warn or error; adjustable at /v1/log/level")
+	logPayloads = flag.String("log_payloads", "size", "what request logs show of message objects: none, size, or full, which logs their contents")
+	logLevel = new(slog.LevelVar)
+	logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+)
+
+// setupLogging configures logger from the flags to write to w, and makes it
+// the default so that the log package writes through it too.
+func setupLogging(w io.Writer) error {
+	if err := logLevel.UnmarshalText([]byte(*logLevelName)); err != nil {
+		return fmt.Errorf("--log_level: %v", err)
+	}
+	if *verbose {
+		logLevel.Set(slog.LevelDebug)
+	}
+	switch *logPayloads {
+	case "none", "size", "full":
+	default:
+		return fmt.Errorf("--log_payloads must be none, size or full, not %q", *logPayloads)
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch *logFormat {
+	case "text":
+		logger = slog.New(slog.NewTextHandler(w, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(w, opts))
+	default:
+		return fmt.Errorf("--log_format must be text or json, not %q", *logFormat)
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// fatal logs an error the server can't run with and exits.
+func fatal(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestLog collects the fields of a request's log line. Only the request's
+// goroutine adds to it.
+type requestLog struct {
+	args	[]interface{}
+}
+
+type requestLogKey struct{}
+
+func withRequestLog(ctx context.Context) (context.Context, *requestLog) {
+	l := new(requestLog)
+	return context.WithValue(ctx, requestLogKey{}, l), l
+}
+
+// annotate adds key-value pairs to the log line of ctx's request, if it is
+// being logged.
+func annotate(ctx context.Context, args ...interface{}) {
+	if l, _ := ctx.Value(requestLogKey{}).(*requestLog); l != nil {
+		l.args = append(l.args, args...)
+	}
+}
+
+// unlogged returns ctx with its request's log line out of annotate's reach,
+// for bulk operations that would otherwise add a field per message.
+func unlogged(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestLogKey{}, (*requestLog)(nil))
+}
+
+// annotateMessage adds a message's id and, as --log_payloads allows, its
+// object to the log line of ctx's request.
+func annotateMessage(ctx context.Context, id int64, object []byte) {
+	switch *logPayloads {
+	case "full":
+		annotate(ctx, "message_id", id, "bytes", len(object), "object", string(object))
+	case "size":
+		annotate(ctx, "message_id", id, "bytes", len(object))
+	default:
+		annotate(ctx, "message_id", id)
+	}
+}
+
+// loggedResponse records the status a handler wrote.
+type loggedResponse struct {
+	http.ResponseWriter
+	status	int
+}
+
+func (w *loggedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming handlers working.
+func (w *loggedResponse) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggedResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequests logs each HTTP request when it finishes.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, l := withRequestLog(r.Context())
+		lw := &loggedResponse{ResponseWriter: w}
+		next.ServeHTTP(lw, r.WithContext(ctx))
+
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelDebug
+		// /readyz answers 503 whenever the server is starting or stopping
+		if status >= 500 && r.URL.Path != "/readyz" {
+			level = slog.LevelError
+		}
+		if !logger.Enabled(ctx, level) {
+			return
+		}
+		args := append([]interface{}{"method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "status", status, "latency", time.Since(start)}, l.args...)
+		logger.Log(ctx, level, "request", args...)
+	})
+}
+
+// loggedService logs each call to a qrpc.QueueService, for the APIs that
+// don't go through logRequests.
+type loggedService struct {
+	qrpc.QueueService
+	protocol	string
+}
+
+func (s loggedService) log(ctx context.Context, l *requestLog, start time.Time, op string, id qcommon.QueueId, err error) {
+	level := slog.LevelDebug
+	switch qrpc.CodeOf(err) {
+	case qrpc.Unknown, qrpc.Internal, qrpc.Unavailable:
+		level = slog.LevelError
+	}
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	args := []interface{}{"protocol", s.protocol, "op", op, "queue", string(id), "remote", qcommon.RemoteAddrFrom(ctx)}
+	if principal := qcommon.PrincipalFrom(ctx); principal != "" {
+		args = append(args, "principal", principal)
+	}
+	args = append(args, "code", int(qrpc.CodeOf(err)), "latency", time.Since(start))
+	logger.Log(ctx, level, "request", append(args, l.args...)...)
+}
+
+func (s loggedService) CreateQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	ctx, l := withRequestLog(ctx)
+	start := time.Now()
+	id, err := s.QueueService.CreateQueue(ctx, name)
+	s.log(ctx, l, start, "CreateQueue", qcommon.QueueId(name), err)
+	return id, err
+}
+
+func (s loggedService) GetQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	ctx, l := withRequestLog(ctx)
+	start := time.Now()
+	id, err := s.QueueService.GetQueue(ctx, name)
+	s.log(ctx, l, start, "GetQueue", qcommon.QueueId(name), err)
+	return id, err
+}
+
+func (s loggedService) DeleteQueue(ctx context.Context, id qcommon.QueueId) error {
+	ctx, l := withRequestLog(ctx)
+	start := time.Now()
+	err := s.QueueService.DeleteQueue(ctx, id)
+	s.log(ctx, l, start, "DeleteQueue", id, err)
+	return err
+}
+
+func (s loggedService) Enqueue(ctx context.Context, id qcommon.QueueId, object qcommon.Object) error {
+	ctx, l := withRequestLog(ctx)
+	start := time.Now()
+	err := s.QueueService.Enqueue(ctx, id, object)
+	s.log(ctx, l, start, "Enqueue", id, err)
+	return err
+}
+
+func (s loggedService) Dequeue(ctx context.Context, id qcommon.QueueId) (qcommon.Object, error) {
+	ctx, l := withRequestLog(ctx)
+	start := time.Now()
+	object, err := s.QueueService.Dequeue(ctx, id)
+	s.log(ctx, l, start, "Dequeue", id, err)
+	return object, err
+}
+
+// logLevelHandler reports the least severe level logged, or sets it from a
+// qcommon.LogLevelData. The level isn't saved across restarts.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if !permitted(w, r, "*", permAdmin) {
+		return
+	}
+	if r.Method == "PUT" {
+		var data qcommon.LogLevelData
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1 << 10)).Decode(&data); err != nil {
+			writeError(w, http.StatusBadRequest, qcommon.ErrorCodeInvalidArgument, "Unable to parse log level: %v", err)
+			return
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(data.Level)); err != nil {
+			writeError(w, http.StatusBadRequest, qcommon.ErrorCodeInvalidArgument, "Invalid log level %q; want debug, info, warn or error", data.Level)
+			return
+		}
+		if level != logLevel.Level() {
+			from, to := strings.ToLower(logLevel.Level().String()), strings.ToLower(level.String())
+			logger.Info("log level changed", "from", from, "to", to, "remote", r.RemoteAddr)
+			audits.record(r.Context(), qcommon.AuditSetLogLevel, "", map[string]string{"from": from, "to": to})
+			logLevel.Set(level)
+		}
+	}
+	writeJSON(w, http.StatusOK, qcommon.LogLevelData{Level: strings.ToLower(logLevel.Level().String())})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"qcommon"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer is a buffer handlers may log to while a test reads it.
+type logBuffer struct {
+	sync.Mutex
+	b	bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.Write(p)
+}
+
+// captureLogs sends logs at every level to a buffer of JSON lines until the
+// test ends.
+func captureLogs(t *testing.T) *logBuffer {
+	b := new(logBuffer)
+	saved, savedLevel := logger, logLevel.Level()
+	logLevel.Set(slog.LevelDebug)
+	logger = slog.New(slog.NewJSONHandler(b, &slog.HandlerOptions{Level: logLevel}))
+	t.Cleanup(func() {
+		logger = saved
+		logLevel.Set(savedLevel)
+	})
+	return b
+}
+
+// logLines waits for want logs with the given message, since servers log
+// requests after responding, and returns them parsed, emptying the buffer.
+func logLines(t *testing.T, b *logBuffer, msg string, want int) []map[string]interface{} {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		var lines []map[string]interface{}
+		b.Lock()
+		for _, line := range strings.Split(b.b.String(), "\n") {
+			var fields map[string]interface{}
+			if line == "" {
+				continue
+			}
+			if err := json.Unmarshal([]byte(line), &fields); err != nil {
+				t.Fatalf("log line %q isn't JSON: %v", line, err)
+			}
+			if fields["msg"] == msg {
+				lines = append(lines, fields)
+			}
+		}
+		if len(lines) >= want || time.Now().After(deadline) {
+			b.b.Reset()
+			b.Unlock()
+			if len(lines) != want {
+				t.Fatalf("got %d %q logs, want %d: %v", len(lines), msg, want, lines)
+			}
+			return lines
+		}
+		b.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	logs := captureLogs(t)
+	mux := http.NewServeMux()
+	registerRESTHandlers(mux)
+	srv := httptest.NewServer(logRequests(mux))
+	defer srv.Close()
+	url := srv.URL + "/v1/queues/logq"
+	doRequest(t, "PUT", url, "", "")
+	defer doRequest(t, "DELETE", url, "", "")
+	logLines(t, logs, "request", 1)
+
+	for _, payloads := range []string{"none", "size", "full"} {
+		*logPayloads = payloads
+		doRequest(t, "POST", url + "/messages", qcommon.ObjectContentType, "secret")
+		doRequest(t, "DELETE", url + "/messages/head", "", "")
+		lines := logLines(t, logs, "request", 2)
+		for _, fields := range lines {
+			if fields["level"] != "DEBUG" || fields["queue"] != "logq" || fields["message_id"] == nil || fields["latency"] == nil {
+				t.Errorf("--log_payloads=%s: missing fields in %v", payloads, fields)
+			}
+			if _, sized := fields["bytes"]; sized != (payloads != "none") {
+				t.Errorf("--log_payloads=%s: logged %v", payloads, fields)
+			}
+			if _, full := fields["object"]; full != (payloads == "full") || full && fields["object"] != "secret" {
+				t.Errorf("--log_payloads=%s: logged %v", payloads, fields)
+			}
+		}
+		if lines[0]["status"] != float64(http.StatusCreated) || lines[1]["status"] != float64(http.StatusOK) || lines[0]["message_id"] != lines[1]["message_id"] {
+			t.Errorf("enqueue and dequeue logged %v and %v", lines[0], lines[1])
+		}
+	}
+	*logPayloads = "size"
+
+	logLevel.Set(slog.LevelInfo)
+	doRequest(t, "GET", url + "/messages/head", "", "")
+	time.Sleep(50 * time.Millisecond)
+	logLines(t, logs, "request", 0)
+}
+
+func TestServiceLog(t *testing.T) {
+	logs := captureLogs(t)
+	svc := loggedService{service{newRegistry()}, "binary"}
+	ctx := qcommon.WithRemoteAddr(context.Background(), "10.0.0.1:5000")
+	svc.CreateQueue(ctx, "logq")
+	svc.Enqueue(ctx, "logq", []byte("x"))
+	svc.Dequeue(ctx, "logq")
+	svc.Dequeue(ctx, "logq")
+
+	lines := logLines(t, logs, "request", 4)
+	for i, op := range []string{"CreateQueue", "Enqueue", "Dequeue", "Dequeue"} {
+		if fields := lines[i]; fields["op"] != op || fields["protocol"] != "binary" || fields["queue"] != "logq" || fields["remote"] != "10.0.0.1:5000" {
+			t.Errorf("logged %v for %s", fields, op)
+		}
+	}
+	if lines[2]["message_id"] != float64(1) || lines[2]["code"] != float64(0) {
+		t.Errorf("dequeue logged %v", lines[2])
+	}
+	if _, present := lines[3]["message_id"]; present || lines[3]["code"] != float64(11) {
+		t.Errorf("empty dequeue logged %v", lines[3])
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	captureLogs(t)
+	logLevel.Set(slog.LevelInfo)
+	srv := restServer()
+	defer srv.Close()
+	url := srv.URL + "/v1/log/level"
+
+	if resp, b := doRequest(t, "GET", url, "", ""); resp.StatusCode != http.StatusOK || string(b) != `{"level":"info"}` {
+		t.Errorf("get: got %d %s", resp.StatusCode, b)
+	}
+	if resp, b := doRequest(t, "PUT", url, "application/json", `{"level":"debug"}`); resp.StatusCode != http.StatusOK || string(b) != `{"level":"debug"}` || logLevel.Level() != slog.LevelDebug {
+		t.Errorf("put: got %d %s", resp.StatusCode, b)
+	}
+	if resp, b := doRequest(t, "PUT", url, "application/json", `{"level":"loud"}`); resp.StatusCode != http.StatusBadRequest || errorCode(b) != qcommon.ErrorCodeInvalidArgument || logLevel.Level() != slog.LevelDebug {
+		t.Errorf("put invalid: got %d %s", resp.StatusCode, b)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"qcommon"
+	"qrpc"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// enqueue charges the object to the queue and the server budget, rejecting it
+// with a ResourceExhausted error if the budget would be exceeded or the queue
+// is full.
+func (e *entry) enqueue(object []byte) error {
+	_, err := e.add(object, time.Now().UnixNano(), true)
+	return err
+}
+
+// add enqueues an object as of enqueuedAt, checking the budget if asked, and
+// returns its id. Replicas don't check, so that they hold whatever their
+// primary accepted. It fails with NotFound if the queue was removed after the
+// caller looked it up, since remove has already settled its bytes.
+func (e *entry) add(object []byte, enqueuedAt int64, checkBudget bool) (int64, error) {
+	if j := e.registry.journal; j != nil {
+		j.Lock()
+		defer j.Unlock()
+	}
+	e.removal.RLock()
+	defer e.removal.RUnlock()
+	if e.removed {
+		return 0, qrpc.Errorf(qrpc.NotFound, "Queue %q doesn't exist", e.name)
+	}
+	cost := e.queue.cost(object)
+	if used := atomic.AddInt64(&e.registry.bytes, cost); checkBudget && e.registry.maxBytes > 0 && used > e.registry.maxBytes {
+		atomic.AddInt64(&e.registry.bytes, -cost)
+		return 0, errMemoryExhausted(e.registry.maxBytes)
+	}
+	// counted before enqueuing so that a dequeue racing ahead can't take the
+	// counts below zero
+	atomic.AddInt64(&e.bytes, cost)
+	atomic.AddInt64(&e.depth, 1)
+	id := atomic.AddInt64(&e.lastID, 1)
+	if err := e.queue.enqueue(message{object: object, enqueuedAt: enqueuedAt, id: id}); err != nil {
+		atomic.AddInt64(&e.registry.bytes, -cost)
+		atomic.AddInt64(&e.bytes, -cost)
+		atomic.AddInt64(&e.depth, -1)
+		if err == errFull {
+			return 0, errQueueFull(e.name, e.settings().Capacity)
+		}
+		return 0, qrpc.Errorf(qrpc.Internal, "Enqueuing to queue %q failed: %v", e.name, err)
+	}
+	atomic.AddInt64(&e.enqueued, 1)
+	e.registry.journal.record(qcommon.ReplicationEvent{Op: qcommon.ReplicationEnqueue, Queue: e.name, Object: object, EnqueuedAt: enqueuedAt})
+	return id, nil
+}
+
+func (e *entry) dequeue() ([]byte, bool, error) {
+	object, _, valid, err := e.dequeueMessage()
+	return object, valid, err
+}
+
+// dequeueMessage is dequeue, also returning the object's id.
+func (e *entry) dequeueMessage() ([]byte, int64, bool, error) {
+	return e.take(false)
+}
+
+// consumeMessage is dequeueMessage for a dequeue a cluster committed or a
+// primary made, which must leave every node's queue the same: a message this
+// node can't read is logged and removed all the same, reported as removed
+// with an error.
+func (e *entry) consumeMessage() ([]byte, int64, bool, error) {
+	return e.take(true)
+}
+
+func (e *entry) take(consume bool) ([]byte, int64, bool, error) {
+	if j := e.registry.journal; j != nil {
+		j.Lock()
+		defer j.Unlock()
+	}
+	e.removal.RLock()
+	defer e.removal.RUnlock()
+	if e.removed {
+		return nil, 0, false, nil
+	}
+	m, ok, err := e.queue.dequeue()
+	if err != nil {
+		err = errQueueRead(e.name, err)
+		d, discards := e.queue.(discarder)
+		if !consume || !discards {
+			return nil, 0, false, err
+		}
+		logger.Error("discarding unreadable message", "queue", e.name, "error", err)
+		m, ok = d.discard()
+	}
+	if !ok {
+		return nil, 0, false, err
+	}
+	cost := e.queue.cost(m.object)
+	atomic.AddInt64(&e.bytes, -cost)
+	atomic.AddInt64(&e.registry.bytes, -cost)
+	atomic.AddInt64(&e.depth, -1)
+	atomic.AddInt64(&e.dequeued, 1)
+	e.registry.journal.record(qcommon.ReplicationEvent{Op: qcommon.ReplicationDequeue, Queue: e.name})
+	return m.object, m.id, true, err
+}
+
+// errQueueRead is the error from a queue that couldn't read its head.
+func errQueueRead(name string, err error) error {
+	return qrpc.Errorf(qrpc.Internal, "Reading queue %q failed: %v", name, err)
+}
+
+// purge dequeues every object, returning how many there were. It stops at the
+// first that can't be read.
+func (e *entry) purge() (int64, error) {
+	return e.drain(false)
+}
+
+// consumeAll is purge for a purge a cluster committed, removing the messages
+// that can't be read too and reporting the first such error.
+func (e *entry) consumeAll() (int64, error) {
+	return e.drain(true)
+}
+
+func (e *entry) drain(consume bool) (int64, error) {
+	var purged int64
+	var failed error
+	for {
+		_, _, valid, err := e.take(consume)
+		if failed == nil {
+			failed = err
+		}
+		if !valid {
+			return purged, failed
+		}
+		purged++
+	}
+}
+
+func (e *entry) stats(name string) qcommon.QueueStats {
+	stats := qcommon.QueueStats{
+		Name:		name,
+		Depth:		atomic.LoadInt64(&e.depth),
+		Bytes:		atomic.LoadInt64(&e.bytes),
+		Enqueued:	atomic.LoadInt64(&e.enqueued),
+		Dequeued:	atomic.LoadInt64(&e.dequeued),
+	}
+	if oldest, ok := e.oldest(); ok {
+		stats.OldestAgeSeconds = time.Since(oldest).Seconds()
+	}
+	return stats
+}
+
+func errMemoryExhausted(max int64) error {
+	return qrpc.Errorf(qrpc.ResourceExhausted, "Server memory budget of %d bytes exceeded", max)
+}
+
+// queueFullError is a ResourceExhausted error from a bounded queue at
+// capacity, told apart from the server running out of memory.
+type queueFullError struct {
+	*qrpc.Status
+}
+
+func (e *queueFullError) Unwrap() error {
+	return e.Status
+}
+
+func errQueueFull(name string, capacity int) error {
+	return &queueFullError{qrpc.Errorf(qrpc.ResourceExhausted, "Queue %q is full at its capacity of %d messages", name, capacity).(*qrpc.Status)}
+}
+
+// writeEnqueueError reports a failed enqueue in the style of the API being
+// called.
+func writeEnqueueError(w http.ResponseWriter, r *http.Request, err error) {
+	msg := err.Error()
+	var s *qrpc.Status
+	if errors.As(err, &s) {
+		msg = s.Message
+	}
+	code := qcommon.ErrorCodeMemoryExhausted
+	var full *queueFullError
+	if errors.As(err, &full) {
+		code = qcommon.ErrorCodeQueueFull
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		writeError(w, http.StatusInsufficientStorage, code, "%s", msg)
+	} else {
+		http.Error(w, msg, http.StatusInsufficientStorage)
+	}
+}
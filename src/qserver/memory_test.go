@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"qcommon"
+	"qrpc"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMemoryAccounting(t *testing.T) {
+	registry := newRegistry()
+	a, _ := registry.create("a", qcommon.QueueSettings{})
+	b, _ := registry.create("b", qcommon.QueueSettings{})
+
+	a.enqueue(make([]byte, 100))
+	a.enqueue(make([]byte, 50))
+	b.enqueue(make([]byte, 10))
+	if got, want := a.stats("a").Bytes, 150 + 2 * nodeOverhead; got != want {
+		t.Errorf("queue a: want %d bytes, got %d", want, got)
+	}
+	if got, want := registry.bytes, 160 + 3 * nodeOverhead; got != want {
+		t.Errorf("server: want %d bytes, got %d", want, got)
+	}
+
+	if stats := a.stats("a"); stats.OldestAgeSeconds <= 0 {
+		t.Errorf("want the age of the oldest object, got %v", stats.OldestAgeSeconds)
+	}
+	a.dequeue()
+	if stats := a.stats("a"); stats.Depth != 1 || stats.Bytes != 50 + nodeOverhead || stats.Enqueued != 2 || stats.Dequeued != 1 {
+		t.Errorf("queue a after dequeue: got %+v", stats)
+	}
+
+	a.dequeue()
+	if stats := a.stats("a"); stats.OldestAgeSeconds != 0 {
+		t.Errorf("want no age for an empty queue, got %v", stats.OldestAgeSeconds)
+	}
+
+	registry.remove("a")
+	if got, want := registry.bytes, 10 + nodeOverhead; got != want {
+		t.Errorf("server after delete: want %d bytes, got %d", want, got)
+	}
+}
+
+func TestRemoveWhileEnqueuing(t *testing.T) {
+	registry := newRegistry()
+	for round := 0; round < 50; round++ {
+		e, _ := registry.create("racedq", qcommon.QueueSettings{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if err := e.enqueue([]byte("object")); err != nil && qrpc.CodeOf(err) != qrpc.NotFound {
+						t.Errorf("unexpected error: %v", err)
+					}
+				}
+			}()
+		}
+		registry.remove("racedq")
+		wg.Wait()
+		if got := atomic.LoadInt64(&registry.bytes); got != 0 {
+			t.Fatalf("round %d: %d bytes still charged after delete", round, got)
+		}
+	}
+}
+
+func TestQueueReadError(t *testing.T) {
+	*queueDir = t.TempDir()
+	defer func() { *queueDir = "" }()
+	registry := newRegistry()
+	e, _ := registry.create("unreadable", qcommon.QueueSettings{Kind: kindDisk})
+	defer registry.remove("unreadable")
+	e.enqueue([]byte("x"))
+	e.enqueue([]byte("y"))
+	e.enqueue([]byte("z"))
+	if err := os.Truncate(e.queue.(*diskQueue).path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.dequeue(); qrpc.CodeOf(err) != qrpc.Internal {
+		t.Errorf("dequeue: want Internal, got %v", err)
+	}
+	if _, _, err := e.peek(); qrpc.CodeOf(err) != qrpc.Internal {
+		t.Errorf("peek: want Internal, got %v", err)
+	}
+	if stats := e.stats("unreadable"); stats.Depth != 3 {
+		t.Errorf("unreadable message wasn't left queued: %+v", stats)
+	}
+
+	// a committed dequeue or purge removes what it can't read, as the
+	// nodes that can read it do
+	result := registry.applyCommand(clusterCommand{Op: commandDequeue, Queue: "unreadable"})
+	if result.ok || qrpc.CodeOf(result.err) != qrpc.Internal || e.stats("unreadable").Depth != 2 {
+		t.Errorf("committed dequeue: got %+v, depth %d", result, e.stats("unreadable").Depth)
+	}
+	result = registry.applyCommand(clusterCommand{Op: commandPurge, Queue: "unreadable"})
+	if result.purged != 2 || qrpc.CodeOf(result.err) != qrpc.Internal {
+		t.Errorf("committed purge: got %+v", result)
+	}
+	if stats := e.stats("unreadable"); stats.Depth != 0 || stats.Bytes != 0 {
+		t.Errorf("after committed purge: %+v", stats)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	registry := newRegistry()
+	registry.maxBytes = 100 + nodeOverhead
+	q, _ := registry.create("q", qcommon.QueueSettings{})
+
+	if err := q.enqueue(make([]byte, 100)); err != nil {
+		t.Fatalf("unexpected error within budget: %v", err)
+	}
+	if err := q.enqueue([]byte("x")); qrpc.CodeOf(err) != qrpc.ResourceExhausted {
+		t.Errorf("want ResourceExhausted, got %v", err)
+	}
+	if stats := q.stats("q"); stats.Depth != 1 {
+		t.Errorf("rejected object was queued: %+v", stats)
+	}
+	q.dequeue()
+	if err := q.enqueue([]byte("x")); err != nil {
+		t.Errorf("unexpected error after freeing memory: %v", err)
+	}
+}
+
+func TestRESTStats(t *testing.T) {
+	srv := restServer()
+	defer srv.Close()
+	url := srv.URL + "/v1/queues/statsq"
+	doRequest(t, "PUT", url, "", "")
+	defer doRequest(t, "DELETE", url, "", "")
+	doRequest(t, "POST", url + "/messages", qcommon.ObjectContentType, "12345")
+
+	resp, b := doRequest(t, "GET", url + "/stats", "", "")
+	var stats qcommon.QueueStats
+	if err := json.Unmarshal(b, &stats); resp.StatusCode != http.StatusOK || err != nil || stats.Depth != 1 || stats.Bytes != 5 + nodeOverhead {
+		t.Errorf("queue stats: got %d %s", resp.StatusCode, b)
+	}
+
+	resp, b = doRequest(t, "GET", srv.URL + "/v1/stats", "", "")
+	var server qcommon.ServerStats
+	if err := json.Unmarshal(b, &server); resp.StatusCode != http.StatusOK || err != nil || server.MemoryBytes < stats.Bytes {
+		t.Errorf("server stats: got %d %s", resp.StatusCode, b)
+	}
+}
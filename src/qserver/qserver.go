@@ -1,26 +1,65 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"qbinary"
 	"qcommon"
+	"qrpc"
+	"syscall"
+	"time"
 )
 
 var (
+	configFile = flag.String("config", "", "JSON file of flag values and queues to create; queues are reconfigured on SIGHUP")
 	port = flag.Int("port", 4242, "port to listen on")
-	verbose = flag.Bool("verbose", false, "verbose logging")
-	queues = map[string](*queue){}
+	grpcPort = flag.Int("grpc_port", 0, "port to serve the gRPC API on; 0 disables it")
+	binaryPort = flag.Int("binary_port", 0, "port to serve the binary protocol on; 0 disables it")
+	binarySocket = flag.String("binary_socket", "", "unix socket path to serve the binary protocol on")
+	verbose = flag.Bool("verbose", false, "log at debug level; same as --log_level=debug")
+	aclFile = flag.String("acl_file", "", "JSON policy of per-principal queue permissions; if set, it is enforced. Reloaded on SIGHUP")
+	tokenFile = flag.String("token_file", "", "file of \"<token> <principal>\" lines; if set, requests need a bearer token. Reloaded on SIGHUP")
+	tlsCert = flag.String("tls_cert", "", "PEM certificate; if set with --tls_key, TCP listeners use TLS")
+	tlsKey = flag.String("tls_key", "", "PEM private key for --tls_cert")
+	tlsClientCA = flag.String("tls_client_ca", "", "PEM CA bundle to verify client certificates against. A verified certificate's common name authenticates its principal")
+	tlsRequireClientCert = flag.Bool("tls_require_client_cert", false, "reject TLS clients without a certificate verified by --tls_client_ca")
+	clientRate = flag.Float64("client_rate", 0, "operations per second allowed to each principal or remote host; 0 is unlimited")
+	clientBurst = flag.Int("client_burst", 0, "operations a client may make at once; defaults to one second's worth")
+	enqueueRate = flag.Float64("enqueue_rate", 0, "default enqueues per second allowed on each queue; 0 is unlimited")
+	enqueueBurst = flag.Int("enqueue_burst", 0, "default enqueue burst size; defaults to one second's worth")
+	dequeueRate = flag.Float64("dequeue_rate", 0, "default dequeues per second allowed on each queue; 0 is unlimited")
+	dequeueBurst = flag.Int("dequeue_burst", 0, "default dequeue burst size; defaults to one second's worth")
+	maxMemory = flag.Int64("max_memory", 0, "bytes all queued objects may use before enqueues are rejected; 0 is unlimited")
+	queueKind = flag.String("queue_kind", "list", "default implementation of new queues: list, a lock-free linked list; slice, a growable ring buffer; channel, a bounded channel; ring, a bounded lock-free ring buffer; or disk, which keeps objects in --queue_dir")
+	queueCapacity = flag.Int("queue_capacity", 10000, "default number of messages a channel or ring queue holds")
+	queueDir = flag.String("queue_dir", "", "directory disk queues keep their objects in, discarded on restart; disk queues are unavailable if unset")
+	maxObjectSize = flag.Int64("max_object_size", 64 << 20, "largest object in bytes accepted by enqueue")
+	replication = flag.Bool("replication", false, "record mutations so that replicas can follow this server; serializes queue operations")
+	replicaOf = flag.String("replica_of", "", "host:port of a primary's HTTP API to replicate; this server is read-only until promoted")
+	replicaToken = flag.String("replica_token", "", "bearer token for --replica_of, which needs admin permission on every queue")
+	replicaTLSCA = flag.String("replica_tls_ca", "", "if set, connect to --replica_of over TLS trusting this PEM CA bundle")
+	clusterID = flag.String("cluster_id", "", "this server's id in --cluster_peers; if set, queue mutations are committed through a Raft log across the cluster")
+	clusterState = flag.String("cluster_state_file", "", "file this node keeps its Raft term and vote in; required with --cluster_id. The Raft log itself is kept in memory")
+	clusterPeers = flag.String("cluster_peers", "", "comma-separated id=host:port of every cluster node's HTTP API, this one included")
+	clusterToken = flag.String("cluster_token", "", "bearer token cluster nodes send each other, which needs admin permission on every queue; it also signs the requests they forward to the leader")
+	clusterTLSCA = flag.String("cluster_tls_ca", "", "if set, reach the other cluster nodes over TLS trusting this PEM CA bundle")
+	auditLogFile = flag.String("audit_log", "", "file to append a hash-chained record of queue creation, deletion, purges, reconfiguration and other admin actions to; check it with qctl verifyaudit")
+	shutdownDelay = flag.Duration("shutdown_delay", 0, "how long to keep serving after SIGTERM or SIGINT while /readyz reports not ready, so that load balancers stop sending requests before draining")
+	shutdownTimeout = flag.Duration("shutdown_timeout", 30 * time.Second, "how long in-flight requests may take to finish after SIGTERM or SIGINT")
+	queues = newRegistry()
+	acls *acl
+	audits *auditLog
+	clientLimits *clientLimiter
 )
 
-func vLog(format string, a ...interface{}) {
-	if *verbose {
-		log.Printf(format, a...)
-	}
-}
-
 // returns the form value for the given key, or an error message/http status code pair.
 func getFormValue(r *http.Request, key string) (string, int) {
 	if r.Method != "POST" {
@@ -44,14 +83,21 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, name, status)
 		return
 	}
+	annotate(r.Context(), "queue", name)
+	if !permitted(w, r, name, permCreate) || !admitted(w, r, name, nil) {
+		return
+	}
 
-	if _, present := queues[name]; present {
+	e, created, err := queues.commitCreate(r.Context(), name, qcommon.QueueSettings{})
+	if err != nil {
+		writeCommitError(w, r, err)
+		return
+	}
+	if !created {
 		http.Error(w, "Queue already exists", http.StatusConflict)
 		return
 	}
-
-	vLog("creating queue %q", name)
-	queues[name] = newQueue()
+	audits.record(r.Context(), qcommon.AuditCreateQueue, name, e.settings())
 
 	idData := qcommon.IdData{Id: qcommon.QueueId(name)}
 	b, err := json.Marshal(idData)
@@ -69,13 +115,16 @@ func getHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, name, status)
 		return
 	}
+	annotate(r.Context(), "queue", name)
+	if !permitted(w, r, name, allPermissions...) || !admitted(w, r, name, nil) {
+		return
+	}
 
-	if _, present := queues[name]; !present {
+	if _, present := queues.get(name); !present {
 		http.Error(w, "Queue doesn't exist", http.StatusNotFound)
 		return
 	}
 
-	vLog("getting queue %q", name)
 	idData := qcommon.IdData{Id: qcommon.QueueId(name)}
 	b, err := json.Marshal(idData)
 	if err != nil {
@@ -92,14 +141,22 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, id, status)
 		return
 	}
+	annotate(r.Context(), "queue", id)
+	if !permitted(w, r, id, permDelete) || !admitted(w, r, id, nil) {
+		return
+	}
 
-	if _, present := queues[id]; !present {
+	removed, err := queues.commitRemove(r.Context(), id)
+	if err != nil {
+		writeCommitError(w, r, err)
+		return
+	}
+	if !removed {
 		http.Error(w, "Queue doesn't exist", http.StatusNotFound)
 		return
 	}
+	audits.record(r.Context(), qcommon.AuditDeleteQueue, id, nil)
 
-	vLog("deleting queue %q", id)
-	delete(queues, id)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -109,21 +166,43 @@ func enqueueHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, id, status)
 		return
 	}
+	annotate(r.Context(), "queue", id)
+	if !permitted(w, r, id, permEnqueue) {
+		return
+	}
 
-	q, present := queues[id];
+	q, present := queues.get(id)
 	if !present {
 		http.Error(w, fmt.Sprintf("Queue %q doesn't exist", id), http.StatusNotFound)
 		return
 	}
+	if !admitted(w, r, id, q.enqueueLimit()) {
+		return
+	}
 
-	// TODO: extend getFormValue to take a slice of keys 
-	if len(r.Form["object"]) == 0 {
-		http.Error(w, "Missing object field", http.StatusBadRequest)
+	var object []byte
+	if isRawObject(r.Header.Get("Content-Type")) {
+		var msg string
+		if object, msg, status = readObject(w, r); status != http.StatusOK {
+			http.Error(w, msg, status)
+			return
+		}
+	} else {
+		// TODO: extend getFormValue to take a slice of keys 
+		if len(r.Form["object"]) == 0 {
+			http.Error(w, "Missing object field", http.StatusBadRequest)
+			return
+		}
+		object = []byte(r.Form["object"][0])
+		if int64(len(object)) > *maxObjectSize {
+			http.Error(w, fmt.Sprintf("Object exceeds %d bytes", *maxObjectSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	if err := q.commitEnqueue(r.Context(), object); err != nil {
+		writeCommitError(w, r, err)
 		return
 	}
-	object := r.Form["object"][0]
-	vLog("enqueue %q %q", id, object)
-	q.enqueue([]byte(object))
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -133,19 +212,33 @@ func dequeueHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, id, status)
 		return
 	}
+	annotate(r.Context(), "queue", id)
+	if !permitted(w, r, id, permDequeue) {
+		return
+	}
 
-	q, present := queues[id];
+	q, present := queues.get(id)
 	if !present {
 		http.Error(w, fmt.Sprintf("Queue %q doesn't exist", id), http.StatusNotFound)
 		return
 	}
-	object, valid := q.dequeue()
+	if !admitted(w, r, id, q.dequeueLimit()) {
+		return
+	}
+	object, valid, err := q.commitDequeue(r.Context())
+	if err != nil {
+		writeCommitError(w, r, err)
+		return
+	}
 	if !valid {
 		http.Error(w, "Attempt to dequeue from empty queue", http.StatusNotFound)
 		return
 	}
 
-	vLog("dequeue %q %q", id, object)
+	if wantsRawObject(r) {
+		writeObject(w, qcommon.QueueId(id), object)
+		return
+	}
 
 	idObjectData := qcommon.IdObjectData{
 		Id:	qcommon.QueueId(id),
@@ -166,7 +259,262 @@ func main() {
 	http.HandleFunc("/delete", deleteHandler)
 	http.HandleFunc("/enqueue", enqueueHandler)
 	http.HandleFunc("/dequeue", dequeueHandler)
+	registerRESTHandlers(http.DefaultServeMux)
 
 	flag.Parse()
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+
+	var cfg *config
+	if *configFile != "" {
+		var err error
+		if cfg, err = loadConfig(*configFile); err != nil {
+			fatal("loading config failed", "error", err)
+		}
+		if err := cfg.applyFlags(); err != nil {
+			fatal("loading config failed", "error", err)
+		}
+	}
+	if err := setupLogging(os.Stderr); err != nil {
+		fatal("configuring logging failed", "error", err)
+	}
+	if *auditLogFile != "" {
+		var err error
+		if audits, err = openAuditLog(*auditLogFile); err != nil {
+			fatal("opening audit log failed", "error", err)
+		}
+		logger.Info("appending to audit log", "file", *auditLogFile, "seq", audits.last.Seq, "hash", audits.last.Hash)
+	}
+
+	var tokens *tokenStore
+	if *tokenFile != "" {
+		var err error
+		if tokens, err = loadTokens(*tokenFile); err != nil {
+			fatal("loading tokens failed", "error", err)
+		}
+	}
+	if *aclFile != "" {
+		var err error
+		if acls, err = loadACL(*aclFile); err != nil {
+			fatal("loading acls failed", "error", err)
+		}
+	}
+
+	if err := checkSettings(withDefaultSettings(qcommon.QueueSettings{})); err != nil {
+		fatal("invalid --queue_kind", "error", err)
+	}
+	if *queueDir != "" {
+		if err := os.MkdirAll(*queueDir, 0700); err != nil {
+			fatal("creating --queue_dir failed", "error", err)
+		}
+	}
+
+	clientLimits = newClientLimiter(*clientRate, *clientBurst)
+	queues.maxBytes = *maxMemory
+	if *replication || *replicaOf != "" {
+		// replicas record too, so that they can serve replicas once promoted
+		queues.journal = newJournal()
+	}
+	if *clusterID != "" {
+		if *replication || *replicaOf != "" {
+			fatal("--cluster_id can't be combined with --replication or --replica_of")
+		}
+		addrs, err := parseClusterPeers(*clusterPeers)
+		if err != nil {
+			fatal("parsing --cluster_peers failed", "error", err)
+		}
+		if _, present := addrs[*clusterID]; !present {
+			fatal("--cluster_id isn't in --cluster_peers", "cluster_id", *clusterID)
+		}
+		// without it a restarted node could vote twice in one election
+		if *clusterState == "" {
+			fatal("--cluster_id needs --cluster_state_file")
+		}
+		scheme, client := "http", http.DefaultClient
+		if *clusterTLSCA != "" {
+			config, err := qcommon.ClientTLSConfig(*clusterTLSCA, "", "")
+			if err != nil {
+				fatal("loading --cluster_tls_ca failed", "error", err)
+			}
+			scheme, client = "https", &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		}
+		if _, err := newCluster(*clusterID, addrs, *clusterState, scheme, *clusterToken, client, queues); err != nil {
+			fatal("joining cluster failed", "error", err)
+		}
+		logger.Info("joined cluster", "peers", *clusterPeers, "cluster_id", *clusterID)
+		if cfg != nil && len(cfg.queues) > 0 {
+			logger.Info("send SIGHUP to the cluster leader to configure the config file's queues", "config", *configFile)
+		}
+	} else if *replicaOf != "" {
+		scheme, client := "http", http.DefaultClient
+		if *replicaTLSCA != "" {
+			config, err := qcommon.ClientTLSConfig(*replicaTLSCA, "", "")
+			if err != nil {
+				fatal("loading --replica_tls_ca failed", "error", err)
+			}
+			scheme, client = "https", &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		}
+		following.Store(startFollower(*replicaOf, scheme + "://" + *replicaOf, *replicaToken, client, queues))
+		logger.Info("replicating", "primary", *replicaOf)
+	} else if cfg != nil {
+		cfg.applyQueues(queues)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if tokens != nil {
+				if err := tokens.reload(); err != nil {
+					logger.Error("reloading tokens failed", "error", err)
+				} else {
+					logger.Info("reloaded tokens", "file", *tokenFile)
+				}
+			}
+			if acls != nil {
+				if err := acls.reload(); err != nil {
+					logger.Error("reloading acls failed", "error", err)
+				} else {
+					logger.Info("reloaded acls", "file", *aclFile)
+				}
+			}
+			if cfg != nil {
+				var err error
+				if cfg, err = cfg.reload(queues); err != nil {
+					logger.Error("reloading config failed", "error", err)
+				} else {
+					logger.Info("reloaded config", "file", *configFile)
+				}
+			}
+		}
+	}()
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		var err error
+		if tlsConfig, err = qcommon.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert); err != nil {
+			fatal("loading TLS config failed", "error", err)
+		}
+	}
+
+	var servers []func(context.Context) error
+	if *grpcPort != 0 {
+		l, err := listenTCP(*grpcPort, tlsConfig, "h2")
+		if err != nil {
+			fatal("listening for gRPC failed", "error", err)
+		}
+		grpcServer := qrpc.NewHTTPServer(loggedService{service{queues}, "grpc"})
+		grpcServer.Handler = authenticate(tokens, grpcServer.Handler)
+		serve(func() error { return grpcServer.Serve(l) })
+		readiness.listening(fmt.Sprintf("grpc :%d", *grpcPort))
+		servers = append(servers, grpcServer.Shutdown)
+	}
+
+	binaryServer := qbinary.NewServer(loggedService{service{queues}, "binary"})
+	if tokens != nil {
+		binaryServer.Authenticate = tokens.principal
+	}
+	servers = append(servers, binaryServer.Shutdown)
+	if *binaryPort != 0 {
+		l, err := listenTCP(*binaryPort, tlsConfig)
+		if err != nil {
+			fatal("listening for the binary protocol failed", "error", err)
+		}
+		serve(func() error { return binaryServer.Serve(l) })
+		readiness.listening(fmt.Sprintf("binary :%d", *binaryPort))
+	}
+	if *binarySocket != "" {
+		os.Remove(*binarySocket)
+		l, err := net.Listen("unix", *binarySocket)
+		if err != nil {
+			fatal("listening for the binary protocol failed", "error", err)
+		}
+		defer os.Remove(*binarySocket)
+		serve(func() error { return binaryServer.Serve(l) })
+		readiness.listening("binary " + *binarySocket)
+	}
+
+	l, err := listenTCP(*port, tlsConfig, "h2", "http/1.1")
+	if err != nil {
+		fatal("listening for HTTP failed", "error", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dashboard", dashboardHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.Handle("/", authenticate(tokens, clusterProxy(replicaGuard(http.DefaultServeMux))))
+	httpServer := &http.Server{Handler: logRequests(mux)}
+	if queues.journal != nil {
+		// end replication streams, which would otherwise hold shutdown open
+		httpServer.RegisterOnShutdown(queues.journal.close)
+	}
+	serve(func() error { return httpServer.Serve(l) })
+	readiness.listening(fmt.Sprintf("http :%d", *port))
+	readiness.start()
+	servers = append(servers, httpServer.Shutdown, func(context.Context) error {
+		if f := following.Load(); f != nil {
+			f.stop()
+		}
+		return nil
+	})
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	signal.Stop(stop)
+	readiness.drain()
+	if *shutdownDelay > 0 {
+		logger.Info("shutting down; reporting not ready", "signal", sig.String(), "delay", *shutdownDelay)
+		time.Sleep(*shutdownDelay)
+	}
+	logger.Info("shutting down; draining in-flight requests", "signal", sig.String(), "timeout", *shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := shutdown(ctx, servers...); err != nil {
+		logger.Warn("in-flight requests aborted", "error", err)
+	}
+	if c := queues.cluster; c != nil {
+		c.stop()
+	}
+	audits.close()
+	logger.Info("shut down")
+}
+
+// serve runs a server's serve loop in the background, exiting the process if
+// it fails other than by being shut down.
+func serve(serve func() error) {
+	go func() {
+		if err := serve(); !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			fatal("serving failed", "error", err)
+		}
+	}()
+}
+
+// shutdown stops servers concurrently, waiting for their in-flight requests
+// until ctx expires. It returns the first error.
+func shutdown(ctx context.Context, servers ...func(context.Context) error) error {
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s func(context.Context) error) {
+			errs <- s(ctx)
+		}(s)
+	}
+	var first error
+	for range servers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// listenTCP listens on port, over TLS if config is set. protos are offered in
+// ALPN.
+func listenTCP(port int, config *tls.Config, protos ...string) (net.Listener, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil || config == nil {
+		return l, err
+	}
+	config = config.Clone()
+	config.NextProtos = protos
+	return tls.NewListener(l, config), nil
 }
@@ -1,40 +1,165 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"qcommon"
 	"sync/atomic"
 	"unsafe"
 )
 
-type node struct {
+// Queue is a FIFO of messages safe for concurrent use. The server programs
+// against it, keeping its own accounting in entry, so that each queue can be
+// backed by the implementation its settings choose.
+type Queue interface {
+	// enqueue appends m, failing with errFull if the queue is bounded and
+	// at capacity.
+	enqueue(m message) error
+	// dequeue removes and returns the message at the head. Returns false if
+	// the queue is empty, and an error if the message couldn't be read from
+	// where the queue keeps it, leaving it queued.
+	dequeue() (message, bool, error)
+	// peek returns the message at the head without removing it. Returns
+	// false if the queue is empty, and an error as dequeue does.
+	peek() (message, bool, error)
+	// walk calls visit with each message from the head, without dequeuing
+	// any, until visit returns false. Messages enqueued or dequeued
+	// meanwhile may or may not be visited.
+	walk(visit func(message) bool)
+	// cost is the memory, in bytes, the queue uses to hold object.
+	cost(object []byte) int64
+	// close discards the queue's messages and releases what holds them.
+	close() error
+}
+
+// discarder is a Queue whose dequeue can fail to read the head. discard
+// removes the head regardless, returning it without its object, or false if
+// the queue is empty.
+type discarder interface {
+	discard() (message, bool)
+}
+
+// Queue kinds, chosen by qcommon.QueueSettings.Kind.
+const (
+	kindList = "list"
+	kindSlice = "slice"
+	kindChannel = "channel"
+	kindDisk = "disk"
+	kindRing = "ring"
+)
+
+// errFull is returned by bounded queues' enqueue when they are at capacity.
+var errFull = errors.New("queue is full")
+
+// message is an object in a queue with its enqueue time and id.
+type message struct {
 	object	[]byte
+	enqueuedAt	int64	// unix nanoseconds
+	id	int64	// increases with each enqueue from 1; 0 if unnumbered
+}
+
+// newQueue returns an empty queue named name of the kind settings choose.
+// Settings that fail checkSettings, as a primary's or cluster leader's may
+// on a differently configured server, get a list queue.
+func newQueue(name string, settings qcommon.QueueSettings) Queue {
+	if err := checkSettings(settings); err != nil {
+		logger.Warn("creating a list queue instead", "queue", name, "error", err)
+		return newListQueue()
+	}
+	switch settings.Kind {
+	case kindSlice:
+		return newSliceQueue(settings.Capacity)
+	case kindChannel:
+		return newChannelQueue(settings.Capacity)
+	case kindRing:
+		return newRingQueue(settings.Capacity)
+	case kindDisk:
+		return newDiskQueue(diskQueuePath(name))
+	}
+	return newListQueue()
+}
+
+// checkSettings rejects settings no queue could be created with on this
+// server.
+func checkSettings(settings qcommon.QueueSettings) error {
+	if err := checkKind(settings); err != nil {
+		return err
+	}
+	if settings.Kind == kindDisk && *queueDir == "" {
+		return fmt.Errorf("disk queues need the server to be run with --queue_dir")
+	}
+	return nil
+}
+
+// checkKind rejects settings no queue could be created with on any server.
+func checkKind(settings qcommon.QueueSettings) error {
+	if settings.Capacity < 0 {
+		return fmt.Errorf("negative capacity %d", settings.Capacity)
+	}
+	switch settings.Kind {
+	case "", kindList, kindDisk:
+		if settings.Capacity != 0 {
+			return fmt.Errorf("%s queues are unbounded and take no capacity", kindOf(settings))
+		}
+	case kindSlice:
+	case kindChannel:
+		if settings.Capacity <= 0 {
+			return fmt.Errorf("channel queues need a capacity")
+		}
+	case kindRing:
+		// a cell published for one lap must not look free for the next
+		if settings.Capacity < 2 {
+			return fmt.Errorf("ring queues need a capacity of at least 2")
+		}
+	default:
+		return fmt.Errorf("unknown queue kind %q; want list, slice, channel, ring or disk", settings.Kind)
+	}
+	return nil
+}
+
+// kindOf returns the kind of queue settings choose.
+func kindOf(settings qcommon.QueueSettings) string {
+	if settings.Kind == "" {
+		return kindList
+	}
+	return settings.Kind
+}
+
+type node struct {
+	message
 	next	*node
 }
 
-type queue struct {
+// listQueue is the Michael-Scott lock-free linked list. It is unbounded.
+type listQueue struct {
 	dummy	*node
 	tail	*node
 }
 
-func newQueue() *queue {
-	q := new(queue)
+// nodeOverhead is charged per object on top of its length, for the list node
+// that holds it.
+const nodeOverhead = int64(unsafe.Sizeof(node{}))
+
+func newListQueue() *listQueue {
+	q := new(listQueue)
 	q.dummy = new(node)
 	q.tail = q.dummy
 	return q
 }
 
-// atomically enqueue a byte slice
-func (q *queue) enqueue(object []byte) {
+// atomically enqueue a message
+func (q *listQueue) enqueue(m message) error {
 	newNode := new(node)
-	newNode.object = object
+	newNode.message = m
 
 	added := false
 
 	var oldTail *node
 	for !added {
-		oldTail = q.tail
-		oldTailNext := oldTail.next
+		oldTail = load(&q.tail)
+		oldTailNext := oldTail.following()
 
-		if q.tail != oldTail {
+		if load(&q.tail) != oldTail {
 			continue
 		}
 
@@ -47,32 +172,72 @@ func (q *queue) enqueue(object []byte) {
 	}
 
 	atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&q.tail)), unsafe.Pointer(oldTail), unsafe.Pointer(newNode))
+	return nil
 }
 
-// atomically dequeue a byte slice. Returns nil, false if the queue is empty.
-func (q *queue) dequeue() ([]byte, bool) {
-	var object []byte
+// atomically dequeue the message at the head of the queue. Returns false if
+// the queue is empty.
+func (q *listQueue) dequeue() (message, bool, error) {
+	var head *node
 	removed := false
 
 	for !removed {
-		oldDummy := q.dummy
-		oldHead := oldDummy.next
-		oldTail := q.tail
+		oldDummy := load(&q.dummy)
+		oldHead := oldDummy.following()
+		oldTail := load(&q.tail)
 
-		if q.dummy != oldDummy {
+		if load(&q.dummy) != oldDummy {
 			continue
 		}
 
 		if oldHead == nil {
-			return nil, false
+			return message{}, false, nil
 		}
 
 		if oldTail == oldDummy {
 			atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&q.tail)), unsafe.Pointer(oldTail), unsafe.Pointer(oldHead))
 			continue
 		}
-		object = oldHead.object
+		head = oldHead
 		removed = atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&q.dummy)), unsafe.Pointer(oldDummy), unsafe.Pointer(oldHead))
 	}
-	return object, true
+	return head.message, true, nil
+}
+
+// returns the node at the head of the queue, or nil if the queue is empty.
+func (q *listQueue) head() *node {
+	return load(&q.dummy).following()
+}
+
+// atomically load a node pointer that others may swap
+func load(p **node) *node {
+	return (*node)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(p))))
+}
+
+// returns the node after n, or nil if n is the tail. Following nodes from
+// head() visits every message without dequeuing any; ones dequeued meanwhile
+// are still visited.
+func (n *node) following() *node {
+	return load(&n.next)
+}
+
+func (q *listQueue) peek() (message, bool, error) {
+	head := q.head()
+	if head == nil {
+		return message{}, false, nil
+	}
+	return head.message, true, nil
+}
+
+func (q *listQueue) walk(visit func(message) bool) {
+	for n := q.head(); n != nil && visit(n.message); n = n.following() {
+	}
+}
+
+func (q *listQueue) cost(object []byte) int64 {
+	return int64(len(object)) + nodeOverhead
+}
+
+func (q *listQueue) close() error {
+	return nil
 }
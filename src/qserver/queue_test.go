@@ -3,16 +3,51 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"testing"
 )
 
-var (
-	q *queue
-	data []string
+// The conformance tests run against every Queue implementation.
 
-	count = flag.Int("count", 10000, "number of concurrent read/writes")
-)
+var count = flag.Int("count", 10000, "number of concurrent read/writes")
+
+// queueKinds makes empty queues of each kind, bounded ones with room for
+// capacity messages.
+func queueKinds(tb testing.TB, capacity int) map[string]func() Queue {
+	dir := tb.TempDir()
+	var files int
+	return map[string]func() Queue{
+		"list":	func() Queue { return newListQueue() },
+		"slice":	func() Queue { return newSliceQueue(0) },
+		"bounded slice":	func() Queue { return newSliceQueue(capacity) },
+		"channel":	func() Queue { return newChannelQueue(capacity) },
+		"ring":	func() Queue { return newRingQueue(capacity) },
+		"disk": func() Queue {
+			files++
+			return newDiskQueue(filepath.Join(dir, fmt.Sprintf("%d.queue", files)))
+		},
+	}
+}
+
+// forEachKind runs test against a fresh queue of each kind.
+func forEachKind(t *testing.T, test func(t *testing.T, q Queue)) {
+	for kind, newQ := range queueKinds(t, *count) {
+		t.Run(kind, func(t *testing.T) {
+			q := newQ()
+			defer q.close()
+			test(t, q)
+		})
+	}
+}
+
+func enqueueString(t testing.TB, q Queue, s string) {
+	if err := q.enqueue(message{object: []byte(s)}); err != nil {
+		t.Errorf("enqueuing %q: %v", s, err)
+	}
+}
 
 func contains(arr []string, s string) bool {
 	for _, a := range arr {
@@ -24,185 +59,431 @@ func contains(arr []string, s string) bool {
 }
 
 func TestSingleGoroutine(t *testing.T) {
-	q = newQueue()
+	forEachKind(t, func(t *testing.T, q Queue) {
+		got1 := message{object: []byte("abcdef"), enqueuedAt: 100, id: 1}
+		got2 := message{object: []byte("ghijkl"), enqueuedAt: 200, id: 2}
 
-	got1 := "abcdef"
-	got2 := "ghijkl"
+		q.enqueue(got1)
+		q.enqueue(got2)
 
-	q.enqueue([]byte(got1))
-	q.enqueue([]byte(got2))
+		if want, ok, _ := q.dequeue(); !ok || string(want.object) != "abcdef" || want.enqueuedAt != 100 || want.id != 1 {
+			t.Errorf("want %+v, got %+v", want, got1)
+		}
 
-	if want, ok := q.dequeue(); !ok || string(want) != got1 {
-		t.Errorf("want %q, got %q", want, got1)
-	}
+		if want, ok, _ := q.dequeue(); !ok || string(want.object) != "ghijkl" || want.enqueuedAt != 200 || want.id != 2 {
+			t.Errorf("want %+v, got %+v", want, got2)
+		}
 
-	if want, ok := q.dequeue(); !ok || string(want) != got2 {
-		t.Errorf("want %q, got %q", want, got2)
-	}
+		if _, ok, _ := q.dequeue(); ok {
+			t.Errorf("Expected empty queue")
+		}
+	})
 }
 
-func TestEnqueue(t *testing.T) {
-	var waitgroup sync.WaitGroup
-	for i := 0; i < *count; i++ {
-		s := fmt.Sprintf("%d", i)
-		data = append(data, s)
-		waitgroup.Add(1)
-		go func() {
-			q.enqueue([]byte(s))
-			waitgroup.Done()
-		}()
-	}
-	waitgroup.Wait()
+func TestEnqueueThenDequeue(t *testing.T) {
+	forEachKind(t, func(t *testing.T, q Queue) {
+		var data []string
+		var waitgroup sync.WaitGroup
+		for i := 0; i < *count; i++ {
+			s := fmt.Sprintf("%d", i)
+			data = append(data, s)
+			waitgroup.Add(1)
+			go func() {
+				enqueueString(t, q, s)
+				waitgroup.Done()
+			}()
+		}
+		waitgroup.Wait()
+
+		results := make([]string, *count)
+		for i := 0; i < *count; i++ {
+			waitgroup.Add(1)
+			go func(s *string) {
+				defer waitgroup.Done()
+				m, ok, _ := q.dequeue()
+				if !ok {
+					t.Errorf("Unexpected empty queue")
+					return
+				}
+				*s = string(m.object)
+			}(&results[i])
+		}
+
+		waitgroup.Wait()
+		seen := map[string]bool{}
+		for _, s := range results {
+			if !contains(data, s) || seen[s] {
+				t.Errorf("%q was not enqueued, or was dequeued twice", s)
+				return
+			}
+			seen[s] = true
+		}
+
+		if _, ok, _ := q.dequeue(); ok {
+			t.Errorf("Expected empty queue")
+		}
+	})
 }
 
-func BenchmarkEnqueue(b *testing.B) {
-	bmData := make([]string, b.N)
-	for i := 0; i < b.N; i++ {
-		bmData[i] = fmt.Sprintf("%d", i)
-	}
-	var waitgroup sync.WaitGroup
-	waitgroup.Add(b.N)
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		go func(i int) {
-			q.enqueue([]byte(bmData[i]))
-			waitgroup.Done()
-		}(i)
-	}
-	waitgroup.Wait()
+func TestEnqueueDequeue(t *testing.T) {
+	forEachKind(t, func(t *testing.T, q Queue) {
+		var waitgroup sync.WaitGroup
+		waitgroup.Add(2 * *count)
+		for i := 0; i < *count; i++ {
+			go func(i int) {
+				enqueueString(t, q, fmt.Sprintf("%d", i))
+				waitgroup.Done()
+			}(i)
+			// dequeuers may run before the enqueues they're matched with
+			go func() {
+				for _, ok, _ := q.dequeue(); !ok; _, ok, _ = q.dequeue() {
+					runtime.Gosched()
+				}
+				waitgroup.Done()
+			}()
+		}
+		waitgroup.Wait()
+
+		if _, ok, _ := q.dequeue(); ok {
+			t.Errorf("expected empty queue")
+		}
+	})
 }
 
-func TestDequeue(t *testing.T) {
-	var waitgroup sync.WaitGroup
+func TestFIFO(t *testing.T) {
+	forEachKind(t, func(t *testing.T, q Queue) {
+		// each producer's messages stay in order among the others'
+		const producers = 4
+		var waitgroup sync.WaitGroup
+		for p := 0; p < producers; p++ {
+			waitgroup.Add(1)
+			go func(p int) {
+				for i := 0; i < *count / producers; i++ {
+					enqueueString(t, q, fmt.Sprintf("%d %d", p, i))
+				}
+				waitgroup.Done()
+			}(p)
+		}
+		waitgroup.Wait()
 
-	var results []*string
-	for i := 0; i < *count; i++ {
-		s := new(string)
-		results = append(results, s)
+		next := make([]int, producers)
+		for m, ok, _ := q.dequeue(); ok; m, ok, _ = q.dequeue() {
+			var p, i int
+			fmt.Sscanf(string(m.object), "%d %d", &p, &i)
+			if i != next[p] {
+				t.Fatalf("producer %d: got message %d, want %d", p, i, next[p])
+			}
+			next[p]++
+		}
+	})
+}
 
-		waitgroup.Add(1)
-		go func(s *string) {
-			b, ok := q.dequeue()
-			if !ok {
-				t.Errorf("Unexpected empty queue")
-				return
+func TestPeek(t *testing.T) {
+	forEachKind(t, func(t *testing.T, q Queue) {
+		if _, ok, _ := q.peek(); ok {
+			t.Errorf("peeked into an empty queue")
+		}
+		enqueueString(t, q, "a")
+		enqueueString(t, q, "b")
+		for i := 0; i < 2; i++ {
+			if m, ok, _ := q.peek(); !ok || string(m.object) != "a" {
+				t.Errorf("peek %d: got %q, %v", i, m.object, ok)
 			}
-			*s = string(b)
-			waitgroup.Done()
-		}(s)
-	}
+		}
+		q.dequeue()
+		if m, ok, _ := q.peek(); !ok || string(m.object) != "b" {
+			t.Errorf("peek after dequeue: got %q, %v", m.object, ok)
+		}
+	})
+}
 
-	waitgroup.Wait()
-	for i := 0; i < *count; i++ {
-		s := *(results[i])
-		if !contains(data, *(results[i])) {
-			t.Errorf("%q was not enqueue", s)
-			return
+func TestWalk(t *testing.T) {
+	forEachKind(t, func(t *testing.T, q Queue) {
+		for _, s := range []string{"a", "b", "c"} {
+			enqueueString(t, q, s)
 		}
-	}
+		q.dequeue()
+		enqueueString(t, q, "d")
 
-	if _, ok := q.dequeue(); ok {
-		t.Errorf("Expected empty queue")
+		var walked string
+		q.walk(func(m message) bool {
+			walked += string(m.object)
+			return true
+		})
+		if walked != "bcd" {
+			t.Errorf("walked %q, want bcd", walked)
+		}
+
+		walked = ""
+		q.walk(func(m message) bool {
+			walked += string(m.object)
+			return len(walked) < 2
+		})
+		if walked != "bc" {
+			t.Errorf("walk stopped after %q, want bc", walked)
+		}
+		if m, ok, _ := q.dequeue(); !ok || string(m.object) != "b" {
+			t.Errorf("walking dequeued: got %q", m.object)
+		}
+	})
+}
+
+func TestBounded(t *testing.T) {
+	for kind, q := range map[string]Queue{"bounded slice": newSliceQueue(3), "channel": newChannelQueue(3), "ring": newRingQueue(3)} {
+		for i := 0; i < 3; i++ {
+			enqueueString(t, q, "x")
+		}
+		if err := q.enqueue(message{object: []byte("y")}); err != errFull {
+			t.Errorf("%s: enqueuing past capacity: got %v, want errFull", kind, err)
+		}
+		q.dequeue()
+		if err := q.enqueue(message{object: []byte("y")}); err != nil {
+			t.Errorf("%s: enqueuing after a dequeue: %v", kind, err)
+		}
 	}
 }
 
-// NOTE: this is a potentially long-running test. Best to run under short times.
-func BenchmarkDequeue(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		q.enqueue([]byte(fmt.Sprintf("%d", i)))
+func TestDiskQueueFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.queue")
+	q := newDiskQueue(path)
+	enqueueString(t, q, "abc")
+	enqueueString(t, q, "de")
+	if info, err := os.Stat(path); err != nil || info.Size() != 5 {
+		t.Fatalf("file holds %v, %v; want 5 bytes", info, err)
+	}
+	if cost := q.cost(make([]byte, 1 << 20)); cost != recordOverhead {
+		t.Errorf("charged %d bytes of memory for an object on disk", cost)
 	}
+	q.dequeue()
+	q.dequeue()
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Errorf("emptied queue's file holds %v, %v", info, err)
+	}
+	enqueueString(t, q, "f")
+	q.close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("closed queue's file remains: %v", err)
+	}
+	if err := q.enqueue(message{object: []byte("g")}); err == nil {
+		t.Errorf("enqueued to a closed queue")
+	}
+}
 
-	var waitgroup sync.WaitGroup
-	waitgroup.Add(b.N)
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		go func() {
-			q.dequeue()
-			waitgroup.Done()
-		}()
+// forEachKindB runs a benchmark against a fresh queue of each kind, bounded
+// ones with room for every message it enqueues.
+func forEachKindB(b *testing.B, bench func(b *testing.B, q Queue)) {
+	for _, kind := range []string{"list", "slice", "bounded slice", "channel", "ring", "disk"} {
+		b.Run(kind, func(b *testing.B) {
+			q := queueKinds(b, b.N)[kind]()
+			b.ReportAllocs()
+			defer q.close()
+			bench(b, q)
+		})
 	}
-	waitgroup.Wait()
 }
 
-func TestEnqueueDequeue(t *testing.T) {
-	enq := make(chan int)
-	deq := make(chan int)
-
-	for i := 0; i < 2 * *count; i++ {
-		go func(i int) {
-			if i % 2 == 0 {
-				q.enqueue([]byte(data[i/2]))
-				enq <- 1
-				if (i/2)+1 == *count {
-					enq <- -1
-				}
-			} else {
-				if _, ok := q.dequeue(); ok {
-					deq <- 1
+func BenchmarkEnqueue(b *testing.B) {
+	forEachKindB(b, func(b *testing.B, q Queue) {
+		bmData := make([]string, b.N)
+		for i := 0; i < b.N; i++ {
+			bmData[i] = fmt.Sprintf("%d", i)
+		}
+		var waitgroup sync.WaitGroup
+		waitgroup.Add(b.N)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			go func(i int) {
+				q.enqueue(message{object: []byte(bmData[i])})
+				waitgroup.Done()
+			}(i)
+		}
+		waitgroup.Wait()
+	})
+}
+
+// NOTE: this is a potentially long-running benchmark. Best to run under short times.
+func BenchmarkDequeue(b *testing.B) {
+	forEachKindB(b, func(b *testing.B, q Queue) {
+		for i := 0; i < b.N; i++ {
+			q.enqueue(message{object: []byte(fmt.Sprintf("%d", i))})
+		}
+
+		var waitgroup sync.WaitGroup
+		waitgroup.Add(b.N)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			go func() {
+				q.dequeue()
+				waitgroup.Done()
+			}()
+		}
+		waitgroup.Wait()
+	})
+}
+
+func BenchmarkEnqueueDequeue(b *testing.B) {
+	forEachKindB(b, func(b *testing.B, q Queue) {
+		bmData := make([]string, b.N)
+		for i := 0; i < b.N; i++ {
+			bmData[i] = fmt.Sprintf("%d", i)
+		}
+		var waitgroup sync.WaitGroup
+		waitgroup.Add(2 * b.N)
+		b.ResetTimer()
+		for i := 0; i < 2 * b.N; i++ {
+			go func(i int) {
+				if i % 2 == 0 {
+					q.enqueue(message{object: []byte(bmData[i/2])})
 				} else {
-					deq <- 0
+					q.dequeue()
 				}
-				if (i/2)+1 == *count {
-					deq <- -1
-				}
-			}
-		}(i)
-	}
-
-	var enqCount, deqCount int
-	enqEnd, deqEnd := false, false
+				waitgroup.Done()
+			}(i)
+		}
+		waitgroup.Wait()
+	})
+}
 
-	for !(enqEnd && deqEnd) {
-		select {
-		case i := <-enq:
-			if i < 0 {
-				enqEnd = true
-			} else {
-				enqCount += i
-			}
-		case i := <-deq:
-			if i < 0 {
-				deqEnd = true
-			} else {
-				deqCount += i
+// BenchmarkParallel has each goroutine enqueue and dequeue in turn, which
+// without a goroutine per operation shows what the queues allocate.
+func BenchmarkParallel(b *testing.B) {
+	object := []byte("object")
+	forEachKindB(b, func(b *testing.B, q Queue) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				q.enqueue(message{object: object})
+				q.dequeue()
 			}
+		})
+	})
+}
+
+func TestChannelQueuePeek(t *testing.T) {
+	q := newChannelQueue(2)
+	enqueueString(t, q, "a")
+	if m, ok, _ := q.peek(); !ok || string(m.object) != "a" {
+		t.Fatalf("peeked %q, %v", m.object, ok)
+	}
+	// the peeked head, outside the channel, still counts against capacity
+	enqueueString(t, q, "b")
+	if err := q.enqueue(message{object: []byte("c")}); err != errFull {
+		t.Errorf("enqueuing past capacity: got %v, want errFull", err)
+	}
+	if len(q.ch) != 1 {
+		t.Errorf("peek left %d messages in the channel, want 1", len(q.ch))
+	}
+	for _, want := range []string{"a", "b"} {
+		if m, ok, _ := q.dequeue(); !ok || string(m.object) != want {
+			t.Errorf("dequeued %q, %v; want %q", m.object, ok, want)
 		}
 	}
+}
 
-	if enqCount != *count {
-		t.Errorf("%d enqueue operations failed", *count - enqCount)
-		return
+func TestDiskQueueCompaction(t *testing.T) {
+	diskCompactBytes = 4
+	defer func() { diskCompactBytes = 64 << 20 }()
+	path := filepath.Join(t.TempDir(), "q.queue")
+	q := newDiskQueue(path)
+	defer q.close()
+	for _, s := range []string{"aa", "bb", "cc", "dd", "ee"} {
+		enqueueString(t, q, s)
 	}
-
-	if deqCount != *count {
-		t.Errorf("%d dequeue operations failed", *count - deqCount)
-		return
+	q.dequeue()
+	q.dequeue()
+	if info, err := os.Stat(path); err != nil || info.Size() != 10 {
+		t.Fatalf("file holds %v, %v; want it left at 10 bytes while mostly queued", info, err)
 	}
-
-	if _, ok := q.dequeue(); ok {
-		t.Errorf("expected empty queue")
-		return
+	q.dequeue()
+	// a dequeued prefix of 6 bytes against 4 still queued is copied away
+	if info, err := os.Stat(path); err != nil || info.Size() != 4 {
+		t.Fatalf("file holds %v, %v; want it compacted to 4 bytes", info, err)
+	}
+	enqueueString(t, q, "ff")
+	var walked []string
+	q.walk(func(m message) bool {
+		walked = append(walked, string(m.object))
+		return true
+	})
+	if fmt.Sprint(walked) != "[dd ee ff]" {
+		t.Errorf("walked %v after compaction", walked)
+	}
+	for _, want := range []string{"dd", "ee", "ff"} {
+		if m, ok, err := q.dequeue(); !ok || err != nil || string(m.object) != want {
+			t.Errorf("dequeued %q, %v, %v; want %q", m.object, ok, err, want)
+		}
 	}
 }
 
-func BenchmarkEnqueueDequeue(b *testing.B) {
-	bmData := make([]string, b.N)
-	for i := 0; i < b.N; i++ {
-		bmData[i] = fmt.Sprintf("%d", i)
+func TestDiskQueueReadError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.queue")
+	q := newDiskQueue(path)
+	defer q.close()
+	q.enqueue(message{object: []byte("abc"), id: 1})
+	q.enqueue(message{object: []byte("def"), id: 2})
+	// the file loses its messages beneath the queue
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := q.peek(); ok || err == nil {
+		t.Errorf("peek: got %v, %v; want an error", ok, err)
+	}
+	if _, ok, err := q.dequeue(); ok || err == nil {
+		t.Errorf("dequeue: got %v, %v; want an error", ok, err)
 	}
+	if len(q.records) - q.head != 2 {
+		t.Errorf("unreadable message was dropped")
+	}
+	if m, ok := q.discard(); !ok || m.id != 1 || len(q.records) - q.head != 1 {
+		t.Errorf("discard: got %+v, %v with %d left", m, ok, len(q.records) - q.head)
+	}
+}
+
+func TestRingQueueLaps(t *testing.T) {
+	// a small ring wraps many times under concurrent producers and consumers
+	q := newRingQueue(4)
+	const producers, each = 4, 5000
 	var waitgroup sync.WaitGroup
-	waitgroup.Add(2 * b.N)
-	b.ResetTimer()
-	for i := 0; i < 2 * b.N; i++ {
-		go func(i int) {
-			if i % 2 == 0 {
-				q.enqueue([]byte(bmData[i/2]))
-			} else {
-				q.dequeue()
+	for p := 0; p < producers; p++ {
+		waitgroup.Add(1)
+		go func(p int) {
+			defer waitgroup.Done()
+			for i := 0; i < each; i++ {
+				m := message{object: []byte(fmt.Sprintf("%d %d", p, i)), id: int64(i)}
+				for q.enqueue(m) == errFull {
+					runtime.Gosched()
+				}
+			}
+		}(p)
+	}
+	results := make(chan []string, producers)
+	for c := 0; c < producers; c++ {
+		go func() {
+			var got []string
+			for len(got) < each {
+				if m, ok, _ := q.dequeue(); ok {
+					got = append(got, string(m.object))
+				} else {
+					q.peek()
+					runtime.Gosched()
+				}
 			}
-			waitgroup.Done()
-		}(i)
+			results <- got
+		}()
 	}
 	waitgroup.Wait()
+	seen := map[string]bool{}
+	for c := 0; c < producers; c++ {
+		for _, s := range <-results {
+			if seen[s] {
+				t.Fatalf("%q dequeued twice", s)
+			}
+			seen[s] = true
+		}
+	}
+	if len(seen) != producers * each {
+		t.Errorf("dequeued %d messages, want %d", len(seen), producers * each)
+	}
+	if _, ok, _ := q.dequeue(); ok {
+		t.Errorf("expected empty queue")
+	}
 }
-
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"qcommon"
+	"qrpc"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate operations per second with bursts of up to burst.
+// A nil bucket allows everything.
+type tokenBucket struct {
+	sync.Mutex
+	rate	float64
+	burst	float64
+	tokens	float64
+	last	time.Time
+}
+
+// newTokenBucket returns nil, which is unlimited, for a rate <= 0. A burst <= 0
+// allows one second's worth of operations.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if burst <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b}
+}
+
+// take removes a token if one is available, otherwise it returns how long
+// until one will be.
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens + now.Sub(b.last).Seconds() * b.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+}
+
+// refund returns a token take removed, for an operation refused elsewhere.
+func (b *tokenBucket) refund() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens + 1)
+}
+
+// clientLimiter keeps a token bucket per client, identified by principal or
+// else remote address.
+type clientLimiter struct {
+	sync.Mutex
+	rate	float64
+	burst	int
+	buckets	map[string]*tokenBucket
+	lastSweep	time.Time
+}
+
+const (
+	clientSweepInterval = time.Minute
+)
+
+func newClientLimiter(rate float64, burst int) *clientLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &clientLimiter{rate: rate, burst: burst, buckets: map[string]*tokenBucket{}}
+}
+
+func (l *clientLimiter) take(client string, now time.Time) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.Lock()
+	// forget clients idle long enough for their bucket to have refilled
+	if now.Sub(l.lastSweep) > clientSweepInterval {
+		for c, b := range l.buckets {
+			b.Lock()
+			idle := now.Sub(b.last) > clientSweepInterval
+			b.Unlock()
+			if idle {
+				delete(l.buckets, c)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, present := l.buckets[client]
+	if !present {
+		b = newTokenBucket(l.rate, l.burst)
+		l.buckets[client] = b
+	}
+	l.Unlock()
+	return b.take(now)
+}
+
+// refund returns the token the client's last take removed.
+func (l *clientLimiter) refund(client string) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	b := l.buckets[client]
+	l.Unlock()
+	b.refund()
+}
+
+// client identifies the caller for rate limiting.
+func client(ctx context.Context) string {
+	if principal := qcommon.PrincipalFrom(ctx); principal != "" {
+		return "principal:" + principal
+	}
+	return "addr:" + remoteHost(qcommon.RemoteAddrFrom(ctx))
+}
+
+// rateLimitError carries how long the caller should wait.
+type rateLimitError struct {
+	*qrpc.Status
+	retryAfter	time.Duration
+}
+
+func (e *rateLimitError) Unwrap() error {
+	return e.Status
+}
+
+// admit charges an operation to the caller's rate limit and, if bucket is
+// set, to the queue's. Returns a ResourceExhausted error if either is used
+// up, in which case neither is charged.
+func admit(ctx context.Context, queue string, bucket *tokenBucket) error {
+	now := time.Now()
+	caller := client(ctx)
+	if wait, ok := clientLimits.take(caller, now); !ok {
+		annotate(ctx, "limited", "client")
+		return &rateLimitError{qrpc.Errorf(qrpc.ResourceExhausted, "Client rate limit exceeded").(*qrpc.Status), wait}
+	}
+	if wait, ok := bucket.take(now); !ok {
+		// a throttled queue mustn't use up the caller's budget for others
+		clientLimits.refund(caller)
+		annotate(ctx, "limited", "queue")
+		return &rateLimitError{qrpc.Errorf(qrpc.ResourceExhausted, "Queue %q rate limit exceeded", queue).(*qrpc.Status), wait}
+	}
+	return nil
+}
+
+// admitted is admit for HTTP handlers. It writes a 429 with Retry-After in the
+// style of the API being called and returns false if the request is limited.
+func admitted(w http.ResponseWriter, r *http.Request, queue string, bucket *tokenBucket) bool {
+	err := admit(r.Context(), queue, bucket)
+	if err == nil {
+		return true
+	}
+	limited, ok := err.(*rateLimitError)
+	if !ok {
+		logger.Error("unexpected admission error", "error", err)
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.retryAfter.Seconds()))))
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		writeError(w, http.StatusTooManyRequests, qcommon.ErrorCodeRateLimited, "%s", limited.Message)
+	} else {
+		http.Error(w, limited.Message, http.StatusTooManyRequests)
+	}
+	return false
+}
+
+// remoteHost strips the port from an address so that a client's connections
+// share a limit.
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"qclient"
+	"qcommon"
+	"qrpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, ok := b.take(now); !ok {
+			t.Fatalf("burst token %d refused", i)
+		}
+	}
+	wait, ok := b.take(now)
+	if ok || wait != 500 * time.Millisecond {
+		t.Errorf("want refusal with 500ms wait, got %v %v", ok, wait)
+	}
+	if _, ok := b.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Errorf("token not refilled after 500ms")
+	}
+	if _, ok := b.take(now.Add(time.Hour)); !ok {
+		t.Errorf("token not refilled after an hour")
+	}
+
+	var unlimited *tokenBucket = newTokenBucket(0, 0)
+	if _, ok := unlimited.take(now); !ok {
+		t.Errorf("unlimited bucket refused")
+	}
+}
+
+func TestClientLimiter(t *testing.T) {
+	l := newClientLimiter(1, 1)
+	now := time.Now()
+	if _, ok := l.take("a", now); !ok {
+		t.Errorf("first request from a refused")
+	}
+	if _, ok := l.take("a", now); ok {
+		t.Errorf("second request from a allowed")
+	}
+	if _, ok := l.take("b", now); !ok {
+		t.Errorf("first request from b refused")
+	}
+	l.take("c", now.Add(2 * clientSweepInterval))
+	if len(l.buckets) != 1 {
+		t.Errorf("want idle clients swept, have %d buckets", len(l.buckets))
+	}
+}
+
+func TestQueueRateLimit(t *testing.T) {
+	registry := newRegistry()
+	registry.create("limitedq", qcommon.QueueSettings{EnqueueRate: 1, EnqueueBurst: 1})
+	svc := service{registry}
+	if err := svc.Enqueue(ctx, "limitedq", []byte("a")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := svc.Enqueue(ctx, "limitedq", []byte("b")); qrpc.CodeOf(err) != qrpc.ResourceExhausted {
+		t.Errorf("want ResourceExhausted, got %v", err)
+	}
+	// dequeues are limited separately
+	if _, err := svc.Dequeue(ctx, "limitedq"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestQueueLimitRefundsClient(t *testing.T) {
+	clientLimits = newClientLimiter(1, 2)
+	defer func() { clientLimits = nil }()
+	registry := newRegistry()
+	registry.create("throttledq", qcommon.QueueSettings{EnqueueRate: 1, EnqueueBurst: 1})
+	registry.create("openq", qcommon.QueueSettings{})
+	svc := service{registry}
+	if err := svc.Enqueue(ctx, "throttledq", []byte("a")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := svc.Enqueue(ctx, "throttledq", []byte("b")); qrpc.CodeOf(err) != qrpc.ResourceExhausted {
+			t.Fatalf("want ResourceExhausted, got %v", err)
+		}
+	}
+	// the refused enqueues left the client its second token
+	if err := svc.Enqueue(ctx, "openq", []byte("c")); err != nil {
+		t.Errorf("client locked out by a throttled queue: %v", err)
+	}
+	if err := svc.Enqueue(ctx, "openq", []byte("d")); qrpc.CodeOf(err) != qrpc.ResourceExhausted {
+		t.Errorf("want the client limit to apply, got %v", err)
+	}
+}
+
+func TestRESTRateLimitRetryAfter(t *testing.T) {
+	srv := restServer()
+	defer srv.Close()
+	url := srv.URL + "/v1/queues/restlimitq"
+	if resp, b := doRequest(t, "PUT", url, "application/json", `{"settings":{"dequeue_rate":0.5,"dequeue_burst":1}}`); resp.StatusCode != http.StatusCreated || !strings.Contains(string(b), `"dequeue_rate":0.5`) {
+		t.Fatalf("create: got %d %s", resp.StatusCode, b)
+	}
+	defer doRequest(t, "DELETE", url, "", "")
+
+	doRequest(t, "DELETE", url + "/messages/head", "", "")
+	resp, b := doRequest(t, "DELETE", url + "/messages/head", "", "")
+	if resp.StatusCode != http.StatusTooManyRequests || errorCode(b) != qcommon.ErrorCodeRateLimited {
+		t.Errorf("want 429 rate_limited, got %d %s", resp.StatusCode, b)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Errorf("want Retry-After 2, got %q", got)
+	}
+}
+
+func TestClientHonorsRetryAfter(t *testing.T) {
+	name := "retryq"
+	queues.create(name, qcommon.QueueSettings{EnqueueRate: 1, EnqueueBurst: 1})
+	defer queues.remove(name)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/enqueue", enqueueHandler)
+	srv := httptest.NewServer(authenticate(nil, mux))
+	defer srv.Close()
+
+	defer func(host string, port int) {
+		qclient.Host, qclient.Port = host, port
+	}(qclient.Host, qclient.Port)
+	qclient.Host = "127.0.0.1"
+	qclient.Port = srv.Listener.Addr().(*net.TCPAddr).Port
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := qclient.Enqueue(qcommon.QueueId(name), []byte("x")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("want second enqueue delayed by Retry-After, took %v", elapsed)
+	}
+}
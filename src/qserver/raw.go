@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"qcommon"
+	"qrpc"
+	"strconv"
+	"strings"
+)
+
+func isRawObject(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == qcommon.ObjectContentType
+}
+
+// wantsRawObject reports whether the client asked for the object as the
+// response body rather than base64 inside JSON.
+func wantsRawObject(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if isRawObject(strings.TrimSpace(accept)) {
+			return true
+		}
+	}
+	return false
+}
+
+// errObjectTooLarge rejects an object over --max_object_size from the gRPC
+// and binary APIs.
+func errObjectTooLarge() error {
+	return qrpc.Errorf(qrpc.InvalidArgument, "Object exceeds %d bytes", *maxObjectSize)
+}
+
+// reads a raw request body as an object, or returns an error message/http
+// status code pair. When the length is known up front the body is read
+// straight into a buffer of that size.
+func readObject(w http.ResponseWriter, r *http.Request) ([]byte, string, int) {
+	tooLarge := fmt.Sprintf("Object exceeds %d bytes", *maxObjectSize)
+	if r.ContentLength > *maxObjectSize {
+		return nil, tooLarge, http.StatusRequestEntityTooLarge
+	}
+	body := http.MaxBytesReader(w, r.Body, *maxObjectSize)
+
+	var object []byte
+	var err error
+	if r.ContentLength >= 0 {
+		object = make([]byte, r.ContentLength)
+		_, err = io.ReadFull(body, object)
+	} else {
+		object, err = io.ReadAll(body)
+	}
+
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return nil, tooLarge, http.StatusRequestEntityTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Sprintf("Unable to read object: %v", err), http.StatusBadRequest
+	}
+	return object, "", http.StatusOK
+}
+
+// writeObject sends an object as the raw response body with its queue id in a
+// header.
+func writeObject(w http.ResponseWriter, id qcommon.QueueId, object []byte) {
+	w.Header().Set("Content-Type", qcommon.ObjectContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+	w.Header().Set(qcommon.QueueIdHeader, string(id))
+	w.WriteHeader(http.StatusOK)
+	w.Write(object)
+}
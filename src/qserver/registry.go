@@ -0,0 +1,259 @@
+package main
+
+import (
+	"qcommon"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// entry is a queue together with its settings and accounting. Its enqueue and
+// dequeue wrap the queue's to keep the accounting.
+type entry struct {
+	queue	Queue
+	name	string
+	registry	*registry
+
+	// replaced as a whole when the queue is reconfigured
+	mu	sync.RWMutex
+	limits	queueLimits
+
+	// held for reading while a message is charged or credited, and for
+	// writing by remove, which settles the queue's bytes with the registry
+	// once and for all
+	removal	sync.RWMutex
+	removed	bool
+
+	// updated atomically
+	depth	int64
+	bytes	int64
+	enqueued	int64
+	dequeued	int64
+	// the id of the last message enqueued; rejected enqueues use one up
+	lastID	int64
+}
+
+// queueLimits are a queue's settings and the rate limits they describe.
+type queueLimits struct {
+	settings	qcommon.QueueSettings
+	enqueue	*tokenBucket
+	dequeue	*tokenBucket
+}
+
+func newQueueLimits(settings qcommon.QueueSettings) queueLimits {
+	return queueLimits{
+		settings:	settings,
+		enqueue:	newTokenBucket(settings.EnqueueRate, settings.EnqueueBurst),
+		dequeue:	newTokenBucket(settings.DequeueRate, settings.DequeueBurst),
+	}
+}
+
+// peek returns the object at the head of the queue without removing it.
+// Returns nil, false if the queue is empty.
+func (e *entry) peek() ([]byte, bool, error) {
+	m, ok, err := e.queue.peek()
+	if err != nil {
+		return nil, false, errQueueRead(e.name, err)
+	}
+	return m.object, ok, nil
+}
+
+// oldest returns when the object at the head of the queue was enqueued.
+// Returns zero time, false if the queue is empty.
+func (e *entry) oldest() (time.Time, bool) {
+	m, ok, err := e.queue.peek()
+	if err != nil {
+		logger.Error("reading queue failed", "queue", e.name, "error", err)
+	}
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, m.enqueuedAt), true
+}
+
+func (e *entry) settings() qcommon.QueueSettings {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.limits.settings
+}
+
+func (e *entry) enqueueLimit() *tokenBucket {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.limits.enqueue
+}
+
+func (e *entry) dequeueLimit() *tokenBucket {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.limits.dequeue
+}
+
+// registry is the set of named queues, shared by every API the server exposes.
+type registry struct {
+	sync.RWMutex
+	queues	map[string]*entry
+
+	// bytes held by every queue, updated atomically, and the budget for them;
+	// 0 is unlimited.
+	bytes	int64
+	maxBytes	int64
+
+	// if set, mutations are serialized and recorded for replicas. Set before
+	// the registry is used.
+	journal	*journal
+	// if set, API mutations are committed through the cluster's log, which
+	// applies them. Set before the registry is used.
+	cluster	*cluster
+}
+
+func newRegistry() *registry {
+	return &registry{queues: map[string]*entry{}}
+}
+
+// create adds a new queue, filling unset settings from the server defaults.
+// Returns false if the name is already taken.
+func (r *registry) create(name string, settings qcommon.QueueSettings) (*entry, bool) {
+	return r.insert(name, withDefaultSettings(settings))
+}
+
+// insert is create without the server defaults.
+func (r *registry) insert(name string, settings qcommon.QueueSettings) (*entry, bool) {
+	if j := r.journal; j != nil {
+		j.Lock()
+		defer j.Unlock()
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, present := r.queues[name]; present {
+		return nil, false
+	}
+	return r.add(name, settings), true
+}
+
+// configure creates a queue with settings, or changes an existing queue's
+// settings if they differ. Returns whether anything changed.
+func (r *registry) configure(name string, settings qcommon.QueueSettings) bool {
+	return r.set(name, withDefaultSettings(settings))
+}
+
+// set is configure without the server defaults, for settings that already
+// have them applied.
+func (r *registry) set(name string, settings qcommon.QueueSettings) bool {
+	if j := r.journal; j != nil {
+		j.Lock()
+		defer j.Unlock()
+	}
+	r.Lock()
+	defer r.Unlock()
+	e, present := r.queues[name]
+	if !present {
+		r.add(name, settings)
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// the queue's implementation can't change under it
+	settings.Kind, settings.Capacity = e.limits.settings.Kind, e.limits.settings.Capacity
+	if e.limits.settings == settings {
+		return false
+	}
+	e.limits = newQueueLimits(settings)
+	r.journal.record(qcommon.ReplicationEvent{Op: qcommon.ReplicationCreate, Queue: name, Settings: &settings})
+	return true
+}
+
+// add creates a queue. Called with r and its journal locked.
+func (r *registry) add(name string, settings qcommon.QueueSettings) *entry {
+	e := &entry{
+		queue:		newQueue(name, settings),
+		name:		name,
+		registry:	r,
+		limits:		newQueueLimits(settings),
+	}
+	r.queues[name] = e
+	r.journal.record(qcommon.ReplicationEvent{Op: qcommon.ReplicationCreate, Queue: name, Settings: &settings})
+	return e
+}
+
+func (r *registry) get(name string) (*entry, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	q, present := r.queues[name]
+	return q, present
+}
+
+// remove deletes a queue. Returns false if it doesn't exist.
+func (r *registry) remove(name string) bool {
+	if j := r.journal; j != nil {
+		j.Lock()
+		defer j.Unlock()
+	}
+	r.Lock()
+	defer r.Unlock()
+	e, present := r.queues[name]
+	if !present {
+		return false
+	}
+	delete(r.queues, name)
+	e.removal.Lock()
+	e.removed = true
+	atomic.AddInt64(&r.bytes, -atomic.LoadInt64(&e.bytes))
+	e.removal.Unlock()
+	if err := e.queue.close(); err != nil {
+		logger.Warn("closing queue failed", "queue", name, "error", err)
+	}
+	r.journal.record(qcommon.ReplicationEvent{Op: qcommon.ReplicationDelete, Queue: name})
+	return true
+}
+
+// names returns the queue names in sorted order.
+func (r *registry) names() []string {
+	r.RLock()
+	defer r.RUnlock()
+	names := make([]string, 0, len(r.queues))
+	for name := range r.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// stats reports on the named queues, skipping any that have been removed.
+func (r *registry) stats(names []string) qcommon.ServerStats {
+	stats := qcommon.ServerStats{
+		MemoryBytes:	atomic.LoadInt64(&r.bytes),
+		MaxMemoryBytes:	r.maxBytes,
+		Queues:		[]qcommon.QueueStats{},
+	}
+	for _, name := range names {
+		if e, present := r.get(name); present {
+			stats.Queues = append(stats.Queues, e.stats(name))
+		}
+	}
+	return stats
+}
+
+// withDefaultSettings fills unset settings from the command line defaults.
+func withDefaultSettings(settings qcommon.QueueSettings) qcommon.QueueSettings {
+	if settings.EnqueueRate == 0 {
+		settings.EnqueueRate = *enqueueRate
+	}
+	if settings.EnqueueBurst == 0 {
+		settings.EnqueueBurst = *enqueueBurst
+	}
+	if settings.DequeueRate == 0 {
+		settings.DequeueRate = *dequeueRate
+	}
+	if settings.DequeueBurst == 0 {
+		settings.DequeueBurst = *dequeueBurst
+	}
+	if settings.Kind == "" {
+		settings.Kind = *queueKind
+	}
+	if (settings.Kind == kindChannel || settings.Kind == kindRing) && settings.Capacity == 0 {
+		settings.Capacity = *queueCapacity
+	}
+	return settings
+}
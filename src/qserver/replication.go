@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"qcommon"
+	"qrpc"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// events a replica may fall behind before it is disconnected; it then
+	// reconnects and starts again from a snapshot
+	replicationBuffer = 1 << 16
+	replicationHeartbeat = time.Second
+)
+
+// journal serializes a registry's mutations and hands each, numbered, to the
+// replicas streaming from it. Mutations hold the journal's lock while they
+// apply and record themselves, so replicas see them in the order they happened.
+// A nil journal records nothing.
+type journal struct {
+	sync.Mutex
+	seq	int64	// written with the lock held, read atomically
+	subscribers	map[chan qcommon.ReplicationEvent]bool
+}
+
+func newJournal() *journal {
+	return &journal{subscribers: map[chan qcommon.ReplicationEvent]bool{}}
+}
+
+// record numbers ev and sends it to every subscriber. Called with j locked.
+func (j *journal) record(ev qcommon.ReplicationEvent) {
+	if j == nil {
+		return
+	}
+	ev.Seq = atomic.AddInt64(&j.seq, 1)
+	for ch := range j.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// too far behind to keep up
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a snapshot of r, as the events that would rebuild it,
+// and a channel of the mutations that follow it. The channel is closed if the
+// subscriber falls too far behind or the journal is closed.
+func (j *journal) subscribe(r *registry) ([]qcommon.ReplicationEvent, chan qcommon.ReplicationEvent) {
+	j.Lock()
+	defer j.Unlock()
+	r.RLock()
+	defer r.RUnlock()
+
+	seq := atomic.LoadInt64(&j.seq)
+	snapshot := []qcommon.ReplicationEvent{{Seq: seq, Op: qcommon.ReplicationReset}}
+	names := make([]string, 0, len(r.queues))
+	for name := range r.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := r.queues[name]
+		settings := e.settings()
+		snapshot = append(snapshot, qcommon.ReplicationEvent{Seq: seq, Op: qcommon.ReplicationCreate, Queue: name, Settings: &settings})
+		// nothing enqueues or dequeues while the journal is locked
+		e.queue.walk(func(m message) bool {
+			snapshot = append(snapshot, qcommon.ReplicationEvent{Seq: seq, Op: qcommon.ReplicationEnqueue, Queue: name, Object: m.object, EnqueuedAt: m.enqueuedAt})
+			return true
+		})
+	}
+
+	ch := make(chan qcommon.ReplicationEvent, replicationBuffer)
+	j.subscribers[ch] = true
+	return snapshot, ch
+}
+
+func (j *journal) unsubscribe(ch chan qcommon.ReplicationEvent) {
+	j.Lock()
+	defer j.Unlock()
+	if j.subscribers[ch] {
+		delete(j.subscribers, ch)
+		close(ch)
+	}
+}
+
+// close ends every subscription, letting streams finish when the server shuts
+// down.
+func (j *journal) close() {
+	j.Lock()
+	defer j.Unlock()
+	for ch := range j.subscribers {
+		delete(j.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (j *journal) replicas() int {
+	j.Lock()
+	defer j.Unlock()
+	return len(j.subscribers)
+}
+
+// following is set while this server is a replica.
+var following atomic.Pointer[follower]
+
+// readOnly reports whether writes must be refused because this server is a
+// replica. It returns the error to refuse them with.
+func readOnly() error {
+	if f := following.Load(); f != nil {
+		return errReadOnly(f.primary)
+	}
+	return nil
+}
+
+// replicaGuard refuses HTTP requests that would mutate queues while this
+// server is a replica, in the style of the API being called.
+func replicaGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := readOnly()
+		if err == nil || !mutates(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		msg := err.Error()
+		if s, ok := err.(*qrpc.Status); ok {
+			msg = s.Message
+		}
+		if strings.HasPrefix(r.URL.Path, "/v1/") {
+			writeError(w, http.StatusServiceUnavailable, qcommon.ErrorCodeReadOnlyReplica, "%s", msg)
+		} else {
+			http.Error(w, msg, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// mutates reports whether an HTTP request would change queues.
+func mutates(r *http.Request) bool {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/replication"), strings.HasPrefix(r.URL.Path, "/v1/log/"):
+		return false
+	case strings.HasPrefix(r.URL.Path, "/v1/"):
+		return r.Method != "GET" && r.Method != "HEAD"
+	}
+	switch r.URL.Path {
+	case "/create", "/delete", "/enqueue", "/dequeue":
+		return true
+	}
+	return false
+}
+
+// replicationStatus reports this server's role and, for a replica, its lag
+// behind the primary.
+func replicationStatus() qcommon.ReplicationStatus {
+	status := qcommon.ReplicationStatus{Role: "primary"}
+	if f := following.Load(); f != nil {
+		status = f.status()
+	}
+	if j := queues.journal; j != nil {
+		status.Seq = atomic.LoadInt64(&j.seq)
+		status.Replicas = j.replicas()
+	}
+	return status
+}
+
+func replicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !permitted(w, r, "*", permAdmin) {
+		return
+	}
+	writeJSON(w, http.StatusOK, replicationStatus())
+}
+
+// replicationStreamHandler streams a snapshot and then every mutation to a
+// replica as NDJSON, with heartbeats while idle.
+func replicationStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !permitted(w, r, "*", permAdmin) {
+		return
+	}
+	j := queues.journal
+	if j == nil {
+		writeError(w, http.StatusNotFound, qcommon.ErrorCodeReplicationDisabled, "Replication is not enabled on this server")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, qcommon.ErrorCodeInternal, "Streaming unsupported")
+		return
+	}
+
+	snapshot, events := j.subscribe(queues)
+	defer j.unsubscribe(events)
+	logger.Info("replica connected", "remote", r.RemoteAddr, "seq", snapshot[0].Seq)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, ev := range snapshot {
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				logger.Info("replica disconnected", "remote", r.RemoteAddr)
+				return
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			if len(events) == 0 {
+				flusher.Flush()
+			}
+		case <-heartbeat.C:
+			if err := enc.Encode(qcommon.ReplicationEvent{Seq: atomic.LoadInt64(&j.seq), Op: qcommon.ReplicationHeartbeat}); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// promoting serializes promotions, so that only one stops the follower.
+var promoting sync.Mutex
+
+// promoteHandler stops following the primary and makes this server writable.
+// The follower has finished applying the primary's events before writes are
+// accepted, so that the two histories don't interleave.
+func promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if !permitted(w, r, "*", permAdmin) {
+		return
+	}
+	promoting.Lock()
+	defer promoting.Unlock()
+	f := following.Load()
+	if f == nil {
+		writeError(w, http.StatusConflict, qcommon.ErrorCodeNotReplica, "Server is not a replica")
+		return
+	}
+	f.stop()
+	following.Store(nil)
+	seq := f.status().AppliedSeq
+	logger.Info("promoted to primary", "primary", f.primary, "seq", seq)
+	audits.record(r.Context(), qcommon.AuditPromote, "", map[string]interface{}{"primary": f.primary, "seq": seq})
+	writeJSON(w, http.StatusOK, replicationStatus())
+}
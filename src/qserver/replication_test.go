@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"qcommon"
+	"qrpc"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// contents returns a queue's objects, head first.
+func contents(r *registry, name string) [][]byte {
+	e, present := r.get(name)
+	if !present {
+		return nil
+	}
+	var objects [][]byte
+	e.queue.walk(func(m message) bool {
+		objects = append(objects, m.object)
+		return true
+	})
+	return objects
+}
+
+// startReplica makes the global registry a primary served over HTTP and
+// follows it into a new registry.
+func startReplica(t *testing.T) (*registry, *follower, func()) {
+	queues.journal = newJournal()
+	srv := restServer()
+	replica := newRegistry()
+	f := startFollower("primary", srv.URL, "", http.DefaultClient, replica)
+	return replica, f, func() {
+		f.stop()
+		queues.journal.close()
+		srv.Close()
+		queues.journal = nil
+	}
+}
+
+// waitForReplica waits until f has applied everything the primary recorded.
+func waitForReplica(t *testing.T, f *follower) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status := f.status(); status.Connected && status.AppliedSeq == atomic.LoadInt64(&queues.journal.seq) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("replica didn't catch up: %+v, primary at %d", f.status(), atomic.LoadInt64(&queues.journal.seq))
+}
+
+func TestReplication(t *testing.T) {
+	// a queue that exists before the replica connects arrives in the snapshot
+	snapshotted, _ := queues.create("repl-snapshot", qcommon.QueueSettings{EnqueueRate: 7})
+	defer queues.remove("repl-snapshot")
+	snapshotted.enqueue([]byte("old"))
+
+	replica, f, stop := startReplica(t)
+	defer stop()
+	waitForReplica(t, f)
+
+	live, _ := queues.create("repl-live", qcommon.QueueSettings{})
+	defer queues.remove("repl-live")
+	for _, object := range []string{"a", "b", "c"} {
+		live.enqueue([]byte(object))
+	}
+	live.dequeue()
+	snapshotted.enqueue([]byte("new"))
+	queues.configure("repl-live", qcommon.QueueSettings{DequeueRate: 3})
+	queues.create("repl-deleted", qcommon.QueueSettings{})
+	queues.remove("repl-deleted")
+	waitForReplica(t, f)
+
+	for _, name := range []string{"repl-snapshot", "repl-live"} {
+		want, got := contents(queues, name), contents(replica, name)
+		if len(want) != len(got) {
+			t.Errorf("%s: want %q, got %q", name, want, got)
+			continue
+		}
+		for i := range want {
+			if !bytes.Equal(want[i], got[i]) {
+				t.Errorf("%s: want %q, got %q", name, want, got)
+			}
+		}
+		primaryEntry, _ := queues.get(name)
+		replicaEntry, _ := replica.get(name)
+		if primaryEntry.settings() != replicaEntry.settings() {
+			t.Errorf("%s: want settings %+v, got %+v", name, primaryEntry.settings(), replicaEntry.settings())
+		}
+		wantOldest, _ := primaryEntry.oldest()
+		if gotOldest, _ := replicaEntry.oldest(); !gotOldest.Equal(wantOldest) {
+			t.Errorf("%s: want oldest enqueued at %v, got %v", name, wantOldest, gotOldest)
+		}
+	}
+	if _, present := replica.get("repl-deleted"); present {
+		t.Errorf("deleted queue still on replica")
+	}
+	if status := f.status(); status.LagEvents != 0 || status.Role != "replica" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestReplicaReadOnlyAndPromote(t *testing.T) {
+	replica, f, stop := startReplica(t)
+	defer stop()
+	following.Store(f)
+	defer following.Store(nil)
+	waitForReplica(t, f)
+	queues.create("repl-promote", qcommon.QueueSettings{})
+	defer queues.remove("repl-promote")
+	waitForReplica(t, f)
+
+	svc := service{replica}
+	if err := svc.Enqueue(ctx, "repl-promote", []byte("x")); qrpc.CodeOf(err) != qrpc.Unavailable {
+		t.Errorf("enqueue on replica: want Unavailable, got %v", err)
+	}
+	guarded := httptest.NewServer(replicaGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	defer guarded.Close()
+	if resp, b := doRequest(t, "POST", guarded.URL + "/v1/queues/repl-promote/messages", qcommon.ObjectContentType, "x"); resp.StatusCode != http.StatusServiceUnavailable || errorCode(b) != qcommon.ErrorCodeReadOnlyReplica {
+		t.Errorf("REST write on replica: got %d %s", resp.StatusCode, b)
+	}
+	if resp, _ := doRequest(t, "POST", guarded.URL + "/dequeue", "", ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("legacy write on replica: got %d", resp.StatusCode)
+	}
+	if resp, _ := doRequest(t, "GET", guarded.URL + "/v1/queues/repl-promote", "", ""); resp.StatusCode != http.StatusTeapot {
+		t.Errorf("read on replica: got %d", resp.StatusCode)
+	}
+
+	w := httptest.NewRecorder()
+	promoteHandler(w, httptest.NewRequest("POST", "/v1/replication/promote", nil))
+	if w.Code != http.StatusOK || following.Load() != nil {
+		t.Fatalf("promote: got %d %s", w.Code, w.Body)
+	}
+	if err := svc.Enqueue(ctx, "repl-promote", []byte("x")); err != nil {
+		t.Errorf("enqueue after promotion: %v", err)
+	}
+	w = httptest.NewRecorder()
+	promoteHandler(w, httptest.NewRequest("POST", "/v1/replication/promote", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("second promote: want %d, got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestPromoteDuringStream(t *testing.T) {
+	_, f, stop := startReplica(t)
+	defer stop()
+	following.Store(f)
+	defer following.Store(nil)
+	waitForReplica(t, f)
+	e, _ := queues.create("repl-streaming", qcommon.QueueSettings{})
+	defer queues.remove("repl-streaming")
+
+	streaming := make(chan bool)
+	go func() {
+		defer close(streaming)
+		for following.Load() != nil {
+			e.enqueue([]byte("x"))
+			e.dequeue()
+		}
+	}()
+	writable := make(chan bool)
+	go func() {
+		defer close(writable)
+		for following.Load() != nil {
+		}
+		select {
+		case <-f.done:
+		default:
+			t.Errorf("writable while the follower was still applying the primary's events")
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	w := httptest.NewRecorder()
+	promoteHandler(w, httptest.NewRequest("POST", "/v1/replication/promote", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("promote: got %d %s", w.Code, w.Body)
+	}
+	<-writable
+	<-streaming
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"qcommon"
+	"sort"
+	"strings"
+)
+
+// The versioned API addresses queues as resources by name:
+//
+//	GET	/v1/queues	list queues
+//	PUT	/v1/queues/{name}	create, optionally with settings
+//	GET	/v1/queues/{name}	get
+//	DELETE	/v1/queues/{name}	delete
+//	POST	/v1/queues/{name}/messages	enqueue
+//	DELETE	/v1/queues/{name}/messages	purge
+//	GET	/v1/queues/{name}/messages/head	peek
+//	DELETE	/v1/queues/{name}/messages/head	dequeue
+//	GET	/v1/queues/{name}/stats	depth, memory and throughput of a queue
+//	GET	/v1/queues/{name}/export	NDJSON stream of messages, left queued
+//	POST	/v1/queues/{name}/import	enqueue an NDJSON stream of messages
+//	GET	/v1/stats	server memory and stats of every queue
+//	GET	/v1/replication	role and replication lag
+//	GET	/v1/replication/stream	NDJSON stream of mutations, for replicas
+//	POST	/v1/replication/promote	make a replica the primary
+//	GET	/v1/cluster	Raft state and members of a clustered server
+//	POST	/v1/cluster/raft	Raft RPCs between cluster nodes
+//	GET	/v1/log/level	least severe level logged
+//	PUT	/v1/log/level	change it until restart
+//
+// Requests and responses are JSON except that messages may also be sent and
+// received raw as application/octet-stream. Errors, including unknown paths
+// and methods, are qcommon.ErrorData.
+func registerRESTHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/", restHandler)
+}
+
+var (
+	queuesMethods = methods(map[string]http.HandlerFunc{
+		"GET":	listQueuesHandler,
+	})
+	queueMethods = methods(map[string]http.HandlerFunc{
+		"PUT":	putQueueHandler,
+		"GET":	getQueueHandler,
+		"DELETE":	deleteQueueHandler,
+	})
+	messagesMethods = methods(map[string]http.HandlerFunc{
+		"POST":	postMessageHandler,
+		"DELETE":	purgeHandler,
+	})
+	headMethods = methods(map[string]http.HandlerFunc{
+		"GET":	peekHeadHandler,
+		"DELETE":	deleteHeadHandler,
+	})
+	queueStatsMethods = methods(map[string]http.HandlerFunc{
+		"GET":	queueStatsHandler,
+	})
+	exportMethods = methods(map[string]http.HandlerFunc{
+		"GET":	exportHandler,
+	})
+	importMethods = methods(map[string]http.HandlerFunc{
+		"POST":	importHandler,
+	})
+	statsMethods = methods(map[string]http.HandlerFunc{
+		"GET":	statsHandler,
+	})
+	replicationMethods = methods(map[string]http.HandlerFunc{
+		"GET":	replicationStatusHandler,
+	})
+	replicationStreamMethods = methods(map[string]http.HandlerFunc{
+		"GET":	replicationStreamHandler,
+	})
+	promoteMethods = methods(map[string]http.HandlerFunc{
+		"POST":	promoteHandler,
+	})
+	clusterMethods = methods(map[string]http.HandlerFunc{
+		"GET":	clusterStatusHandler,
+	})
+	clusterRaftMethods = methods(map[string]http.HandlerFunc{
+		"POST":	clusterRaftHandler,
+	})
+	logLevelMethods = methods(map[string]http.HandlerFunc{
+		"GET":	logLevelHandler,
+		"PUT":	logLevelHandler,
+	})
+)
+
+// restHandler routes /v1 paths. The queue name, when present, is passed to
+// handlers as the "name" path value.
+func restHandler(w http.ResponseWriter, r *http.Request) {
+	// split the escaped path so that names may contain an encoded "/"
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/v1/"), "/")
+	switch strings.Join(parts, "/") {
+	case "stats":
+		statsMethods(w, r)
+		return
+	case "replication":
+		replicationMethods(w, r)
+		return
+	case "replication/stream":
+		replicationStreamMethods(w, r)
+		return
+	case "replication/promote":
+		promoteMethods(w, r)
+		return
+	case "cluster":
+		clusterMethods(w, r)
+		return
+	case "cluster/raft":
+		clusterRaftMethods(w, r)
+		return
+	case "log/level":
+		logLevelMethods(w, r)
+		return
+	}
+	if parts[0] != "queues" {
+		writeError(w, http.StatusNotFound, qcommon.ErrorCodeNotFound, "No such resource %q", r.URL.Path)
+		return
+	}
+	if len(parts) > 1 {
+		name, err := url.PathUnescape(parts[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, qcommon.ErrorCodeInvalidArgument, "Invalid queue name %q", parts[1])
+			return
+		}
+		r.SetPathValue("name", name)
+		annotate(r.Context(), "queue", name)
+	}
+
+	switch {
+	case len(parts) == 1:
+		queuesMethods(w, r)
+	case parts[1] == "":
+		writeError(w, http.StatusNotFound, qcommon.ErrorCodeNotFound, "No such resource %q", r.URL.Path)
+	case len(parts) == 2:
+		queueMethods(w, r)
+	case len(parts) == 3 && parts[2] == "messages":
+		messagesMethods(w, r)
+	case len(parts) == 4 && parts[2] == "messages" && parts[3] == "head":
+		headMethods(w, r)
+	case len(parts) == 3 && parts[2] == "stats":
+		queueStatsMethods(w, r)
+	case len(parts) == 3 && parts[2] == "export":
+		exportMethods(w, r)
+	case len(parts) == 3 && parts[2] == "import":
+		importMethods(w, r)
+	default:
+		writeError(w, http.StatusNotFound, qcommon.ErrorCodeNotFound, "No such resource %q", r.URL.Path)
+	}
+}
+
+// methods dispatches on the request method, answering others with a JSON 405.
+func methods(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	var allowed []string
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, present := handlers[r.Method]
+		if !present {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, http.StatusMethodNotAllowed, qcommon.ErrorCodeMethodNotAllowed, "%s not allowed", r.Method)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, qcommon.ErrorCodeInternal, "Failed to marshal JSON")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, format string, a ...interface{}) {
+	b, _ := json.Marshal(qcommon.ErrorData{Error: qcommon.ErrorDetail{Code: code, Message: fmt.Sprintf(format, a...)}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// returns the named queue, or writes a permission or not found error.
+func pathQueue(w http.ResponseWriter, r *http.Request, perms ...permission) (string, *entry, bool) {
+	name := r.PathValue("name")
+	if !permitted(w, r, name, perms...) {
+		return name, nil, false
+	}
+	q, present := queues.get(name)
+	if !present {
+		writeError(w, http.StatusNotFound, qcommon.ErrorCodeQueueNotFound, "Queue %q doesn't exist", name)
+	}
+	return name, q, present
+}
+
+// visibleQueues returns the names of queues the caller holds any permission on.
+func visibleQueues(r *http.Request) []string {
+	var names []string
+	for _, name := range queues.names() {
+		if acls != nil && !acls.allows(qcommon.PrincipalFrom(r.Context()), name, allPermissions...) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func listQueuesHandler(w http.ResponseWriter, r *http.Request) {
+	list := qcommon.QueueListData{Queues: []qcommon.QueueData{}}
+	for _, name := range visibleQueues(r) {
+		list.Queues = append(list.Queues, qcommon.QueueData{Name: name})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, queues.stats(visibleQueues(r)))
+}
+
+func queueStatsHandler(w http.ResponseWriter, r *http.Request) {
+	name, q, present := pathQueue(w, r, allPermissions...)
+	if !present {
+		return
+	}
+	writeJSON(w, http.StatusOK, q.stats(name))
+}
+
+func putQueueHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !permitted(w, r, name, permCreate) || !admitted(w, r, name, nil) {
+		return
+	}
+
+	// the body, if any, is a QueueData carrying settings
+	var data qcommon.QueueData
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1 << 16)).Decode(&data); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, qcommon.ErrorCodeInvalidArgument, "Unable to parse queue: %v", err)
+		return
+	}
+	if data.Name != "" && data.Name != name {
+		writeError(w, http.StatusBadRequest, qcommon.ErrorCodeInvalidArgument, "Name %q doesn't match path", data.Name)
+		return
+	}
+	var settings qcommon.QueueSettings
+	if data.Settings != nil {
+		settings = *data.Settings
+	}
+
+	e, created, err := queues.commitCreate(r.Context(), name, settings)
+	if err != nil {
+		writeCommitError(w, r, err)
+		return
+	}
+	if !created {
+		writeError(w, http.StatusConflict, qcommon.ErrorCodeQueueExists, "Queue %q already exists", name)
+		return
+	}
+	settings = e.settings()
+	audits.record(r.Context(), qcommon.AuditCreateQueue, name, settings)
+	writeJSON(w, http.StatusCreated, qcommon.QueueData{Name: name, Settings: &settings})
+}
+
+func getQueueHandler(w http.ResponseWriter, r *http.Request) {
+	name, q, present := pathQueue(w, r, allPermissions...)
+	if !present || !admitted(w, r, name, nil) {
+		return
+	}
+	settings := q.settings()
+	writeJSON(w, http.StatusOK, qcommon.QueueData{Name: name, Settings: &settings})
+}
+
+func deleteQueueHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !permitted(w, r, name, permDelete) || !admitted(w, r, name, nil) {
+		return
+	}
+	removed, err := queues.commitRemove(r.Context(), name)
+	if err != nil {
+		writeCommitError(w, r, err)
+		return
+	}
+	if !removed {
+		writeError(w, http.StatusNotFound, qcommon.ErrorCodeQueueNotFound, "Queue %q doesn't exist", name)
+		return
+	}
+	audits.record(r.Context(), qcommon.AuditDeleteQueue, name, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func postMessageHandler(w http.ResponseWriter, r *http.Request) {
+	name, q, present := pathQueue(w, r, permEnqueue)
+	if !present || !admitted(w, r, name, q.enqueueLimit()) {
+		return
+	}
+
+	var object []byte
+	if isRawObject(r.Header.Get("Content-Type")) {
+		var msg string
+		var status int
+		if object, msg, status = readObject(w, r); status != http.StatusOK {
+			code := qcommon.ErrorCodeInvalidArgument
+			if status == http.StatusRequestEntityTooLarge {
+				code = qcommon.ErrorCodeObjectTooLarge
+			}
+			writeError(w, status, code, "%s", msg)
+			return
+		}
+	} else {
+		// base64 inflates the object by a third
+		var message qcommon.MessageData
+		body := http.MaxBytesReader(w, r.Body, *maxObjectSize / 3 * 4 + 1024)
+		if err := json.NewDecoder(body).Decode(&message); err != nil {
+			writeError(w, http.StatusBadRequest, qcommon.ErrorCodeInvalidArgument, "Unable to parse message: %v", err)
+			return
+		}
+		object = message.Object
+		if int64(len(object)) > *maxObjectSize {
+			writeError(w, http.StatusRequestEntityTooLarge, qcommon.ErrorCodeObjectTooLarge, "Object exceeds %d bytes", *maxObjectSize)
+			return
+		}
+	}
+
+	if err := q.commitEnqueue(r.Context(), object); err != nil {
+		writeCommitError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func deleteHeadHandler(w http.ResponseWriter, r *http.Request) {
+	name, q, present := pathQueue(w, r, permDequeue)
+	if !present || !admitted(w, r, name, q.dequeueLimit()) {
+		return
+	}
+	object, valid, err := q.commitDequeue(r.Context())
+	if err != nil {
+		writeCommitError(w, r, err)
+		return
+	}
+	if !valid {
+		writeError(w, http.StatusNotFound, qcommon.ErrorCodeQueueEmpty, "Queue %q is empty", name)
+		return
+	}
+
+	if wantsRawObject(r) {
+		writeObject(w, qcommon.QueueId(name), object)
+		return
+	}
+	writeJSON(w, http.StatusOK, qcommon.MessageData{Queue: name, Object: object})
+}
+
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	name, q, present := pathQueue(w, r, permDelete)
+	if !present || !admitted(w, r, name, nil) {
+		return
+	}
+	purged, err := q.commitPurge(r.Context())
+	if err != nil {
+		writeCommitError(w, r, err)
+		return
+	}
+	annotate(r.Context(), "purged", purged)
+	audits.record(r.Context(), qcommon.AuditPurgeQueue, name, qcommon.PurgeData{Purged: purged})
+	writeJSON(w, http.StatusOK, qcommon.PurgeData{Purged: purged})
+}
+
+func peekHeadHandler(w http.ResponseWriter, r *http.Request) {
+	name, q, present := pathQueue(w, r, permDequeue)
+	if !present || !admitted(w, r, name, nil) {
+		return
+	}
+	object, valid, err := q.peek()
+	if err != nil {
+		writeCommitError(w, r, err)
+		return
+	}
+	if !valid {
+		writeError(w, http.StatusNotFound, qcommon.ErrorCodeQueueEmpty, "Queue %q is empty", name)
+		return
+	}
+
+	if wantsRawObject(r) {
+		writeObject(w, qcommon.QueueId(name), object)
+		return
+	}
+	writeJSON(w, http.StatusOK, qcommon.MessageData{Queue: name, Object: object})
+}
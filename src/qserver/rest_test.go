@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"qcommon"
+	"qrpc"
+	"strings"
+	"testing"
+)
+
+func restServer() *httptest.Server {
+	mux := http.NewServeMux()
+	registerRESTHandlers(mux)
+	return httptest.NewServer(mux)
+}
+
+func doRequest(t *testing.T, method, url, contentType, body string) (*http.Response, []byte) {
+	r, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	var b bytes.Buffer
+	b.ReadFrom(resp.Body)
+	return resp, b.Bytes()
+}
+
+func errorCode(b []byte) string {
+	var e qcommon.ErrorData
+	json.Unmarshal(b, &e)
+	return e.Error.Code
+}
+
+func TestRESTQueueLifecycle(t *testing.T) {
+	srv := restServer()
+	defer srv.Close()
+	url := srv.URL + "/v1/queues/restq"
+
+	if resp, _ := doRequest(t, "PUT", url, "", ""); resp.StatusCode != http.StatusCreated {
+		t.Errorf("create: want %d, got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if resp, b := doRequest(t, "PUT", url, "", ""); resp.StatusCode != http.StatusConflict || errorCode(b) != qcommon.ErrorCodeQueueExists {
+		t.Errorf("duplicate create: got %d %s", resp.StatusCode, b)
+	}
+	if resp, b := doRequest(t, "GET", srv.URL + "/v1/queues", "", ""); resp.StatusCode != http.StatusOK || !strings.Contains(string(b), `{"name":"restq"}`) {
+		t.Errorf("list: got %d %s", resp.StatusCode, b)
+	}
+	if resp, _ := doRequest(t, "DELETE", url, "", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete: want %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if resp, b := doRequest(t, "GET", url, "", ""); resp.StatusCode != http.StatusNotFound || errorCode(b) != qcommon.ErrorCodeQueueNotFound {
+		t.Errorf("get deleted: got %d %s", resp.StatusCode, b)
+	}
+}
+
+func TestRESTMessages(t *testing.T) {
+	srv := restServer()
+	defer srv.Close()
+	url := srv.URL + "/v1/queues/restmsgq"
+	doRequest(t, "PUT", url, "", "")
+	defer doRequest(t, "DELETE", url, "", "")
+
+	if resp, b := doRequest(t, "POST", url + "/messages", "application/json", `{"object":"aGVsbG8="}`); resp.StatusCode != http.StatusCreated {
+		t.Errorf("enqueue json: got %d %s", resp.StatusCode, b)
+	}
+	if resp, b := doRequest(t, "POST", url + "/messages", qcommon.ObjectContentType, "raw\x00"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("enqueue raw: got %d %s", resp.StatusCode, b)
+	}
+
+	resp, b := doRequest(t, "DELETE", url + "/messages/head", "", "")
+	var message qcommon.MessageData
+	if err := json.Unmarshal(b, &message); resp.StatusCode != http.StatusOK || err != nil || string(message.Object) != "hello" {
+		t.Errorf("dequeue: got %d %s", resp.StatusCode, b)
+	}
+	resp, b = doRequest(t, "DELETE", url + "/messages/head", "", "")
+	if err := json.Unmarshal(b, &message); resp.StatusCode != http.StatusOK || err != nil || string(message.Object) != "raw\x00" {
+		t.Errorf("dequeue: got %d %s", resp.StatusCode, b)
+	}
+	if resp, b := doRequest(t, "DELETE", url + "/messages/head", "", ""); resp.StatusCode != http.StatusNotFound || errorCode(b) != qcommon.ErrorCodeQueueEmpty {
+		t.Errorf("dequeue empty: got %d %s", resp.StatusCode, b)
+	}
+}
+
+func TestRESTPeekPurge(t *testing.T) {
+	srv := restServer()
+	defer srv.Close()
+	url := srv.URL + "/v1/queues/restpeekq"
+	doRequest(t, "PUT", url, "", "")
+	defer doRequest(t, "DELETE", url, "", "")
+
+	if resp, b := doRequest(t, "GET", url + "/messages/head", "", ""); resp.StatusCode != http.StatusNotFound || errorCode(b) != qcommon.ErrorCodeQueueEmpty {
+		t.Errorf("peek empty: got %d %s", resp.StatusCode, b)
+	}
+	doRequest(t, "POST", url + "/messages", qcommon.ObjectContentType, "first")
+	doRequest(t, "POST", url + "/messages", qcommon.ObjectContentType, "second")
+	for i := 0; i < 2; i++ {
+		resp, b := doRequest(t, "GET", url + "/messages/head", "", "")
+		var message qcommon.MessageData
+		if err := json.Unmarshal(b, &message); resp.StatusCode != http.StatusOK || err != nil || string(message.Object) != "first" {
+			t.Errorf("peek: got %d %s", resp.StatusCode, b)
+		}
+	}
+
+	resp, b := doRequest(t, "DELETE", url + "/messages", "", "")
+	var purge qcommon.PurgeData
+	if err := json.Unmarshal(b, &purge); resp.StatusCode != http.StatusOK || err != nil || purge.Purged != 2 {
+		t.Errorf("purge: got %d %s", resp.StatusCode, b)
+	}
+	if resp, b := doRequest(t, "DELETE", url + "/messages/head", "", ""); resp.StatusCode != http.StatusNotFound || errorCode(b) != qcommon.ErrorCodeQueueEmpty {
+		t.Errorf("dequeue after purge: got %d %s", resp.StatusCode, b)
+	}
+}
+
+func TestRESTExportImport(t *testing.T) {
+	srv := restServer()
+	defer srv.Close()
+	from, to := srv.URL + "/v1/queues/restexportq", srv.URL + "/v1/queues/restimportq"
+	for _, url := range []string{from, to} {
+		doRequest(t, "PUT", url, "", "")
+		defer doRequest(t, "DELETE", url, "", "")
+	}
+	doRequest(t, "POST", from + "/messages", qcommon.ObjectContentType, "first")
+	doRequest(t, "POST", from + "/messages", qcommon.ObjectContentType, "second")
+
+	resp, export := doRequest(t, "GET", from + "/export", "", "")
+	lines := strings.Split(strings.TrimSuffix(string(export), "\n"), "\n")
+	if resp.StatusCode != http.StatusOK || len(lines) != 2 {
+		t.Fatalf("export: got %d %s", resp.StatusCode, export)
+	}
+	for i, line := range lines {
+		var m qcommon.ExportedMessage
+		if err := json.Unmarshal([]byte(line), &m); err != nil || m.ID != int64(i + 1) || m.EnqueuedAt.IsZero() || string(m.Object) != []string{"first", "second"}[i] {
+			t.Errorf("exported %s", line)
+		}
+	}
+	if resp, b := doRequest(t, "GET", from + "/stats", "", ""); !strings.Contains(string(b), `"depth":2`) {
+		t.Errorf("export dequeued: got %d %s", resp.StatusCode, b)
+	}
+
+	resp, b := doRequest(t, "POST", to + "/import", "application/x-ndjson", string(export))
+	var data qcommon.ImportData
+	if err := json.Unmarshal(b, &data); resp.StatusCode != http.StatusOK || err != nil || data.Imported != 2 {
+		t.Errorf("import: got %d %s", resp.StatusCode, b)
+	}
+	if _, again := doRequest(t, "GET", to + "/export", "", ""); string(again) != string(export) {
+		t.Errorf("import didn't keep messages and times: got %s, want %s", again, export)
+	}
+
+	resp, b = doRequest(t, "POST", to + "/import", "application/x-ndjson", `{"object":"dGhpcmQ="}` + "\nnot json\n")
+	if resp.StatusCode != http.StatusBadRequest || errorCode(b) != qcommon.ErrorCodeInvalidArgument || !strings.Contains(string(b), "Imported 1 messages") {
+		t.Errorf("import of bad line: got %d %s", resp.StatusCode, b)
+	}
+
+	bounded := srv.URL + "/v1/queues/restimportfullq"
+	doRequest(t, "PUT", bounded, "", `{"settings": {"kind": "slice", "capacity": 1}}`)
+	defer doRequest(t, "DELETE", bounded, "", "")
+	resp, b = doRequest(t, "POST", bounded + "/import", "application/x-ndjson", string(export))
+	if resp.StatusCode != http.StatusInsufficientStorage || errorCode(b) != qcommon.ErrorCodeQueueFull || !strings.Contains(string(b), `"Imported 1 messages, then: Queue`) {
+		t.Errorf("import past capacity: got %d %s", resp.StatusCode, b)
+	}
+
+	// each imported message is charged to the queue's rate limit
+	limited := srv.URL + "/v1/queues/restimportlimitedq"
+	doRequest(t, "PUT", limited, "", `{"settings": {"enqueue_rate": 0.001, "enqueue_burst": 1}}`)
+	defer doRequest(t, "DELETE", limited, "", "")
+	resp, b = doRequest(t, "POST", limited + "/import", "application/x-ndjson", string(export))
+	if resp.StatusCode != http.StatusTooManyRequests || errorCode(b) != qcommon.ErrorCodeRateLimited || resp.Header.Get("Retry-After") == "" || !strings.Contains(string(b), `"Imported 1 messages, then: Queue`) {
+		t.Errorf("import past rate limit: got %d %s", resp.StatusCode, b)
+	}
+
+	defer func(size int64) { *maxObjectSize = size }(*maxObjectSize)
+	*maxObjectSize = 3
+	resp, b = doRequest(t, "POST", to + "/import", "application/x-ndjson", `{"object":"` + strings.Repeat("A", 2048) + `"}`)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || errorCode(b) != qcommon.ErrorCodeObjectTooLarge || !strings.Contains(string(b), "a line exceeds") {
+		t.Errorf("import of long line: got %d %s", resp.StatusCode, b)
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	defer func(size int64) { *maxObjectSize = size }(*maxObjectSize)
+	*maxObjectSize = 3
+	queues.create("maxsizeq", qcommon.QueueSettings{})
+	defer queues.remove("maxsizeq")
+
+	if err := (service{queues}).Enqueue(ctx, "maxsizeq", []byte("four")); qrpc.CodeOf(err) != qrpc.InvalidArgument {
+		t.Errorf("service: want InvalidArgument, got %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/enqueue", enqueueHandler)
+	registerRESTHandlers(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	if resp, b := doRequest(t, "POST", srv.URL + "/enqueue", "application/x-www-form-urlencoded", "id=maxsizeq&object=four"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("form: got %d %s", resp.StatusCode, b)
+	}
+	if resp, b := doRequest(t, "POST", srv.URL + "/v1/queues/maxsizeq/messages", "", `{"object": "Zm91cg=="}`); resp.StatusCode != http.StatusRequestEntityTooLarge || errorCode(b) != qcommon.ErrorCodeObjectTooLarge {
+		t.Errorf("REST: got %d %s", resp.StatusCode, b)
+	}
+	if stats := contents(queues, "maxsizeq"); len(stats) != 0 {
+		t.Errorf("oversized objects were queued: %q", stats)
+	}
+}
+
+func TestRESTErrors(t *testing.T) {
+	srv := restServer()
+	defer srv.Close()
+
+	resp, b := doRequest(t, "POST", srv.URL + "/v1/queues", "", "")
+	if resp.StatusCode != http.StatusMethodNotAllowed || errorCode(b) != qcommon.ErrorCodeMethodNotAllowed || resp.Header.Get("Allow") != "GET" {
+		t.Errorf("bad method: got %d %s", resp.StatusCode, b)
+	}
+	if resp, b := doRequest(t, "GET", srv.URL + "/v1/nothing", "", ""); resp.StatusCode != http.StatusNotFound || errorCode(b) != qcommon.ErrorCodeNotFound {
+		t.Errorf("unknown path: got %d %s", resp.StatusCode, b)
+	}
+	if resp, b := doRequest(t, "POST", srv.URL + "/v1/queues/missing/messages", "application/json", `{}`); resp.StatusCode != http.StatusNotFound || errorCode(b) != qcommon.ErrorCodeQueueNotFound {
+		t.Errorf("enqueue missing queue: got %d %s", resp.StatusCode, b)
+	}
+}
+
+func TestRESTQueueKinds(t *testing.T) {
+	srv := restServer()
+	defer srv.Close()
+	url := srv.URL + "/v1/queues/"
+	*queueDir = t.TempDir()
+	defer func() { *queueDir = "" }()
+
+	for _, kind := range []string{"list", "slice", "channel", "ring", "disk"} {
+		resp, b := doRequest(t, "PUT", url + kind + "q", "", `{"settings": {"kind": "` + kind + `"}}`)
+		if resp.StatusCode != http.StatusCreated || !strings.Contains(string(b), `"kind":"` + kind + `"`) {
+			t.Errorf("create %s: got %d %s", kind, resp.StatusCode, b)
+			continue
+		}
+		doRequest(t, "POST", url + kind + "q/messages", qcommon.ObjectContentType, "x")
+		if resp, b := doRequest(t, "DELETE", url + kind + "q/messages/head", "", ""); resp.StatusCode != http.StatusOK || !strings.Contains(string(b), `"object":"eA=="`) {
+			t.Errorf("dequeue %s: got %d %s", kind, resp.StatusCode, b)
+		}
+		doRequest(t, "DELETE", url + kind + "q", "", "")
+	}
+
+	if resp, b := doRequest(t, "PUT", url + "boundedq", "", `{"settings": {"kind": "ring", "capacity": 2}}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create bounded: got %d %s", resp.StatusCode, b)
+	}
+	defer doRequest(t, "DELETE", url + "boundedq", "", "")
+	doRequest(t, "POST", url + "boundedq/messages", qcommon.ObjectContentType, "x")
+	doRequest(t, "POST", url + "boundedq/messages", qcommon.ObjectContentType, "y")
+	if resp, b := doRequest(t, "POST", url + "boundedq/messages", qcommon.ObjectContentType, "z"); resp.StatusCode != http.StatusInsufficientStorage || errorCode(b) != qcommon.ErrorCodeQueueFull {
+		t.Errorf("enqueue to full queue: got %d %s", resp.StatusCode, b)
+	}
+	if e, _ := queues.get("boundedq"); e.stats("boundedq").Depth != 2 || e.stats("boundedq").Enqueued != 2 {
+		t.Errorf("rejected enqueue was counted: %+v", e.stats("boundedq"))
+	}
+	if _, err := queues.commitConfigure(t.Context(), "boundedq", qcommon.QueueSettings{Kind: "ring", Capacity: 3}); err == nil {
+		t.Errorf("changed a queue's capacity")
+	}
+
+	for _, settings := range []string{`{"kind": "tree"}`, `{"kind": "list", "capacity": 5}`, `{"kind": "slice", "capacity": -1}`, `{"kind": "ring", "capacity": 1}`} {
+		if resp, b := doRequest(t, "PUT", url + "badq", "", `{"settings": ` + settings + `}`); resp.StatusCode != http.StatusBadRequest || errorCode(b) != qcommon.ErrorCodeInvalidArgument {
+			t.Errorf("create with %s: got %d %s", settings, resp.StatusCode, b)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// ringQueue is Dmitry Vyukov's bounded multi-producer multi-consumer queue: a
+// ring of cells, each with a sequence number saying which lap of the ring it
+// is ready for. Producers and consumers claim positions with a CAS and then
+// own the cell until they publish its next sequence number, so that nothing
+// is allocated per message and nothing blocks.
+//
+// A cell at position pos is free for the producer of pos when its sequence
+// is pos, holds that producer's message when it is pos+1, and is free for the
+// producer of pos+size once consumed. The ring's size is its capacity, which
+// must be at least 2 for pos+1 and pos+size to differ.
+type ringQueue struct {
+	cells	[]ringCell
+	size	uint64
+	_	[64]byte
+	// the next position to enqueue at, updated atomically
+	enqueuePos	uint64
+	_	[56]byte
+	// the next position to dequeue from, updated atomically
+	dequeuePos	uint64
+	_	[56]byte
+}
+
+// ringCell's fields are written by the cell's owner and read atomically, so
+// that peek and walk can read cells they don't own and check afterwards that
+// nothing changed.
+type ringCell struct {
+	seq	uint64
+	data	unsafe.Pointer
+	len	int64
+	enqueuedAt	int64
+	id	int64
+}
+
+// cellOverhead is charged per object on top of its length, for the cell that
+// holds it.
+const cellOverhead = int64(unsafe.Sizeof(ringCell{}))
+
+func newRingQueue(capacity int) *ringQueue {
+	q := &ringQueue{cells: make([]ringCell, capacity), size: uint64(capacity)}
+	for i := range q.cells {
+		q.cells[i].seq = uint64(i)
+	}
+	return q
+}
+
+func (c *ringCell) store(m message) {
+	atomic.StorePointer(&c.data, unsafe.Pointer(unsafe.SliceData(m.object)))
+	atomic.StoreInt64(&c.len, int64(len(m.object)))
+	atomic.StoreInt64(&c.enqueuedAt, m.enqueuedAt)
+	atomic.StoreInt64(&c.id, m.id)
+}
+
+func (c *ringCell) load() message {
+	data := (*byte)(atomic.LoadPointer(&c.data))
+	m := message{enqueuedAt: atomic.LoadInt64(&c.enqueuedAt), id: atomic.LoadInt64(&c.id)}
+	if data != nil {
+		m.object = unsafe.Slice(data, atomic.LoadInt64(&c.len))
+	}
+	return m
+}
+
+func (q *ringQueue) enqueue(m message) error {
+	pos := atomic.LoadUint64(&q.enqueuePos)
+	for {
+		cell := &q.cells[pos % q.size]
+		seq := atomic.LoadUint64(&cell.seq)
+		switch diff := int64(seq - pos); {
+		case diff == 0:
+			if atomic.CompareAndSwapUint64(&q.enqueuePos, pos, pos + 1) {
+				cell.store(m)
+				atomic.StoreUint64(&cell.seq, pos + 1)
+				return nil
+			}
+		case diff < 0:
+			// the cell still holds the message from the lap before
+			return errFull
+		}
+		pos = atomic.LoadUint64(&q.enqueuePos)
+	}
+}
+
+func (q *ringQueue) dequeue() (message, bool, error) {
+	pos := atomic.LoadUint64(&q.dequeuePos)
+	for {
+		cell := &q.cells[pos % q.size]
+		seq := atomic.LoadUint64(&cell.seq)
+		switch diff := int64(seq - (pos + 1)); {
+		case diff == 0:
+			if atomic.CompareAndSwapUint64(&q.dequeuePos, pos, pos + 1) {
+				m := cell.load()
+				// release the object to the garbage collector
+				atomic.StorePointer(&cell.data, nil)
+				atomic.StoreUint64(&cell.seq, pos + q.size)
+				return m, true, nil
+			}
+		case diff < 0:
+			// the cell's producer hasn't published yet
+			return message{}, false, nil
+		}
+		pos = atomic.LoadUint64(&q.dequeuePos)
+	}
+}
+
+// read returns the message at pos if it has been enqueued and not yet
+// claimed by a consumer. Consumers claim a position before touching its cell,
+// so a read is consistent if the position is still unclaimed afterwards.
+func (q *ringQueue) read(pos uint64) (message, bool) {
+	cell := &q.cells[pos % q.size]
+	if atomic.LoadUint64(&cell.seq) != pos + 1 {
+		return message{}, false
+	}
+	m := cell.load()
+	if atomic.LoadUint64(&q.dequeuePos) > pos {
+		return message{}, false
+	}
+	return m, true
+}
+
+func (q *ringQueue) peek() (message, bool, error) {
+	for {
+		pos := atomic.LoadUint64(&q.dequeuePos)
+		if m, ok := q.read(pos); ok {
+			return m, true, nil
+		}
+		if atomic.LoadUint64(&q.dequeuePos) == pos {
+			// not consumed, so not yet produced
+			return message{}, false, nil
+		}
+	}
+}
+
+// walk visits the messages enqueued before it started, skipping those
+// consumed meanwhile.
+func (q *ringQueue) walk(visit func(message) bool) {
+	end := atomic.LoadUint64(&q.enqueuePos)
+	for pos := atomic.LoadUint64(&q.dequeuePos); pos < end; pos++ {
+		m, ok := q.read(pos)
+		if !ok {
+			if next := atomic.LoadUint64(&q.dequeuePos); next > pos {
+				// consumed; catch up with the consumers
+				pos = next - 1
+				continue
+			}
+			// claimed by a producer that hasn't published yet
+			return
+		}
+		if !visit(m) {
+			return
+		}
+	}
+}
+
+func (q *ringQueue) cost(object []byte) int64 {
+	return int64(len(object)) + cellOverhead
+}
+
+func (q *ringQueue) close() error {
+	return nil
+}
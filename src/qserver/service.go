@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"qcommon"
+	"qrpc"
+)
+
+// service implements qrpc.QueueService on top of the queue registry. It backs
+// both the gRPC and the binary APIs.
+type service struct {
+	queues	*registry
+}
+
+func (s service) CreateQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	if err := readOnly(); err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", qrpc.Errorf(qrpc.InvalidArgument, "Missing queue name")
+	}
+	if err := authorize(ctx, name, permCreate); err != nil {
+		return "", err
+	}
+	if err := admit(ctx, name, nil); err != nil {
+		return "", err
+	}
+	e, created, err := s.queues.commitCreate(ctx, name, qcommon.QueueSettings{})
+	if err != nil {
+		return "", err
+	}
+	if !created {
+		return "", qrpc.Errorf(qrpc.AlreadyExists, "Queue already exists")
+	}
+	audits.record(ctx, qcommon.AuditCreateQueue, name, e.settings())
+	return qcommon.QueueId(name), nil
+}
+
+func (s service) GetQueue(ctx context.Context, name string) (qcommon.QueueId, error) {
+	if err := authorize(ctx, name, allPermissions...); err != nil {
+		return "", err
+	}
+	if err := admit(ctx, name, nil); err != nil {
+		return "", err
+	}
+	if _, present := s.queues.get(name); !present {
+		return "", qrpc.Errorf(qrpc.NotFound, "Queue doesn't exist")
+	}
+	return qcommon.QueueId(name), nil
+}
+
+func (s service) DeleteQueue(ctx context.Context, id qcommon.QueueId) error {
+	if err := readOnly(); err != nil {
+		return err
+	}
+	if err := authorize(ctx, string(id), permDelete); err != nil {
+		return err
+	}
+	if err := admit(ctx, string(id), nil); err != nil {
+		return err
+	}
+	removed, err := s.queues.commitRemove(ctx, string(id))
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return qrpc.Errorf(qrpc.NotFound, "Queue doesn't exist")
+	}
+	audits.record(ctx, qcommon.AuditDeleteQueue, string(id), nil)
+	return nil
+}
+
+func (s service) Enqueue(ctx context.Context, id qcommon.QueueId, object qcommon.Object) error {
+	if err := readOnly(); err != nil {
+		return err
+	}
+	if err := authorize(ctx, string(id), permEnqueue); err != nil {
+		return err
+	}
+	if int64(len(object)) > *maxObjectSize {
+		return errObjectTooLarge()
+	}
+	q, present := s.queues.get(string(id))
+	if !present {
+		return qrpc.Errorf(qrpc.NotFound, "Queue %q doesn't exist", id)
+	}
+	if err := admit(ctx, string(id), q.enqueueLimit()); err != nil {
+		return err
+	}
+	if err := q.commitEnqueue(ctx, object); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s service) Dequeue(ctx context.Context, id qcommon.QueueId) (qcommon.Object, error) {
+	if err := readOnly(); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, string(id), permDequeue); err != nil {
+		return nil, err
+	}
+	q, present := s.queues.get(string(id))
+	if !present {
+		return nil, qrpc.Errorf(qrpc.NotFound, "Queue %q doesn't exist", id)
+	}
+	if err := admit(ctx, string(id), q.dequeueLimit()); err != nil {
+		return nil, err
+	}
+	object, valid, err := q.commitDequeue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, qrpc.ErrEmpty
+	}
+	return object, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"qbinary"
+	"qcommon"
+	"qrpc"
+	"testing"
+	"time"
+)
+
+// blockingService holds enqueues until release is closed.
+type blockingService struct {
+	service
+	started	chan bool
+	release	chan bool
+}
+
+func (s blockingService) Enqueue(ctx context.Context, id qcommon.QueueId, object qcommon.Object) error {
+	s.started <- true
+	<-s.release
+	return s.service.Enqueue(ctx, id, object)
+}
+
+func TestBinaryShutdownDrains(t *testing.T) {
+	svc := blockingService{service{newRegistry()}, make(chan bool, 1), make(chan bool)}
+	svc.queues.create("drainq", qcommon.QueueSettings{})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	srv := qbinary.NewServer(svc)
+	go srv.Serve(l)
+	busy, _ := qbinary.Dial("tcp", l.Addr().String())
+	defer busy.Close()
+	idle, _ := qbinary.Dial("tcp", l.Addr().String())
+	defer idle.Close()
+	idle.GetQueue(ctx, "drainq")
+
+	enqueued := make(chan error)
+	go func() { enqueued <- busy.Enqueue(ctx, "drainq", []byte("in flight")) }()
+	<-svc.started
+	stopped := make(chan error)
+	go func() { stopped <- srv.Shutdown(ctx) }()
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := idle.GetQueue(ctx, "drainq"); err == nil {
+		t.Errorf("idle connection still served after shutdown")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Errorf("listener still accepting after shutdown")
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("shutdown returned %v before in-flight request finished", err)
+	default:
+	}
+
+	close(svc.release)
+	if err := <-enqueued; err != nil {
+		t.Errorf("in-flight enqueue failed: %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+	if object, err := svc.Dequeue(ctx, "drainq"); err != nil || string(object) != "in flight" {
+		t.Errorf("want %q, got %q (%v)", "in flight", object, err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	svc := blockingService{service{newRegistry()}, make(chan bool, 1), make(chan bool)}
+	defer close(svc.release)
+	svc.queues.create("drainq", qcommon.QueueSettings{})
+	l := qrpc.NewBufListener()
+	grpcServer := qrpc.NewHTTPServer(svc)
+	go grpcServer.Serve(l)
+	client := qrpc.NewClient("bufconn", l.Dial)
+	go client.Enqueue(ctx, "drainq", []byte("stuck"))
+	<-svc.started
+
+	deadline, cancel := context.WithTimeout(ctx, 50 * time.Millisecond)
+	defer cancel()
+	binaryServer := qbinary.NewServer(svc)
+	if err := shutdown(deadline, grpcServer.Shutdown, binaryServer.Shutdown); err != context.DeadlineExceeded {
+		t.Errorf("want DeadlineExceeded, got %v", err)
+	}
+	if err := grpcServer.Serve(l); err != http.ErrServerClosed {
+		t.Errorf("want ErrServerClosed, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// sliceQueue is a ring buffer in a slice, guarded by a mutex. It grows by
+// doubling, up to its capacity if it has one, and holds no per-message
+// allocation besides the object.
+type sliceQueue struct {
+	mu	sync.Mutex
+	ring	[]message
+	head	int
+	len	int
+	// 0 is unbounded
+	capacity	int
+}
+
+// slotOverhead is charged per object on top of its length, for the ring slot
+// that holds it.
+const slotOverhead = int64(unsafe.Sizeof(message{}))
+
+func newSliceQueue(capacity int) *sliceQueue {
+	size := 16
+	if capacity > 0 && capacity < size {
+		size = capacity
+	}
+	return &sliceQueue{ring: make([]message, size), capacity: capacity}
+}
+
+func (q *sliceQueue) enqueue(m message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.len == len(q.ring) {
+		if q.capacity > 0 && q.len >= q.capacity {
+			return errFull
+		}
+		q.grow()
+	}
+	q.ring[(q.head + q.len) % len(q.ring)] = m
+	q.len++
+	return nil
+}
+
+// grow doubles the ring, or fills it out to the capacity. Called with q
+// locked.
+func (q *sliceQueue) grow() {
+	size := 2 * len(q.ring)
+	if q.capacity > 0 && size > q.capacity {
+		size = q.capacity
+	}
+	ring := make([]message, size)
+	n := copy(ring, q.ring[q.head:])
+	copy(ring[n:], q.ring[:q.head])
+	q.ring, q.head = ring, 0
+}
+
+func (q *sliceQueue) dequeue() (message, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.len == 0 {
+		return message{}, false, nil
+	}
+	m := q.ring[q.head]
+	// release the object to the garbage collector
+	q.ring[q.head] = message{}
+	q.head = (q.head + 1) % len(q.ring)
+	q.len--
+	return m, true, nil
+}
+
+func (q *sliceQueue) peek() (message, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.len == 0 {
+		return message{}, false, nil
+	}
+	return q.ring[q.head], true, nil
+}
+
+// walk visits a copy of the messages so as not to hold up the queue.
+func (q *sliceQueue) walk(visit func(message) bool) {
+	q.mu.Lock()
+	messages := make([]message, q.len)
+	for i := range messages {
+		messages[i] = q.ring[(q.head + i) % len(q.ring)]
+	}
+	q.mu.Unlock()
+	for _, m := range messages {
+		if !visit(m) {
+			return
+		}
+	}
+}
+
+func (q *sliceQueue) cost(object []byte) int64 {
+	return int64(len(object)) + slotOverhead
+}
+
+func (q *sliceQueue) close() error {
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"qbinary"
+	"qclient"
+	"qcommon"
+	"qrpc"
+	"testing"
+	"time"
+)
+
+type testCerts struct {
+	caFile	string
+	serverCert, serverKey	string
+	clientCert, clientKey	string
+}
+
+// generateCerts writes a CA, a server certificate for 127.0.0.1 and a client
+// certificate for "alice", all signed by the CA, to a temporary directory.
+func generateCerts(t *testing.T) testCerts {
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:		big.NewInt(1),
+		Subject:		pkix.Name{CommonName: "test ca"},
+		NotBefore:		time.Now().Add(-time.Hour),
+		NotAfter:		time.Now().Add(time.Hour),
+		IsCA:			true,
+		KeyUsage:		x509.KeyUsageCertSign,
+		BasicConstraintsValid:	true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating ca: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+		return path
+	}
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber:	big.NewInt(serial),
+			Subject:	pkix.Name{CommonName: name},
+			NotBefore:	time.Now().Add(-time.Hour),
+			NotAfter:	time.Now().Add(time.Hour),
+			KeyUsage:	x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:	[]x509.ExtKeyUsage{usage},
+			IPAddresses:	[]net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("creating %s certificate: %v", name, err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		return write(name + ".crt", "CERTIFICATE", der), write(name + ".key", "EC PRIVATE KEY", keyDER)
+	}
+
+	certs := testCerts{caFile: write("ca.crt", "CERTIFICATE", caDER)}
+	certs.serverCert, certs.serverKey = issue("server", 2, x509.ExtKeyUsageServerAuth)
+	certs.clientCert, certs.clientKey = issue("alice", 3, x509.ExtKeyUsageClientAuth)
+	return certs
+}
+
+func loopbackAddr(l net.Listener) string {
+	return fmt.Sprintf("127.0.0.1:%d", l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestTLSClientCertPrincipal(t *testing.T) {
+	certs := generateCerts(t)
+	serverConfig, err := qcommon.ServerTLSConfig(certs.serverCert, certs.serverKey, certs.caFile, false)
+	if err != nil {
+		t.Fatalf("server config: %v", err)
+	}
+	l, err := listenTCP(0, serverConfig, "h2", "http/1.1")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	principals := make(chan string, 2)
+	go http.Serve(l, authenticate(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principals <- qcommon.PrincipalFrom(r.Context())
+		fmt.Fprint(w, `{"Id":"tlsq"}`)
+	})))
+	defer l.Close()
+
+	defer func(host string, port int) {
+		qclient.Host, qclient.Port, qclient.TLSConfig = host, port, nil
+	}(qclient.Host, qclient.Port)
+	qclient.Host = "127.0.0.1"
+	qclient.Port = l.Addr().(*net.TCPAddr).Port
+
+	qclient.TLSConfig, _ = qcommon.ClientTLSConfig(certs.caFile, certs.clientCert, certs.clientKey)
+	if _, err := qclient.GetQueue("tlsq"); err != nil {
+		t.Fatalf("unexpected error with client certificate: %v", err)
+	}
+	if got := <-principals; got != "alice" {
+		t.Errorf("want principal alice, got %q", got)
+	}
+
+	qclient.TLSConfig, _ = qcommon.ClientTLSConfig(certs.caFile, "", "")
+	if _, err := qclient.GetQueue("tlsq"); err != nil {
+		t.Fatalf("unexpected error without client certificate: %v", err)
+	}
+	if got := <-principals; got != "" {
+		t.Errorf("want no principal, got %q", got)
+	}
+
+	qclient.TLSConfig, _ = qcommon.ClientTLSConfig("", "", "")
+	if _, err := qclient.GetQueue("tlsq"); err == nil {
+		t.Errorf("expected error for untrusted server certificate")
+	}
+}
+
+func TestTLSRequireClientCert(t *testing.T) {
+	certs := generateCerts(t)
+	serverConfig, _ := qcommon.ServerTLSConfig(certs.serverCert, certs.serverKey, certs.caFile, true)
+	l, _ := listenTCP(0, serverConfig)
+	srv := qbinary.NewServer(service{newRegistry()})
+	srv.Authenticate = func(string) (string, bool) { return "", false }
+	go srv.Serve(l)
+	defer srv.Close()
+
+	config, _ := qcommon.ClientTLSConfig(certs.caFile, "", "")
+	if client, err := qbinary.DialTLS("tcp", loopbackAddr(l), config); err == nil {
+		_, err = client.CreateQueue(ctx, "tlsq")
+		client.Close()
+		if err == nil {
+			t.Errorf("expected error without client certificate")
+		}
+	}
+
+	// the client certificate authenticates the connection without a token
+	config, _ = qcommon.ClientTLSConfig(certs.caFile, certs.clientCert, certs.clientKey)
+	client, err := qbinary.DialTLS("tcp", loopbackAddr(l), config)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.CreateQueue(ctx, "tlsq"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestGRPCOverTLS(t *testing.T) {
+	certs := generateCerts(t)
+	serverConfig, _ := qcommon.ServerTLSConfig(certs.serverCert, certs.serverKey, certs.caFile, false)
+	l, _ := listenTCP(0, serverConfig, "h2")
+	srv := qrpc.NewHTTPServer(service{newRegistry()})
+	go srv.Serve(l)
+	defer srv.Close()
+
+	defer func() { qclient.TLSConfig = nil }()
+	qclient.TLSConfig, _ = qcommon.ClientTLSConfig(certs.caFile, "", "")
+	client := qclient.NewGRPCTransport(loopbackAddr(l), nil)
+	if _, err := client.CreateQueue(ctx, "tlsq"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
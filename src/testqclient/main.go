@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"qclient"
+	"qcommon"
 	"time"
 )
 
@@ -14,8 +16,18 @@ const readTimeout = time.Duration(1) * time.Second
 var (
 	port = flag.Int("port", 4242, "the port the server is listening on")
 	host = flag.String("host", "localhost", "the host the server is running on")
+	grpcPort = flag.Int("grpc_port", 0, "if set, use the gRPC API on this port instead of HTTP")
+	token = flag.String("token", "", "bearer token for servers that require authentication")
+	tlsCA = flag.String("tls_ca", "", "if set, connect over TLS trusting this PEM CA bundle")
+	tlsCert = flag.String("tls_cert", "", "PEM client certificate to present over TLS")
+	tlsKey = flag.String("tls_key", "", "PEM private key for --tls_cert")
+	binaryPort = flag.Int("binary_port", 0, "if set, use the binary protocol on this port instead of HTTP")
 	queue = flag.String("queue", "q", "the name of the queue that has been created")
-	count = flag.Int("count", 100, "the number of operations to attempt")
+	count = flag.Int("count", 100, "the number of operations to attempt, or with --verify of objects per producer")
+	verifyMode = flag.Bool("verify", false, "enqueue numbered objects and report those lost, duplicated or out of order, exiting 1 if any were")
+	producerCount = flag.Int("producers", 4, "the number of goroutines enqueuing with --verify")
+	consumerCount = flag.Int("consumers", 4, "the number of goroutines dequeuing with --verify")
+	settle = flag.Duration("settle", 2 * time.Second, "how long the queue must stay empty after the producers finish for --verify to end")
 )
 
 func main() {
@@ -23,12 +35,37 @@ func main() {
 
 	qclient.Host = *host
 	qclient.Port = *port
+	qclient.Token = *token
+	if *tlsCA != "" {
+		config, err := qcommon.ClientTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		qclient.TLSConfig = config
+	}
+	if *grpcPort != 0 {
+		qclient.DefaultTransport = qclient.NewGRPCTransport(fmt.Sprintf("%s:%d", *host, *grpcPort), nil)
+	}
+	if *binaryPort != 0 {
+		transport, err := qclient.NewBinaryTransport("tcp", fmt.Sprintf("%s:%d", *host, *binaryPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		qclient.DefaultTransport = transport
+	}
 
 	id, err := qclient.GetQueue(*queue)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *verifyMode {
+		if !verify(id) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	for i := 0; i < *count; i++ {
 		if rand.Float32() > 0.5 {
 			if err = qclient.Enqueue(id, []byte(fmt.Sprintf("object%d", i))); err != nil {
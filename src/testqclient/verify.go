@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"qclient"
+	"qcommon"
+	"qrpc"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// verifyFormat is the object a producer enqueues in --verify mode: the run's
+// tag, so that objects left by other runs aren't counted, the producer and
+// its sequence number.
+const verifyFormat = "verify %016x %d %d"
+
+// received is an object a consumer dequeued.
+type received struct {
+	producer	int
+	seq	int
+}
+
+// producerLog is what a producer enqueued; acked[seq] is whether the server
+// accepted seq. A failed enqueue may still have been applied.
+type producerLog struct {
+	acked	[]bool
+	failed	int
+}
+
+// consumerLog is what a consumer dequeued, in order.
+type consumerLog struct {
+	received	[]received
+	foreign	int
+}
+
+// producerReport is what became of one producer's objects. Lost objects were
+// accepted but never dequeued, duplicated ones were dequeued more than once
+// and out of order ones were dequeued by a consumer after a later one from
+// the same producer.
+type producerReport struct {
+	sent	int
+	failed	int
+	received	int
+	lost	[]int
+	duplicated	[]int
+	outOfOrder	[]int
+}
+
+func (r producerReport) ok() bool {
+	return len(r.lost) == 0 && len(r.duplicated) == 0 && len(r.outOfOrder) == 0
+}
+
+// verify runs --producers goroutines each enqueuing --count tagged objects
+// and --consumers goroutines dequeuing them until the producers are done and
+// the queue has stayed empty for --settle, then reports per producer what was
+// lost, duplicated or reordered. It returns false if anything was.
+func verify(id qcommon.QueueId) bool {
+	ctx := context.Background()
+	tag := rand.Uint64()
+	producers := make([]producerLog, *producerCount)
+	consumers := make([]consumerLog, *consumerCount)
+
+	var produced int32
+	var wg sync.WaitGroup
+	for p := range producers {
+		wg.Add(1)
+		go func(p int, l *producerLog) {
+			defer wg.Done()
+			defer atomic.AddInt32(&produced, 1)
+			l.acked = make([]bool, *count)
+			for seq := range l.acked {
+				object := fmt.Sprintf(verifyFormat, tag, p, seq)
+				if err := qclient.DefaultTransport.Enqueue(ctx, id, []byte(object)); err != nil {
+					log.Printf("enq: %v", err)
+					l.failed++
+					continue
+				}
+				l.acked[seq] = true
+			}
+		}(p, &producers[p])
+	}
+	for c := range consumers {
+		wg.Add(1)
+		go func(l *consumerLog) {
+			defer wg.Done()
+			var emptySince time.Time
+			for {
+				object, err := qclient.DefaultTransport.Dequeue(ctx, id)
+				if err == nil {
+					emptySince = time.Time{}
+					var t uint64
+					var r received
+					if n, _ := fmt.Sscanf(string(object), verifyFormat, &t, &r.producer, &r.seq); n != 3 || t != tag || r.producer >= len(producers) || r.seq >= *count {
+						l.foreign++
+						continue
+					}
+					l.received = append(l.received, r)
+					continue
+				}
+				if !isEmpty(err) {
+					log.Printf("deq: %v", err)
+				} else if int(atomic.LoadInt32(&produced)) == len(producers) {
+					if emptySince.IsZero() {
+						emptySince = time.Now()
+					} else if time.Since(emptySince) >= *settle {
+						return
+					}
+				}
+				time.Sleep(verifyPoll)
+			}
+		}(&consumers[c])
+	}
+	wg.Wait()
+
+	reports := verifyReports(producers, consumers)
+	ok := printVerifyReports(reports)
+	foreign := 0
+	for _, l := range consumers {
+		foreign += l.foreign
+	}
+	if foreign > 0 {
+		fmt.Printf("\nignored %d objects from elsewhere\n", foreign)
+	}
+	return ok
+}
+
+// verifyPoll is how long consumers wait after an empty or failed dequeue.
+const verifyPoll = 10 * time.Millisecond
+
+// verifyReports works out what became of each producer's objects.
+func verifyReports(producers []producerLog, consumers []consumerLog) []producerReport {
+	reports := make([]producerReport, len(producers))
+	times := make([][]int, len(producers))
+	for p, l := range producers {
+		reports[p].failed = l.failed
+		reports[p].sent = len(l.acked) - l.failed
+		times[p] = make([]int, len(l.acked))
+	}
+	for _, l := range consumers {
+		last := make([]int, len(producers))
+		for p := range last {
+			last[p] = -1
+		}
+		for _, r := range l.received {
+			times[r.producer][r.seq]++
+			reports[r.producer].received++
+			if r.seq < last[r.producer] {
+				reports[r.producer].outOfOrder = append(reports[r.producer].outOfOrder, r.seq)
+			} else {
+				last[r.producer] = r.seq
+			}
+		}
+	}
+	for p, l := range producers {
+		for seq, n := range times[p] {
+			switch {
+			case n == 0 && l.acked[seq]:
+				reports[p].lost = append(reports[p].lost, seq)
+			case n > 1:
+				reports[p].duplicated = append(reports[p].duplicated, seq)
+			}
+		}
+	}
+	return reports
+}
+
+// maxListed is how many sequence numbers of each kind are listed per
+// producer.
+const maxListed = 10
+
+func printVerifyReports(reports []producerReport) bool {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "PRODUCER\tSENT\tFAILED\tRECEIVED\tLOST\tDUPLICATED\tOUT OF ORDER\n")
+	ok := true
+	for p, r := range reports {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%d\n", p, r.sent, r.failed, r.received, len(r.lost), len(r.duplicated), len(r.outOfOrder))
+		ok = ok && r.ok()
+	}
+	w.Flush()
+	for p, r := range reports {
+		for _, list := range []struct {
+			name	string
+			seqs	[]int
+		}{{"lost", r.lost}, {"duplicated", r.duplicated}, {"out of order", r.outOfOrder}} {
+			if len(list.seqs) > 0 {
+				fmt.Printf("producer %d %s: %s\n", p, list.name, formatSeqs(list.seqs))
+			}
+		}
+	}
+	return ok
+}
+
+func formatSeqs(seqs []int) string {
+	var b strings.Builder
+	for i, seq := range seqs {
+		if i == maxListed {
+			fmt.Fprintf(&b, " and %d more", len(seqs) - i)
+			break
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%d", seq)
+	}
+	return b.String()
+}
+
+// isEmpty reports whether err is a dequeue from an empty queue. The HTTP API
+// says so only in its message.
+func isEmpty(err error) bool {
+	return errors.Is(err, qrpc.ErrEmpty) || strings.Contains(err.Error(), "empty queue")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// got is what a consumer received, as producer and sequence number pairs.
+func got(pairs ...int) consumerLog {
+	var l consumerLog
+	for i := 0; i < len(pairs); i += 2 {
+		l.received = append(l.received, received{producer: pairs[i], seq: pairs[i + 1]})
+	}
+	return l
+}
+
+func TestVerifyReports(t *testing.T) {
+	for _, test := range []struct {
+		name	string
+		producers	[]producerLog
+		consumers	[]consumerLog
+		want	[]producerReport
+	}{
+		{
+			"all received",
+			[]producerLog{{acked: []bool{true, true, true}}},
+			[]consumerLog{got(0, 0, 0, 1), got(0, 2)},
+			[]producerReport{{sent: 3, received: 3}},
+		},
+		{
+			"lost",
+			[]producerLog{{acked: []bool{true, true, true}}},
+			[]consumerLog{got(0, 0, 0, 2)},
+			[]producerReport{{sent: 3, received: 2, lost: []int{1}}},
+		},
+		{
+			"failed enqueue never received",
+			[]producerLog{{acked: []bool{true, false, true}, failed: 1}},
+			[]consumerLog{got(0, 0, 0, 2)},
+			[]producerReport{{sent: 2, failed: 1, received: 2}},
+		},
+		{
+			"failed enqueue applied anyway",
+			[]producerLog{{acked: []bool{true, false}, failed: 1}},
+			[]consumerLog{got(0, 0, 0, 1)},
+			[]producerReport{{sent: 1, failed: 1, received: 2}},
+		},
+		{
+			"duplicated across consumers",
+			[]producerLog{{acked: []bool{true, true}}},
+			[]consumerLog{got(0, 0, 0, 1), got(0, 1)},
+			[]producerReport{{sent: 2, received: 3, duplicated: []int{1}}},
+		},
+		{
+			"out of order within a consumer",
+			[]producerLog{{acked: []bool{true, true, true}}},
+			[]consumerLog{got(0, 0, 0, 2, 0, 1)},
+			[]producerReport{{sent: 3, received: 3, outOfOrder: []int{1}}},
+		},
+		{
+			// consumers race each other, so only each one's order counts
+			"interleaved across consumers",
+			[]producerLog{{acked: []bool{true, true}}},
+			[]consumerLog{got(0, 1), got(0, 0)},
+			[]producerReport{{sent: 2, received: 2}},
+		},
+		{
+			"producers reported apart",
+			[]producerLog{{acked: []bool{true, true}}, {acked: []bool{true, true}}},
+			[]consumerLog{got(1, 1, 0, 0, 1, 0, 0, 1, 0, 1)},
+			[]producerReport{{sent: 2, received: 3, duplicated: []int{1}}, {sent: 2, received: 2, outOfOrder: []int{0}}},
+		},
+	} {
+		if got := verifyReports(test.producers, test.consumers); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFormatSeqs(t *testing.T) {
+	for _, test := range []struct {
+		seqs	[]int
+		want	string
+	}{
+		{nil, ""},
+		{[]int{7}, "7"},
+		{[]int{1, 2, 3}, "1, 2, 3"},
+		{[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, "0, 1, 2, 3, 4, 5, 6, 7, 8, 9"},
+		{[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, "0, 1, 2, 3, 4, 5, 6, 7, 8, 9 and 2 more"},
+	} {
+		if got := formatSeqs(test.seqs); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.seqs, got, test.want)
+		}
+	}
+}